@@ -0,0 +1,406 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/peonone/gearman"
+)
+
+// ErrConnClosed is returned for the requests and jobs which are still pending when the connection is closed
+var ErrConnClosed = errors.New("Connection closed")
+
+// ErrResultNotFound is returned by Result and ResultUnique if the server doesn't keep the result or it's expired
+var ErrResultNotFound = errors.New("Result not found")
+
+// ErrJobNotFound is returned by Cancel and CancelUnique if the job is not found or done
+var ErrJobNotFound = errors.New("Job not found")
+
+const exceptionsOption = "exceptions"
+
+var idGen = gearman.NewIDGenerator()
+
+// ServerError is returned if the server responds a request with an ERROR packet
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// pendingReq is a request waiting for its direct response(JOB_CREATED, ERROR, OPTION_RES...)
+// the server responds the requests of a connection in order, so they are kept in a FIFO
+type pendingReq struct {
+	// job is registered to the client once JOB_CREATED received
+	// it's done in the read loop so that no WORK_* packet of the job would be missed
+	job   *Job
+	reply chan *gearman.Message
+	// txtReply is set instead of reply for the commands of the administrative protocol
+	txtReply chan string
+}
+
+// Client is a gearman client which submits jobs to a gearman server
+type Client struct {
+	conn      gearman.Conn
+	mu        sync.Mutex
+	pending   []*pendingReq
+	jobs      map[string][]*Job
+	err       error
+	closeOnce sync.Once
+}
+
+// Dial connects to the gearman server and creates a client on the connection
+func Dial(network, addr string) (*Client, error) {
+	netConn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(gearman.NewNetConn(netConn, idGen.Generate()))
+}
+
+// DialTLS connects to the gearman server over TLS and creates a client on the connection
+// config carries the CAs to verify the server and the client certificate if the server requires one
+func DialTLS(network, addr string, config *tls.Config) (*Client, error) {
+	netConn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(gearman.NewNetConn(netConn, idGen.Generate()))
+}
+
+// NewClient creates a client on an established connection
+func NewClient(conn gearman.Conn) (*Client, error) {
+	c := &Client{
+		conn: conn,
+		jobs: make(map[string][]*Job),
+	}
+	go c.readLoop()
+
+	// ask the server to forward WORK_EXCEPTION instead of converting it to WORK_FAIL
+	_, err := c.request(context.Background(), gearman.OPTION_REQ, []string{exceptionsOption}, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Submit submits a foreground job with normal priority
+func (c *Client) Submit(ctx context.Context, function string, uniqueID string, data []byte) (*Job, error) {
+	return c.submit(ctx, gearman.SUBMIT_JOB, function, uniqueID, data)
+}
+
+// SubmitHigh submits a foreground job with high priority
+func (c *Client) SubmitHigh(ctx context.Context, function string, uniqueID string, data []byte) (*Job, error) {
+	return c.submit(ctx, gearman.SUBMIT_JOB_HIGH, function, uniqueID, data)
+}
+
+// SubmitLow submits a foreground job with low priority
+func (c *Client) SubmitLow(ctx context.Context, function string, uniqueID string, data []byte) (*Job, error) {
+	return c.submit(ctx, gearman.SUBMIT_JOB_LOW, function, uniqueID, data)
+}
+
+// SubmitBackground submits a background job with normal priority and returns the job handle
+func (c *Client) SubmitBackground(ctx context.Context, function string, uniqueID string, data []byte) (string, error) {
+	resp, err := c.request(ctx, gearman.SUBMIT_JOB_BG, []string{function, uniqueID, string(data)}, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Arguments[0], nil
+}
+
+// SubmitReduce submits a map/reduce job, the mapper function emits the sub-results with WORK_DATA,
+// then the server runs the reducer function with them, and the result of the reducer is returned by Job.Wait
+func (c *Client) SubmitReduce(ctx context.Context, mapper string, uniqueID string, reducer string, data []byte) (*Job, error) {
+	j := newJob()
+	_, err := c.request(ctx, gearman.SUBMIT_REDUCE_JOB, []string{mapper, uniqueID, reducer, string(data)}, j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (c *Client) submit(ctx context.Context, packet gearman.PacketType,
+	function string, uniqueID string, data []byte) (*Job, error) {
+	j := newJob()
+	_, err := c.request(ctx, packet, []string{function, uniqueID, string(data)}, j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// request sends a request and waits for the direct response of it
+func (c *Client) request(ctx context.Context, packet gearman.PacketType, args []string, j *Job) (*gearman.Message, error) {
+	msg := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: packet,
+		Arguments:  args,
+	}
+	req := &pendingReq{
+		job:   j,
+		reply: make(chan *gearman.Message, 1),
+	}
+	err := c.send(req, func() error {
+		return c.conn.WriteMsg(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-req.reply:
+		if !ok {
+			return nil, ErrConnClosed
+		}
+		if resp.PacketType == gearman.ERROR {
+			return nil, &ServerError{resp.Arguments[0], resp.Arguments[1]}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// requestTxt sends a command of the administrative protocol and waits for the response line
+// the server responds the text commands in order with the binary requests of the connection
+func (c *Client) requestTxt(ctx context.Context, cmd string) (string, error) {
+	req := &pendingReq{txtReply: make(chan string, 1)}
+	err := c.send(req, func() error {
+		return c.conn.WriteTxtMsg(cmd + "\n")
+	})
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case resp, ok := <-req.txtReply:
+		if !ok {
+			return "", ErrConnClosed
+		}
+		// ERR CODE Message+with+plus+as+space
+		fields := strings.Fields(resp)
+		if len(fields) > 0 && fields[0] == "ERR" {
+			serverErr := &ServerError{}
+			if len(fields) > 1 {
+				serverErr.Code = fields[1]
+			}
+			if len(fields) > 2 {
+				serverErr.Message = strings.Replace(fields[2], "+", " ", -1)
+			}
+			return "", serverErr
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// send registers the request as pending and writes it
+func (c *Client) send(req *pendingReq, write func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	// append before writing, the response may arrive before the write returns
+	c.pending = append(c.pending, req)
+	err := write()
+	if err != nil {
+		c.pending = c.pending[:len(c.pending)-1]
+	}
+	return err
+}
+
+// Result fetches the result of a background job by handle from the result store of the server
+// the data and the error are the same as Job.Wait, ErrResultNotFound is returned if the result is not kept
+func (c *Client) Result(ctx context.Context, handle string) ([]byte, error) {
+	return c.result(ctx, "result "+handle)
+}
+
+// ResultUnique fetches the result of the latest background job with the unique ID, like Result
+func (c *Client) ResultUnique(ctx context.Context, uniqueID string) ([]byte, error) {
+	return c.result(ctx, "result_unique "+uniqueID)
+}
+
+func (c *Client) result(ctx context.Context, cmd string) ([]byte, error) {
+	resp, err := c.requestTxt(ctx, cmd)
+	if serverErr, ok := err.(*ServerError); ok && serverErr.Code == "NOT_FOUND" {
+		return nil, ErrResultNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	// OK STATUS BASE64-DATA
+	fields := strings.Fields(resp)
+	if len(fields) < 2 || fields[0] != "OK" {
+		return nil, &ServerError{"INVALID_RESPONSE", resp}
+	}
+	var data []byte
+	if len(fields) > 2 {
+		data, err = base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch fields[1] {
+	case "fail":
+		return nil, ErrWorkFail
+	case "exception":
+		return nil, &WorkException{data}
+	}
+	return data, nil
+}
+
+// Cancel cancels a job by handle, the job is removed from the queue or ended if it's running,
+// the clients waiting for it get ErrWorkFail, ErrJobNotFound is returned if the job is not found or done
+func (c *Client) Cancel(ctx context.Context, handle string) error {
+	return c.cancel(ctx, "cancel "+handle)
+}
+
+// CancelUnique cancels the job with the unique ID, like Cancel
+func (c *Client) CancelUnique(ctx context.Context, uniqueID string) error {
+	return c.cancel(ctx, "cancel_unique "+uniqueID)
+}
+
+func (c *Client) cancel(ctx context.Context, cmd string) error {
+	_, err := c.requestTxt(ctx, cmd)
+	if serverErr, ok := err.(*ServerError); ok && serverErr.Code == "NOT_FOUND" {
+		return ErrJobNotFound
+	}
+	return err
+}
+
+func (c *Client) readLoop() {
+	for {
+		msg, txtMsg, err := c.conn.ReadMsg()
+		if err != nil {
+			c.shutdown()
+			return
+		}
+		if msg == nil {
+			c.dispatchTxt(txtMsg)
+			continue
+		}
+		if msg.Validate(gearman.RoleClient) != nil {
+			gearman.MsgPool.Put(msg)
+			continue
+		}
+		c.dispatch(msg)
+	}
+}
+
+// dispatchTxt hands the response line over to the pending text command
+func (c *Client) dispatchTxt(txtMsg string) {
+	c.mu.Lock()
+	if len(c.pending) == 0 || c.pending[0].txtReply == nil {
+		// not expected
+		c.mu.Unlock()
+		return
+	}
+	req := c.pending[0]
+	c.pending = c.pending[1:]
+	c.mu.Unlock()
+	req.txtReply <- txtMsg
+}
+
+func (c *Client) dispatch(msg *gearman.Message) {
+	switch msg.PacketType {
+	case gearman.JOB_CREATED, gearman.ERROR, gearman.OPTION_RES, gearman.ECHO_RES,
+		gearman.STATUS_RES, gearman.STATUS_RES_UNIQUE:
+		c.mu.Lock()
+		if len(c.pending) == 0 || c.pending[0].reply == nil {
+			c.mu.Unlock()
+			gearman.MsgPool.Put(msg)
+			return
+		}
+		req := c.pending[0]
+		c.pending = c.pending[1:]
+		if req.job != nil && msg.PacketType == gearman.JOB_CREATED {
+			handle := msg.Arguments[0]
+			req.job.Handle = handle
+			c.jobs[handle] = append(c.jobs[handle], req.job)
+		}
+		c.mu.Unlock()
+		// the message is handed over to the requester, so not put back to the pool
+		req.reply <- msg
+	case gearman.WORK_STATUS:
+		num, numErr := strconv.Atoi(msg.Arguments[1])
+		den, denErr := strconv.Atoi(msg.Arguments[2])
+		if numErr == nil && denErr == nil {
+			for _, j := range c.getJobs(msg.Arguments[0], false) {
+				j.setProgress(num, den)
+			}
+		}
+		gearman.MsgPool.Put(msg)
+	case gearman.WORK_COMPLETE, gearman.WORK_FAIL, gearman.WORK_EXCEPTION:
+		var data []byte
+		var err error
+		switch msg.PacketType {
+		case gearman.WORK_COMPLETE:
+			data = []byte(msg.Arguments[1])
+		case gearman.WORK_FAIL:
+			err = ErrWorkFail
+		case gearman.WORK_EXCEPTION:
+			err = &WorkException{[]byte(msg.Arguments[1])}
+		}
+		for _, j := range c.getJobs(msg.Arguments[0], true) {
+			j.resolve(data, err)
+		}
+		gearman.MsgPool.Put(msg)
+	default:
+		// WORK_DATA and WORK_WARNING are ignored for now
+		gearman.MsgPool.Put(msg)
+	}
+}
+
+func (c *Client) getJobs(handle string, remove bool) []*Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	jobs := c.jobs[handle]
+	if remove {
+		delete(c.jobs, handle)
+	}
+	return jobs
+}
+
+// shutdown fails all pending requests and jobs after the connection is broken
+func (c *Client) shutdown() {
+	c.mu.Lock()
+	c.err = ErrConnClosed
+	pending := c.pending
+	jobs := c.jobs
+	c.pending = nil
+	c.jobs = make(map[string][]*Job)
+	c.mu.Unlock()
+
+	for _, req := range pending {
+		if req.txtReply != nil {
+			close(req.txtReply)
+		} else {
+			close(req.reply)
+		}
+	}
+	for _, handleJobs := range jobs {
+		for _, j := range handleJobs {
+			j.resolve(nil, ErrConnClosed)
+		}
+	}
+	c.Close()
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient creates a client connected to a fake server through a pipe
+// the OPTION_REQ sent by NewClient is answered before returning
+func newTestClient(t *testing.T) (*Client, *gearman.NetConn) {
+	clientSide, serverSide := net.Pipe()
+	srvConn := gearman.NewNetConn(serverSide, idGen.Generate())
+	go func() {
+		msg, _, err := srvConn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, gearman.OPTION_REQ, msg.PacketType)
+		assert.Equal(t, []string{exceptionsOption}, msg.Arguments)
+		writeRes(srvConn, gearman.OPTION_RES, exceptionsOption)
+	}()
+	c, err := NewClient(gearman.NewNetConn(clientSide, idGen.Generate()))
+	assert.Nil(t, err)
+	return c, srvConn
+}
+
+func writeRes(conn gearman.Conn, packet gearman.PacketType, args ...string) {
+	conn.WriteMsg(&gearman.Message{
+		MagicType:  gearman.MagicRes,
+		PacketType: packet,
+		Arguments:  args,
+	})
+}
+
+func TestSubmit(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, packet := range []gearman.PacketType{gearman.SUBMIT_JOB, gearman.SUBMIT_JOB_HIGH, gearman.SUBMIT_JOB_LOW} {
+		go func(packet gearman.PacketType) {
+			msg, _, err := srvConn.ReadMsg()
+			assert.Nil(t, err)
+			assert.Equal(t, gearman.MagicReq, msg.MagicType)
+			assert.Equal(t, packet, msg.PacketType)
+			assert.Equal(t, []string{"reverse", "uniq1", "hello"}, msg.Arguments)
+			writeRes(srvConn, gearman.JOB_CREATED, "H:1")
+			writeRes(srvConn, gearman.WORK_STATUS, "H:1", "1", "2")
+			writeRes(srvConn, gearman.WORK_DATA, "H:1", "partial")
+			writeRes(srvConn, gearman.WORK_COMPLETE, "H:1", "olleh")
+		}(packet)
+
+		var j *Job
+		var err error
+		switch packet {
+		case gearman.SUBMIT_JOB:
+			j, err = c.Submit(ctx, "reverse", "uniq1", []byte("hello"))
+		case gearman.SUBMIT_JOB_HIGH:
+			j, err = c.SubmitHigh(ctx, "reverse", "uniq1", []byte("hello"))
+		case gearman.SUBMIT_JOB_LOW:
+			j, err = c.SubmitLow(ctx, "reverse", "uniq1", []byte("hello"))
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, "H:1", j.Handle)
+		data, err := j.Wait(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("olleh"), data)
+		num, den := j.Progress()
+		assert.Equal(t, 1, num)
+		assert.Equal(t, 2, den)
+	}
+}
+
+func TestSubmitReduce(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	go func() {
+		msg, _, err := srvConn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, gearman.SUBMIT_REDUCE_JOB, msg.PacketType)
+		assert.Equal(t, []string{"split", "uniq1", "count", "a b c"}, msg.Arguments)
+		writeRes(srvConn, gearman.JOB_CREATED, "H:3")
+		writeRes(srvConn, gearman.WORK_COMPLETE, "H:3", "3")
+	}()
+	j, err := c.SubmitReduce(ctx, "split", "uniq1", "count", []byte("a b c"))
+	assert.Nil(t, err)
+	data, err := j.Wait(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), data)
+}
+
+func TestSubmitBackground(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+
+	go func() {
+		msg, _, err := srvConn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, gearman.SUBMIT_JOB_BG, msg.PacketType)
+		writeRes(srvConn, gearman.JOB_CREATED, "H:2")
+	}()
+	handle, err := c.SubmitBackground(context.Background(), "reverse", "", []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "H:2", handle)
+}
+
+func TestSubmitFailed(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	go func() {
+		srvConn.ReadMsg()
+		writeRes(srvConn, gearman.JOB_CREATED, "H:1")
+		srvConn.ReadMsg()
+		writeRes(srvConn, gearman.JOB_CREATED, "H:2")
+		srvConn.ReadMsg()
+		writeRes(srvConn, gearman.ERROR, "queue_full", "too many jobs")
+		writeRes(srvConn, gearman.WORK_EXCEPTION, "H:2", "boom")
+		writeRes(srvConn, gearman.WORK_FAIL, "H:1")
+	}()
+
+	job1, err := c.Submit(ctx, "reverse", "1", nil)
+	assert.Nil(t, err)
+	job2, err := c.Submit(ctx, "reverse", "2", nil)
+	assert.Nil(t, err)
+	_, err = c.Submit(ctx, "reverse", "3", nil)
+	assert.Equal(t, &ServerError{"queue_full", "too many jobs"}, err)
+
+	_, err = job1.Wait(ctx)
+	assert.Equal(t, ErrWorkFail, err)
+	_, err = job2.Wait(ctx)
+	assert.Equal(t, &WorkException{[]byte("boom")}, err)
+}
+
+func TestConnClosed(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	ctx := context.Background()
+
+	go func() {
+		srvConn.ReadMsg()
+		writeRes(srvConn, gearman.JOB_CREATED, "H:1")
+		srvConn.ReadMsg()
+		srvConn.Close()
+	}()
+	j, err := c.Submit(ctx, "reverse", "1", nil)
+	assert.Nil(t, err)
+	_, err = c.Submit(ctx, "reverse", "2", nil)
+	assert.Equal(t, ErrConnClosed, err)
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = j.Wait(waitCtx)
+	assert.Equal(t, ErrConnClosed, err)
+
+	_, err = c.Submit(ctx, "reverse", "3", nil)
+	assert.Equal(t, ErrConnClosed, err)
+}
+
+func TestResult(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	cases := []struct {
+		resp string
+		data []byte
+		err  error
+	}{
+		{"OK complete b2xsZWg=\n", []byte("olleh"), nil},
+		{"OK fail \n", nil, ErrWorkFail},
+		{"OK exception Ym9vbQ==\n", nil, &WorkException{[]byte("boom")}},
+		{"ERR NOT_FOUND The+result+is+not+found+or+expired\n", nil, ErrResultNotFound},
+		{"ERR NOT_SUPPORTED The+result+store+is+not+enabled\n", nil,
+			&ServerError{"NOT_SUPPORTED", "The result store is not enabled"}},
+	}
+	for _, tc := range cases {
+		go func(resp string) {
+			_, txtMsg, err := srvConn.ReadMsg()
+			assert.Nil(t, err)
+			assert.Equal(t, "result H:1", txtMsg)
+			srvConn.WriteTxtMsg(resp)
+		}(tc.resp)
+		data, err := c.Result(ctx, "H:1")
+		assert.Equal(t, tc.err, err, tc.resp)
+		assert.Equal(t, tc.data, data, tc.resp)
+	}
+
+	// the text response is matched with the command in order with the binary requests
+	go func() {
+		msg, _, err := srvConn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, gearman.SUBMIT_JOB_BG, msg.PacketType)
+		_, txtMsg, err := srvConn.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, "result_unique uniq1", txtMsg)
+		writeRes(srvConn, gearman.JOB_CREATED, "H:2")
+		srvConn.WriteTxtMsg("OK complete aGk=\n")
+	}()
+	handleCh := make(chan string, 1)
+	go func() {
+		handle, err := c.SubmitBackground(ctx, "reverse", "uniq1", []byte("ih"))
+		assert.Nil(t, err)
+		handleCh <- handle
+	}()
+	time.Sleep(time.Millisecond * 20)
+	data, err := c.ResultUnique(ctx, "uniq1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hi"), data)
+	assert.Equal(t, "H:2", <-handleCh)
+}
+
+func TestCancel(t *testing.T) {
+	c, srvConn := newTestClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	cases := []struct {
+		byUnique bool
+		cmd      string
+		resp     string
+		err      error
+	}{
+		{false, "cancel H:1", "OK\n", nil},
+		{false, "cancel H:1", "ERR NOT_FOUND The+job+is+not+found+or+done\n", ErrJobNotFound},
+		{true, "cancel_unique uniq1", "OK\n", nil},
+		{true, "cancel_unique uniq1", "ERR INTERNAL_ERROR boom\n", &ServerError{"INTERNAL_ERROR", "boom"}},
+	}
+	for _, tc := range cases {
+		go func(cmd, resp string) {
+			_, txtMsg, err := srvConn.ReadMsg()
+			assert.Nil(t, err)
+			assert.Equal(t, cmd, txtMsg)
+			srvConn.WriteTxtMsg(resp)
+		}(tc.cmd, tc.resp)
+		var err error
+		if tc.byUnique {
+			err = c.CancelUnique(ctx, "uniq1")
+		} else {
+			err = c.Cancel(ctx, "H:1")
+		}
+		assert.Equal(t, tc.err, err, tc.resp)
+	}
+}
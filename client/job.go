@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrWorkFail is returned by Job.Wait if the worker failed the job
+var ErrWorkFail = errors.New("Work failed")
+
+// WorkException is returned by Job.Wait if the worker reported an exception for the job
+type WorkException struct {
+	Data []byte
+}
+
+func (e *WorkException) Error() string {
+	return "Work exception: " + string(e.Data)
+}
+
+// Job represents a foreground job submitted by the client
+// the result is resolved when the server forwards WORK_COMPLETE, WORK_FAIL or WORK_EXCEPTION of it
+type Job struct {
+	// Handle is the job handle assigned by the server(from JOB_CREATED)
+	Handle string
+
+	mu          sync.Mutex
+	done        chan struct{}
+	numerator   int
+	denominator int
+	data        []byte
+	err         error
+}
+
+func newJob() *Job {
+	return &Job{
+		done: make(chan struct{}),
+	}
+}
+
+// Done returns a channel which is closed when the result of the job is resolved
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits until the job result is resolved or the context is done
+// it returns the data of WORK_COMPLETE, or an error if the job failed
+func (j *Job) Wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-j.done:
+		return j.data, j.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Progress returns the latest progress reported by WORK_STATUS
+func (j *Job) Progress() (numerator int, denominator int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.numerator, j.denominator
+}
+
+func (j *Job) setProgress(numerator int, denominator int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.numerator = numerator
+	j.denominator = denominator
+}
+
+// resolve must be called only once for a job
+func (j *Job) resolve(data []byte, err error) {
+	j.data = data
+	j.err = err
+	close(j.done)
+}
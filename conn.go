@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -23,14 +24,21 @@ type Conn interface {
 	Closed() <-chan struct{}
 }
 
+// ErrMessageTimeout is returned by NetConn.ReadMsg if the rest of a message doesn't arrive in the idle timeout,
+// the message is read partially, so the connection can't be read any more
+var ErrMessageTimeout = errors.New("Timeout reading the rest of the message")
+
 // NetConn is a Conn implementation of the net connection
 type NetConn struct {
-	conn    net.Conn
-	id      *ID
-	closed  chan struct{}
-	reader  *bufio.Reader
-	logger  *log.Logger
-	verbose bool
+	conn        net.Conn
+	id          *ID
+	closed      chan struct{}
+	reader      *bufio.Reader
+	logger      *log.Logger
+	verbose     bool
+	maxBodySize uint32
+	idleTimeout time.Duration
+	closeOnce   sync.Once
 }
 
 // NewNetConn creates a NetConn
@@ -43,33 +51,77 @@ func NewNetConn(conn net.Conn, id *ID) *NetConn {
 	}
 }
 
+// SetMaxBodySize sets the max body size of the messages read from the connection
+// ReadMsg returns ErrBodyTooLarge for the message exceeds it, 0 means no limit
+func (c *NetConn) SetMaxBodySize(size uint32) {
+	c.maxBodySize = size
+}
+
+// SetIdleTimeout sets how long the connection waits for the next message, 0 means no limit
+// ReadMsg returns a timeout net.Error if no message arrives in it, or ErrMessageTimeout if the rest of a message
+// doesn't arrive in another timeout, and a write blocked for it fails,
+// so a half-dead peer never blocks the goroutines reading or writing the connection
+func (c *NetConn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
 // ReadMsg reads next Message from the net connection
 func (c *NetConn) ReadMsg() (*Message, string, error) {
-	return NextMessage(c.reader)
+	if c.idleTimeout <= 0 {
+		return NextMessageLimit(c.reader, c.maxBodySize)
+	}
+	if c.reader.Buffered() == 0 {
+		// the wait for the first byte is the idle time, the message is not read partially on its timeout
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		_, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	// a peer stalled in the middle of a message never blocks the reader either
+	c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	msg, txtMsg, err := NextMessageLimit(c.reader, c.maxBodySize)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, "", ErrMessageTimeout
+	}
+	return msg, txtMsg, err
+}
+
+func (c *NetConn) setWriteDeadline() {
+	if c.idleTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+	}
 }
 
 // WriteMsg writes a Message to the net connection
 func (c *NetConn) WriteMsg(msg *Message) error {
+	c.setWriteDeadline()
 	_, err := msg.WriteTo(c.conn)
 	return err
 }
 
 // WriteTxtMsg writes a Message to the net connection
 func (c *NetConn) WriteTxtMsg(content string) error {
+	c.setWriteDeadline()
 	_, err := c.conn.Write([]byte(content))
 	return err
 }
 
 // WriteBin writes an encoded binary message to the net connection
 func (c *NetConn) WriteBin(binData []byte) error {
+	c.setWriteDeadline()
 	_, err := c.conn.Write(binData)
 	return err
 }
 
-// Close closes the connection
+// Close closes the connection, it's safe to call Close more than once
 func (c *NetConn) Close() error {
-	close(c.closed)
-	return c.conn.Close()
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.conn.Close()
+	})
+	return err
 }
 
 // Closed returns the closed channel
@@ -86,6 +138,15 @@ func (c *NetConn) String() string {
 	return fmt.Sprintf("%s(%s)", c.conn.RemoteAddr(), c.id)
 }
 
+// mockTimeoutError is returned by MockConn.ReadMsg if no message arrives in time, like a net read deadline
+type mockTimeoutError struct{}
+
+func (mockTimeoutError) Error() string   { return "timeout" }
+func (mockTimeoutError) Timeout() bool   { return true }
+func (mockTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = mockTimeoutError{}
+
 // MockConn is a Conn implementation by channel
 // the main purpose of this is for unit test
 type MockConn struct {
@@ -96,6 +157,7 @@ type MockConn struct {
 	Timeout    time.Duration
 	ConnID     *ID
 	closed     chan struct{}
+	closeOnce  sync.Once
 }
 
 // NewMockConn creates a new MockConn
@@ -121,7 +183,7 @@ func (c *MockConn) ReadMsg() (*Message, string, error) {
 	case txt := <-c.ReadTxtCh:
 		return nil, txt, nil
 	case <-time.After(c.Timeout):
-		return nil, "", errors.New("timeout")
+		return nil, "", mockTimeoutError{}
 	}
 }
 
@@ -129,7 +191,17 @@ func (c *MockConn) ReadMsg() (*Message, string, error) {
 func (c *MockConn) WriteMsg(m *Message) error {
 	// copy the Message struct as we will the original one to the pool for re-use
 	msgCopy := *m
-	c.WriteCh <- &msgCopy
+	return c.write(&msgCopy)
+}
+
+// write sends the message to WriteCh, io.ErrClosedPipe is returned if the connection is closed
+func (c *MockConn) write(m *Message) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = io.ErrClosedPipe
+		}
+	}()
+	c.WriteCh <- m
 	return nil
 }
 
@@ -146,8 +218,7 @@ func (c *MockConn) WriteBin(binData []byte) error {
 	if err != nil {
 		return err
 	}
-	c.WriteCh <- msg
-	return nil
+	return c.write(msg)
 }
 
 func (c *MockConn) closeChan(ch chan *Message) {
@@ -157,11 +228,13 @@ func (c *MockConn) closeChan(ch chan *Message) {
 	close(ch)
 }
 
-// Close closes the mock connection
+// Close closes the mock connection, it's safe to call Close more than once
 func (c *MockConn) Close() error {
-	close(c.closed)
-	c.closeChan(c.ReadCh)
-	c.closeChan(c.WriteCh)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.closeChan(c.ReadCh)
+		c.closeChan(c.WriteCh)
+	})
 	return nil
 }
 
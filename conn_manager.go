@@ -38,3 +38,14 @@ func (m *ConnManager) RemoveConn(id *ID) {
 	defer m.mu.Unlock()
 	delete(m.conns, *id)
 }
+
+// Conns returns all connections in the manager
+func (m *ConnManager) Conns() []Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]Conn, 0, len(m.conns))
+	for _, conn := range m.conns {
+		ret = append(ret, conn)
+	}
+	return ret
+}
@@ -0,0 +1,46 @@
+package gearman
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetConnIdleTimeout(t *testing.T) {
+	srv, peer := net.Pipe()
+	defer peer.Close()
+	c := NewNetConn(srv, NewIDGenerator().Generate())
+	c.SetIdleTimeout(time.Millisecond * 20)
+
+	_, _, err := c.ReadMsg()
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok)
+	assert.True(t, netErr.Timeout())
+
+	// the message is read after the timeout, the rest of it arrives in another idle timeout
+	msg := &Message{MagicType: MagicReq, PacketType: ECHO_REQ, Arguments: []string{"hello"}}
+	bin, err := msg.Encode()
+	assert.Nil(t, err)
+	go func() {
+		peer.Write(bin[:5])
+		time.Sleep(time.Millisecond * 5)
+		peer.Write(bin[5:])
+	}()
+	read, _, err := c.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello"}, read.Arguments)
+
+	// the peer stalls in the middle of a message
+	go peer.Write(bin[:5])
+	_, _, err = c.ReadMsg()
+	assert.Equal(t, ErrMessageTimeout, err)
+
+	// the write to the peer not reading fails
+	assert.NotNil(t, c.WriteBin(bin))
+
+	assert.Nil(t, c.Close())
+	assert.NotNil(t, c.Close())
+	<-c.Closed()
+}
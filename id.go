@@ -2,22 +2,27 @@ package gearman
 
 import (
 	"encoding/hex"
+	"errors"
 
 	uuid "github.com/satori/go.uuid"
 )
 
-// ID is the type of identity
-// The underlying type is byte array, so use ID as key of a map,
-// but use it's pointer for assignments and arguments to avoid memery copy
-type ID uuid.UUID
+// ID is the type of identity, the connections and the jobs are identified by it
+// The underlying type is string, so use ID as key of a map,
+// but use it's pointer for assignments and arguments to keep the references short
+// the IDs generated by IDGenerator are the hex strings of UUIDs,
+// but a job handle can be any string generated by the server, like H:<hostname>:<counter>
+type ID string
 
 // IDGenerator is a generator of ID
 type IDGenerator struct {
 }
 
-// IDStrLength is the length of ID string
+// IDStrLength is the length of ID string generated by IDGenerator
 const IDStrLength = 32
 
+var errEmptyID = errors.New("Empty ID")
+
 // NewIDGenerator creates a new ID generator
 func NewIDGenerator() *IDGenerator {
 	return &IDGenerator{}
@@ -25,22 +30,21 @@ func NewIDGenerator() *IDGenerator {
 
 // Generate generates a new ID
 func (g *IDGenerator) Generate() *ID {
-	id := ID(uuid.NewV4())
+	u := uuid.NewV4()
+	id := ID(hex.EncodeToString(u[:]))
 	return &id
 }
 
 func (id *ID) String() string {
-	buf := make([]byte, IDStrLength)
-	hex.Encode(buf, (*id)[:])
-	return string(buf)
+	return string(*id)
 }
 
-//UnmarshalID unmarshal an ID from string
+// UnmarshalID unmarshal an ID from string
+// any non-empty string is accepted, as the job handles generated by other servers are not UUIDs
 func UnmarshalID(str string) (*ID, error) {
-	uuidID, err := uuid.FromString(str)
-	if err != nil {
-		return nil, err
+	if str == "" {
+		return nil, errEmptyID
 	}
-	id := ID(uuidID)
+	id := ID(str)
 	return &id, nil
 }
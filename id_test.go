@@ -4,8 +4,6 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-
-	uuid "github.com/satori/go.uuid"
 )
 
 func TestID(t *testing.T) {
@@ -13,11 +11,23 @@ func TestID(t *testing.T) {
 
 	id1 := idGen.Generate()
 	assert.Equal(t, 32, len(id1.String()))
-	id1Array := [uuid.Size]byte(*id1)
 
 	id2 := idGen.Generate()
-	id2Array := [uuid.Size]byte(*id2)
 
 	assert.NotEqual(t, *id1, *id2)
-	assert.NotEqual(t, id1Array, id2Array)
+	assert.NotEqual(t, id1.String(), id2.String())
+}
+
+func TestUnmarshalID(t *testing.T) {
+	id := NewIDGenerator().Generate()
+	unmarshaled, err := UnmarshalID(id.String())
+	assert.Nil(t, err)
+	assert.Equal(t, *id, *unmarshaled)
+
+	unmarshaled, err = UnmarshalID("H:localhost:12")
+	assert.Nil(t, err)
+	assert.Equal(t, "H:localhost:12", unmarshaled.String())
+
+	_, err = UnmarshalID("")
+	assert.NotNil(t, err)
 }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"strings"
 )
 
@@ -23,9 +24,6 @@ const (
 	PacketTypeMax = 42
 )
 
-// MaxBodySize is the max body size
-const MaxBodySize = 63
-
 const headerSize = 12
 
 var (
@@ -35,8 +33,18 @@ var (
 	errInvalidMsgRole   = errors.New("The message type is unexpected for this role")
 	errInvalidArgsLen   = errors.New("The length of arguments is incorrect")
 	errArgumentsTooLong = errors.New("Arguments too long")
+	errInvalidArgument  = errors.New("Only the last argument can contain NUL")
+
+	// ErrBodyTooLarge is returned by NextMessageLimit if the body size exceeds the limit
+	ErrBodyTooLarge = errors.New("Body too large")
 )
 
+// IsMalformed reports whether the error is returned by NextMessageLimit for a malformed message,
+// the message is drained from the reader, so the next one can still be read
+func IsMalformed(err error) bool {
+	return err == errInvalidMagic || err == errInvaldPacketType || err == errInvalidArgsSize
+}
+
 var (
 	MsgPool       = NewMessagePool()
 	MsgHeaderPool = NewMessageHeaderPool()
@@ -78,13 +86,18 @@ func (m *Message) Validate(role RoleType) error {
 }
 
 // Encode encodes the message to bytes in the gearman official protocol format
+// the arguments are separated by NUL, so only the last argument(usually the data) can contain NUL
 func (m *Message) Encode() ([]byte, error) {
-	body := strings.Join(m.Arguments, separator)
-	for _, arg := range m.Arguments {
-		if len(arg) > MaxBodySize {
-			return nil, errArgumentsTooLong
+	argsCnt := len(m.Arguments)
+	for i, arg := range m.Arguments {
+		if i < argsCnt-1 && strings.Contains(arg, separator) {
+			return nil, errInvalidArgument
 		}
 	}
+	body := strings.Join(m.Arguments, separator)
+	if uint64(len(body)) > math.MaxUint32 {
+		return nil, errArgumentsTooLong
+	}
 	if !m.MagicType.Valid() {
 		return nil, errInvalidMagic
 	}
@@ -123,15 +136,21 @@ func firstByte(reader io.Reader) (byte, error) {
 	return buff[0], err
 }
 
-// NextMessage reads next message from a bufio.Reader
+// NextMessage reads next message from a bufio.Reader without limit of the body size
+func NextMessage(reader *bufio.Reader) (binMsg *Message, txtMsg string, err error) {
+	return NextMessageLimit(reader, 0)
+}
+
+// NextMessageLimit reads next message from a bufio.Reader
 // It returns one of binMsg and txtMsg leaving the other as zero value if no any error occured
 // binMsg returned if the next message is binary, and txtMsg if it's text
 // For binary message, it treats error for such cases -
 // 1.read error from the reader
 // 2. invalid magic code / packet type / body size
+// 3. the body size exceeds maxBodySize(ErrBodyTooLarge), 0 means no limit
 // (it will read the full message from the reader in this case, so the next message can be read as expected)
 // It dose not care about the validity of the message, message.Validate() should be called for it
-func NextMessage(reader *bufio.Reader) (binMsg *Message, txtMsg string, err error) {
+func NextMessageLimit(reader *bufio.Reader, maxBodySize uint32) (binMsg *Message, txtMsg string, err error) {
 	beginByte, err := firstByte(reader)
 	if err != nil {
 		return nil, "", err
@@ -171,20 +190,17 @@ func NextMessage(reader *bufio.Reader) (binMsg *Message, txtMsg string, err erro
 	}
 
 	bodySize := byteOrder.Uint32(headers[8:])
+	tooLarge := maxBodySize > 0 && bodySize > maxBodySize
 
 	var arguments []string
 	var bodySizeErr bool
-	if !magicErr && !packetTypeErr {
-		if bodySize == 0 {
-			arguments = nil
-		} else {
-			body := make([]byte, bodySize)
-			_, err = io.ReadFull(reader, body)
-			if err != nil {
-				return nil, "", err
-			}
-			arguments = strings.Split(string(body), separator)
+	if !magicErr && !packetTypeErr && !tooLarge {
+		body := make([]byte, bodySize)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return nil, "", err
 		}
+		arguments = splitArguments(packetType, body)
 	} else {
 		// we don't need the arguments but still need read it from the connection
 		// to make sure the next message can be read properly
@@ -200,6 +216,9 @@ func NextMessage(reader *bufio.Reader) (binMsg *Message, txtMsg string, err erro
 	if packetTypeErr {
 		return nil, "", errInvaldPacketType
 	}
+	if tooLarge {
+		return nil, "", ErrBodyTooLarge
+	}
 	if bodySizeErr {
 		return nil, "", errInvalidArgsSize
 	}
@@ -211,6 +230,19 @@ func NextMessage(reader *bufio.Reader) (binMsg *Message, txtMsg string, err erro
 	return msg, "", nil
 }
 
+// splitArguments splits the body by NUL into at most the expected number of arguments of the packet type
+// so the last argument(usually the data) can contain NUL
+func splitArguments(packetType PacketType, body []byte) []string {
+	argsLen, ok := msgArgsLens[packetType]
+	if ok && argsLen > 0 {
+		return strings.SplitN(string(body), separator, argsLen)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return strings.Split(string(body), separator)
+}
+
 func (m *Message) String() string {
 	return fmt.Sprintf("%s.%s", m.MagicType.String()[1:], m.PacketType)
 }
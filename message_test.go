@@ -55,11 +55,23 @@ func TestEncode(t *testing.T) {
 	assert.Equal(t, errInvaldPacketType, err)
 	assert.Nil(t, encodedBytes)
 
-	// Arguments too long
+	// Long arguments
 	msg.PacketType = SUBMIT_JOB
-	msg.Arguments = []string{"echo", "1234", longString(65)}
+	msg.Arguments = []string{"echo", "1234", longString(1024 * 1024)}
 	encodedBytes, err = msg.Encode()
-	assert.Equal(t, errArgumentsTooLong, err)
+	assert.Nil(t, err)
+	assert.Equal(t, headerSize+len("echo")+len("1234")+1024*1024+2, len(encodedBytes))
+
+	// NUL in the last argument
+	msg.Arguments = []string{"echo", "1234", "hello\000world"}
+	encodedBytes, err = msg.Encode()
+	assert.Nil(t, err)
+	assert.NotNil(t, encodedBytes)
+
+	// NUL in the other arguments
+	msg.Arguments = []string{"echo", "12\00034", "hello world"}
+	encodedBytes, err = msg.Encode()
+	assert.Equal(t, errInvalidArgument, err)
 	assert.Nil(t, encodedBytes)
 }
 
@@ -97,6 +109,64 @@ func TestDecode(t *testing.T) {
 	assert.Equal(t, errInvaldPacketType, err)
 }
 
+func TestDecodeBinaryData(t *testing.T) {
+	for _, msg := range []*Message{
+		&Message{
+			MagicType:  MagicReq,
+			PacketType: SUBMIT_JOB,
+			Arguments:  []string{"echo", "111", "\000hello\000world\000"},
+		},
+		&Message{
+			MagicType:  MagicRes,
+			PacketType: WORK_COMPLETE,
+			Arguments:  []string{"H:1", "\000\001\002"},
+		},
+		&Message{
+			MagicType:  MagicRes,
+			PacketType: ECHO_RES,
+			Arguments:  []string{""},
+		},
+		&Message{
+			MagicType:  MagicRes,
+			PacketType: NOOP,
+		},
+	} {
+		encodedBytes, err := msg.Encode()
+		assert.Nil(t, err)
+		reader := bufio.NewReader(bytes.NewReader(encodedBytes))
+		decodedMsg, _, err := NextMessage(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, decodedMsg)
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	largeMsg := &Message{
+		MagicType:  MagicReq,
+		PacketType: SUBMIT_JOB,
+		Arguments:  []string{"echo", "111", longString(100)},
+	}
+	smallMsg := &Message{
+		MagicType:  MagicReq,
+		PacketType: SUBMIT_JOB,
+		Arguments:  []string{"echo", "111", longString(10)},
+	}
+	largeBytes, err := largeMsg.Encode()
+	assert.Nil(t, err)
+	smallBytes, err := smallMsg.Encode()
+	assert.Nil(t, err)
+
+	reader := bufio.NewReader(bytes.NewReader(bytes.Join([][]byte{largeBytes, smallBytes}, nil)))
+	decodedMsg, _, err := NextMessageLimit(reader, 50)
+	assert.Nil(t, decodedMsg)
+	assert.Equal(t, ErrBodyTooLarge, err)
+
+	// the large body is discarded, so the next message can be read
+	decodedMsg, _, err = NextMessageLimit(reader, 50)
+	assert.Nil(t, err)
+	assert.Equal(t, smallMsg, decodedMsg)
+}
+
 func TestValidate(t *testing.T) {
 	// Request
 	msg := &Message{
@@ -117,6 +187,15 @@ func TestValidate(t *testing.T) {
 	assert.Error(t, errInvalidMsgRole, msg.Validate(RoleClient))
 	assert.Error(t, errInvalidMsgRole, msg.Validate(RoleServer))
 
+	msg = &Message{
+		MagicType:  MagicRes,
+		PacketType: JOB_ASSIGN_UNIQ,
+		Arguments:  []string{"1111", "echo", "unique", "hello world"},
+	}
+	assert.Nil(t, msg.Validate(RoleWorker))
+	msg.MagicType = MagicReq
+	assert.Equal(t, errInvalidMsgRole, msg.Validate(RoleServer))
+
 	// Two roles
 	msg = &Message{
 		MagicType:  MagicRes,
@@ -150,6 +229,7 @@ func TestContinousRead(t *testing.T) {
 	encodededMsgs = append(encodededMsgs, []byte(expectedTxtMsg+"\n"))
 	// valid one
 	msg.PacketType = WORK_COMPLETE
+	msg.Arguments = []string{"111", "hello world"}
 	validMsg := *msg
 	encodededMsgs = append(encodededMsgs, msg.encodeWithoutValidation())
 	// another txt msg
@@ -238,3 +318,11 @@ func BenchmarkEncode(b *testing.B) {
 		}
 	}
 }
+
+func TestIsMalformed(t *testing.T) {
+	assert.True(t, IsMalformed(errInvalidMagic))
+	assert.True(t, IsMalformed(errInvaldPacketType))
+	assert.True(t, IsMalformed(errInvalidArgsSize))
+	assert.False(t, IsMalformed(ErrBodyTooLarge))
+	assert.False(t, IsMalformed(io.ErrClosedPipe))
+}
@@ -208,7 +208,7 @@ func init() {
 	putAllowedRoles(MagicReq, WORK_WARNING, RoleWorker)
 	putAllowedRoles(MagicRes, WORK_WARNING, RoleClient)
 	putAllowedRoles(MagicReq, GRAB_JOB_UNIQ, RoleWorker)
-	putAllowedRoles(MagicReq, JOB_ASSIGN_UNIQ, RoleWorker)
+	putAllowedRoles(MagicRes, JOB_ASSIGN_UNIQ, RoleWorker)
 	putAllowedRoles(MagicReq, SUBMIT_JOB_HIGH_BG, RoleClient)
 	putAllowedRoles(MagicReq, SUBMIT_JOB_LOW, RoleClient)
 	putAllowedRoles(MagicReq, SUBMIT_JOB_LOW_BG, RoleClient)
@@ -255,5 +255,13 @@ func init() {
 		GRAB_JOB_ALL:                 0,
 		SET_CLIENT_ID:                1,
 		ALL_YOURS:                    0,
+		NOOP:                         0,
+		NO_JOB:                       0,
+		JOB_ASSIGN:                   3,
+		JOB_ASSIGN_UNIQ:              4,
+		JOB_ASSIGN_ALL:               5,
+		ECHO_REQ:                     1,
+		ECHO_RES:                     1,
+		ERROR:                        2,
 	}
 }
@@ -0,0 +1,48 @@
+package gearman
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The input of a reduce job is the sub-results emitted by the mapper with WORK_DATA,
+// each of them is prefixed by its length as a 4 bytes big endian integer
+
+const reduceLenSize = 4
+
+// ErrInvalidReduceInput is returned by DecodeReduceInput if the data is malformed
+var ErrInvalidReduceInput = errors.New("Invalid reduce input")
+
+// EncodeReduceInput encodes the sub-results of a mapper into the data of the reduce job
+func EncodeReduceInput(results [][]byte) []byte {
+	size := 0
+	for _, result := range results {
+		size += reduceLenSize + len(result)
+	}
+	data := make([]byte, 0, size)
+	lenBuf := make([]byte, reduceLenSize)
+	for _, result := range results {
+		binary.BigEndian.PutUint32(lenBuf, uint32(len(result)))
+		data = append(data, lenBuf...)
+		data = append(data, result...)
+	}
+	return data
+}
+
+// DecodeReduceInput decodes the data of a reduce job into the sub-results of the mapper
+func DecodeReduceInput(data []byte) ([][]byte, error) {
+	var results [][]byte
+	for len(data) > 0 {
+		if len(data) < reduceLenSize {
+			return nil, ErrInvalidReduceInput
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[reduceLenSize:]
+		if uint64(len(data)) < uint64(size) {
+			return nil, ErrInvalidReduceInput
+		}
+		results = append(results, data[:size])
+		data = data[size:]
+	}
+	return results, nil
+}
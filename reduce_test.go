@@ -0,0 +1,29 @@
+package gearman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReduceInput(t *testing.T) {
+	results := [][]byte{
+		[]byte("hello"),
+		{},
+		[]byte("\000\001\002"),
+	}
+	data := EncodeReduceInput(results)
+	assert.Equal(t, 4*3+5+3, len(data))
+	decoded, err := DecodeReduceInput(data)
+	assert.Nil(t, err)
+	assert.Equal(t, results, decoded)
+
+	decoded, err = DecodeReduceInput(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, decoded)
+
+	_, err = DecodeReduceInput(data[:len(data)-1])
+	assert.Equal(t, ErrInvalidReduceInput, err)
+	_, err = DecodeReduceInput([]byte{0, 0})
+	assert.Equal(t, ErrInvalidReduceInput, err)
+}
@@ -1,8 +1,261 @@
 package server
 
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peonone/gearman"
+)
+
+// Version is the version of the server reported by the admin command "version"
+const Version = "0.1.0"
+
+// admin implements the text based administrative protocol
+// the output format is the same as the upstream gearmand, so the tools like gearadmin work with it
 type admin struct {
+	connManager *gearman.ConnManager
+	jobsManager jobsManager
+	cfg         *Config
+	results     resultStore // nil if the results are not kept
+	shutdown    func(graceful bool)
 }
 
+const (
+	adminOK               = "OK\n"
+	adminEnd              = ".\n"
+	adminErrUnknown       = "ERR UNKNOWN_COMMAND Unknown+server+command\n"
+	adminErrIncomplete    = "ERR INCOMPLETE_ARGS An+incomplete+set+of+arguments+was+sent+to+this+command\n"
+	adminErrInvalidNumber = "ERR INVALID_ARGUMENT The+argument+is+not+a+valid+number\n"
+	adminErrNotFound      = "ERR NOT_FOUND The+result+is+not+found+or+expired\n"
+	adminErrNoResultStore = "ERR NOT_SUPPORTED The+result+store+is+not+enabled\n"
+	adminErrJobNotFound   = "ERR NOT_FOUND The+job+is+not+found+or+done\n"
+)
+
 func (a *admin) handle(txtMsg string, conn *conn) error {
-	return conn.WriteTxtMsg(txtMsg + "\n")
+	fields := strings.Fields(txtMsg)
+	if len(fields) == 0 {
+		return nil
+	}
+	var resp string
+	switch strings.ToLower(fields[0]) {
+	case "status":
+		resp = a.status()
+	case "workers":
+		resp = a.workers()
+	case "version":
+		resp = "OK " + Version + "\n"
+	case "maxqueue":
+		resp = a.maxQueue(fields[1:])
+	case "shutdown":
+		return a.handleShutdown(fields[1:], conn)
+	case "verbose":
+		resp = a.verbose()
+	case "result":
+		resp = a.result(fields[1:], false)
+	case "result_unique":
+		resp = a.result(fields[1:], true)
+	case "cancel":
+		resp = a.cancel(fields[1:], false)
+	case "cancel_unique":
+		resp = a.cancel(fields[1:], true)
+	case "getpid":
+		resp = "OK " + strconv.Itoa(os.Getpid()) + "\n"
+	default:
+		resp = adminErrUnknown
+	}
+	return conn.WriteTxtMsg(resp)
+}
+
+// status outputs one line for each function: FUNCTION\tTOTAL\tRUNNING\tAVAILABLE_WORKERS
+func (a *admin) status() string {
+	type statusLine struct {
+		total   int
+		running int
+		workers int
+	}
+	lines := make(map[string]*statusLine)
+	getLine := func(function string) *statusLine {
+		line, ok := lines[function]
+		if !ok {
+			line = new(statusLine)
+			lines[function] = line
+		}
+		return line
+	}
+	for _, fs := range a.jobsManager.functionsStatus() {
+		line := getLine(fs.function)
+		line.total = fs.queued + fs.running
+		line.running = fs.running
+	}
+	for function, workers := range availableWorkers(serverConns(a.connManager)) {
+		getLine(function).workers = workers
+	}
+
+	functions := make([]string, 0, len(lines))
+	for function := range lines {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	buf := new(bytes.Buffer)
+	for _, function := range functions {
+		line := lines[function]
+		fmt.Fprintf(buf, "%s\t%d\t%d\t%d\n", function, line.total, line.running, line.workers)
+	}
+	buf.WriteString(adminEnd)
+	return buf.String()
+}
+
+// workers outputs one line for each connection: FD IP-ADDRESS CLIENT-ID [ALL_YOURS] : FUNCTION ...
+func (a *admin) workers() string {
+	conns := serverConns(a.connManager)
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].fd < conns[j].fd
+	})
+	buf := new(bytes.Buffer)
+	for _, c := range conns {
+		clientID := c.getClientID()
+		if clientID == "" {
+			clientID = "-"
+		}
+		fmt.Fprintf(buf, "%d %s %s", c.fd, c.remoteAddr, clientID)
+		if c.isExclusive() {
+			buf.WriteString(" ALL_YOURS")
+		}
+		buf.WriteString(" :")
+		functions := c.functions()
+		sort.Strings(functions)
+		for _, function := range functions {
+			buf.WriteString(" " + function)
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString(adminEnd)
+	return buf.String()
+}
+
+// maxQueue handles "maxqueue FUNCTION [MAX_SIZE_HIGH [MAX_SIZE_NORMAL [MAX_SIZE_LOW]]]",
+// a single size limits all priorities, and the limit is removed if no size is given
+func (a *admin) maxQueue(args []string) string {
+	if len(args) == 0 {
+		return adminErrIncomplete
+	}
+	var limit QueueLimit
+	if len(args) > 1 {
+		var err error
+		limit, err = ParseQueueLimit(args[1:])
+		if err != nil {
+			return adminErrInvalidNumber
+		}
+	}
+	a.jobsManager.setMaxQueue(args[0], limit)
+	return adminOK
+}
+
+// result handles "result HANDLE" and "result_unique UNIQUE_ID" for the results of the background jobs
+// the output is "OK STATUS BASE64-DATA", the data is the result of WORK_COMPLETE or the exception of WORK_EXCEPTION
+func (a *admin) result(args []string, byUnique bool) string {
+	if a.results == nil {
+		return adminErrNoResultStore
+	}
+	if len(args) == 0 {
+		return adminErrIncomplete
+	}
+	handle, uniqueID := args[0], ""
+	if byUnique {
+		handle, uniqueID = "", args[0]
+	}
+	ctx := context.Background()
+	if a.cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+	}
+	r, err := a.results.get(ctx, handle, uniqueID)
+	if err != nil {
+		return "ERR INTERNAL_ERROR " + strings.Replace(err.Error(), " ", "+", -1) + "\n"
+	}
+	if r == nil {
+		return adminErrNotFound
+	}
+	return "OK " + r.status + " " + base64.StdEncoding.EncodeToString([]byte(r.data)) + "\n"
+}
+
+// cancel handles "cancel HANDLE" and "cancel_unique UNIQUE_ID"
+// a queued job is removed from the queue, a dispatched one is ended, the listening clients get WORK_FAIL
+func (a *admin) cancel(args []string, byUnique bool) string {
+	if len(args) == 0 {
+		return adminErrIncomplete
+	}
+	var handle *gearman.ID
+	var uniqueID string
+	if byUnique {
+		uniqueID = args[0]
+	} else {
+		var err error
+		handle, err = gearman.UnmarshalID(args[0])
+		if err != nil {
+			return adminErrJobNotFound
+		}
+	}
+	ctx := context.Background()
+	if a.cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+	}
+	cancelled, err := a.jobsManager.cancelJob(ctx, handle, uniqueID)
+	if err != nil {
+		return "ERR INTERNAL_ERROR " + strings.Replace(err.Error(), " ", "+", -1) + "\n"
+	}
+	if !cancelled {
+		return adminErrJobNotFound
+	}
+	return adminOK
+}
+
+// handleShutdown handles "shutdown [graceful]"
+// the server stops accepting new connections, and waits running jobs done if graceful
+func (a *admin) handleShutdown(args []string, conn *conn) error {
+	graceful := len(args) > 0 && strings.ToLower(args[0]) == "graceful"
+	err := conn.WriteTxtMsg(adminOK)
+	if a.shutdown != nil {
+		a.shutdown(graceful)
+	}
+	return err
+}
+
+func (a *admin) verbose() string {
+	if a.cfg.Verbose {
+		return "OK INFO\n"
+	}
+	return "OK ERROR\n"
+}
+
+// serverConns returns the connections served by the server
+func serverConns(connManager *gearman.ConnManager) []*conn {
+	gconns := connManager.Conns()
+	conns := make([]*conn, 0, len(gconns))
+	for _, gconn := range gconns {
+		if c, ok := gconn.(*conn); ok {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// availableWorkers returns the number of the workers by function
+func availableWorkers(conns []*conn) map[string]int {
+	workers := make(map[string]int)
+	for _, c := range conns {
+		for _, function := range c.functions() {
+			workers[function]++
+		}
+	}
+	return workers
 }
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeAdminForTest() (*admin, *srvJobsManager, *mockQueue) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	return &admin{
+		connManager: gearman.NewConnManager(),
+		jobsManager: manager,
+		cfg:         new(Config),
+	}, manager, q
+}
+
+func adminCall(t *testing.T, a *admin, cmd string) string {
+	conn := newMockSConn(10, 10)
+	assert.Nil(t, a.handle(cmd, conn.srvConn))
+	assert.Equal(t, 1, len(conn.WriteTxtCh))
+	return <-conn.WriteTxtCh
+}
+
+func TestAdminStatus(t *testing.T) {
+	a, manager, q := makeAdminForTest()
+	assert.Equal(t, ".\n", adminCall(t, a, "status"))
+
+	ctx := context.Background()
+	q.On("enqueue", ctx, mock.Anything).Return(nil)
+	for i, function := range []string{"reverse", "echo", "echo"} {
+		j := &job{
+			function: function,
+			handle:   testIdGen.Generate(),
+			uniqueID: function + strconv.Itoa(i),
+		}
+		manager.submitJob(ctx, j, nil)
+		if i == 2 {
+			q.On("dequeue", mock.Anything).Return(j, nil).Once()
+		}
+	}
+	functions := supportFunctions(map[string]time.Duration{"echo": 0})
+	_, err := manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+
+	worker1 := newMockSConn(10, 10)
+	worker1.srvConn.canDo("echo", 0)
+	worker1.srvConn.canDo("wc", 0)
+	worker2 := newMockSConn(10, 10)
+	worker2.srvConn.canDo("echo", 0)
+	a.connManager.AddConn(worker1.srvConn)
+	a.connManager.AddConn(worker2.srvConn)
+
+	assert.Equal(t, "echo\t2\t1\t2\nreverse\t1\t0\t0\nwc\t0\t0\t1\n.\n", adminCall(t, a, "status"))
+}
+
+func TestAdminWorkers(t *testing.T) {
+	a, _, _ := makeAdminForTest()
+	worker := newMockSConn(10, 10)
+	worker.srvConn.fd = 5
+	worker.srvConn.remoteAddr = "127.0.0.1"
+	worker.srvConn.setClientID("worker1")
+	worker.srvConn.canDo("wc", 0)
+	worker.srvConn.canDo("echo", 0)
+	exclusiveWorker := newMockSConn(10, 10)
+	exclusiveWorker.srvConn.fd = 7
+	exclusiveWorker.srvConn.remoteAddr = "127.0.0.1"
+	exclusiveWorker.srvConn.setExclusive()
+	exclusiveWorker.srvConn.canDo("echo", 0)
+	client := newMockSConn(10, 10)
+	client.srvConn.fd = 3
+	client.srvConn.remoteAddr = "10.0.0.2"
+	a.connManager.AddConn(worker.srvConn)
+	a.connManager.AddConn(exclusiveWorker.srvConn)
+	a.connManager.AddConn(client.srvConn)
+
+	assert.Equal(t, "3 10.0.0.2 - :\n5 127.0.0.1 worker1 : echo wc\n7 127.0.0.1 - ALL_YOURS : echo\n.\n",
+		adminCall(t, a, "workers"))
+}
+
+func TestAdminMaxQueue(t *testing.T) {
+	a, manager, q := makeAdminForTest()
+	assert.Equal(t, adminErrIncomplete, adminCall(t, a, "maxqueue"))
+	assert.Equal(t, adminErrInvalidNumber, adminCall(t, a, "maxqueue echo abc"))
+	assert.Equal(t, adminOK, adminCall(t, a, "maxqueue echo 1"))
+	assert.Equal(t, QueueLimit{1, 1, 1}, manager.maxQueueSizes["echo"])
+
+	ctx := context.Background()
+	q.On("enqueue", ctx, mock.Anything).Return(nil)
+	_, err := manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "1"}, nil)
+	assert.Nil(t, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "2"}, nil)
+	assert.Equal(t, errQueueFull, err)
+
+	assert.Equal(t, adminOK, adminCall(t, a, "maxqueue echo"))
+	assert.NotContains(t, manager.maxQueueSizes, "echo")
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "2"}, nil)
+	assert.Nil(t, err)
+
+	// limited by priority
+	assert.Equal(t, adminErrInvalidNumber, adminCall(t, a, "maxqueue echo 1 2 3 4"))
+	assert.Equal(t, adminErrInvalidNumber, adminCall(t, a, "maxqueue echo 1 -2"))
+	assert.Equal(t, adminOK, adminCall(t, a, "maxqueue echo 0 3 1"))
+	assert.Equal(t, QueueLimit{0, 3, 1}, manager.maxQueueSizes["echo"])
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "3"}, nil)
+	assert.Nil(t, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "4", priority: priorityLow}, nil)
+	assert.Nil(t, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "5", priority: priorityLow}, nil)
+	assert.Equal(t, errQueueFull, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "6", priority: priorityMid}, nil)
+	assert.Nil(t, err)
+}
+
+func TestParseQueueLimit(t *testing.T) {
+	cases := []struct {
+		sizes []string
+		limit QueueLimit
+		err   error
+	}{
+		{[]string{"5"}, QueueLimit{5, 5, 5}, nil},
+		{[]string{"5", "10"}, QueueLimit{5, 10, 10}, nil},
+		{[]string{"0", "10", "20"}, QueueLimit{0, 10, 20}, nil},
+		{nil, QueueLimit{}, errInvalidQueueLimit},
+		{[]string{"1", "2", "3", "4"}, QueueLimit{}, errInvalidQueueLimit},
+		{[]string{"x"}, QueueLimit{}, errInvalidQueueLimit},
+		{[]string{"1", "-1"}, QueueLimit{}, errInvalidQueueLimit},
+	}
+	for _, c := range cases {
+		limit, err := ParseQueueLimit(c.sizes)
+		assert.Equal(t, c.err, err, "%v", c.sizes)
+		assert.Equal(t, c.limit, limit, "%v", c.sizes)
+	}
+}
+
+func TestAdminCancel(t *testing.T) {
+	a, manager, q := makeAdminForTest()
+	ctx := context.Background()
+	q.On("enqueue", ctx, mock.Anything).Return(nil)
+	j := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "echo1"}
+	_, err := manager.submitJob(ctx, j, nil)
+	assert.Nil(t, err)
+	q.On("remove", j.handle).Return(true, nil).Once()
+
+	assert.Equal(t, adminErrIncomplete, adminCall(t, a, "cancel"))
+	assert.Equal(t, adminErrJobNotFound, adminCall(t, a, "cancel H:1"))
+	assert.Equal(t, adminErrJobNotFound, adminCall(t, a, "cancel "+testIdGen.Generate().String()))
+	assert.Equal(t, adminOK, adminCall(t, a, "cancel_unique echo1"))
+	assert.Equal(t, adminErrJobNotFound, adminCall(t, a, "cancel "+j.handle.String()))
+	assert.Empty(t, manager.functionsStatus())
+	q.AssertExpectations(t)
+}
+
+func TestAdminShutdown(t *testing.T) {
+	a, _, _ := makeAdminForTest()
+	var shutdownCalls []bool
+	a.shutdown = func(graceful bool) {
+		shutdownCalls = append(shutdownCalls, graceful)
+	}
+	assert.Equal(t, adminOK, adminCall(t, a, "shutdown"))
+	assert.Equal(t, adminOK, adminCall(t, a, "shutdown graceful"))
+	assert.Equal(t, []bool{false, true}, shutdownCalls)
+}
+
+func TestAdminMisc(t *testing.T) {
+	a, _, _ := makeAdminForTest()
+	assert.Equal(t, "OK "+Version+"\n", adminCall(t, a, "version"))
+	assert.Equal(t, "OK "+strconv.Itoa(os.Getpid())+"\n", adminCall(t, a, "getpid"))
+	assert.Equal(t, "OK ERROR\n", adminCall(t, a, "verbose"))
+	a.cfg.Verbose = true
+	assert.Equal(t, "OK INFO\n", adminCall(t, a, "verbose\r"))
+	assert.Equal(t, adminErrUnknown, adminCall(t, a, "hello"))
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+
+	"github.com/peonone/gearman"
+)
+
+// allYoursHandler marks the worker as exclusive to this server
+type allYoursHandler struct {
+}
+
+func (h *allYoursHandler) supportPacketTypes() []gearman.PacketType {
+	return []gearman.PacketType{
+		gearman.ALL_YOURS,
+	}
+}
+
+func (h *allYoursHandler) handle(ctx context.Context, m *gearman.Message, conn *conn) (bool, error) {
+	conn.setExclusive()
+	return true, nil
+}
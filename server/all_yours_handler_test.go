@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/peonone/gearman"
+)
+
+func TestAllYoursHandler(t *testing.T) {
+	conn1 := newMockSConn(10, 10)
+	conn2 := newMockSConn(10, 10)
+	h := new(allYoursHandler)
+	m := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.ALL_YOURS,
+	}
+	msgRecyclable, err := h.handle(context.Background(), m, conn1.srvConn)
+	assert.True(t, msgRecyclable)
+	assert.Nil(t, err)
+	assert.True(t, conn1.srvConn.isExclusive())
+	assert.False(t, conn2.srvConn.isExclusive())
+	assert.Equal(t, 0, len(conn1.WriteCh))
+}
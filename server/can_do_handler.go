@@ -21,17 +21,17 @@ func (h *canDoHandler) handle(ctx context.Context, m *gearman.Message, conn *con
 	conn.setIsWorker(true)
 	switch m.PacketType {
 	case gearman.CAN_DO:
-		conn.supportFunctions.canDo(m.Arguments[0], 0)
+		conn.canDo(m.Arguments[0], 0)
 	case gearman.CAN_DO_TIMEOUT:
 		timeoutMili, err := strconv.Atoi(m.Arguments[1])
 		if err != nil {
 			return true, err
 		}
-		conn.supportFunctions.canDo(m.Arguments[0], time.Duration(timeoutMili)*time.Millisecond)
+		conn.canDo(m.Arguments[0], time.Duration(timeoutMili)*time.Millisecond)
 	case gearman.CANT_DO:
-		conn.supportFunctions.cantDo(m.Arguments[0])
+		conn.cantDo(m.Arguments[0])
 	case gearman.RESET_ABILITIES:
-		conn.supportFunctions.reset()
+		conn.resetAbilities()
 	}
 	return true, nil
 }
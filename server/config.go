@@ -1,10 +1,19 @@
 package server
 
 import (
+	"errors"
+	"strconv"
 	"time"
 )
 
+// defaultResultTTL is how long the results of the background jobs are kept by default
+const defaultResultTTL = 24 * time.Hour
+
+// DefaultJobRetries is the max times a job is requeued if Config.JobRetries is 0
+const DefaultJobRetries = 3
+
 type Config struct {
+	// BindAddr is the TCP address to listen on if Listeners is empty
 	BindAddr        string
 	LogFilePath     string
 	LogToStderr     bool
@@ -14,4 +23,111 @@ type Config struct {
 	QueueDataSource string
 	QueueTableName  string
 	RequestTimeout  time.Duration
+	MaxBodySize     uint32
+	// JobRetries is the max times a job is requeued after its worker disconnected or timeouted,
+	// DefaultJobRetries if it's 0, a negative value means the job is never requeued
+	JobRetries int
+	// TLSCertFile, TLSKeyFile and TLSClientCAFile are the TLS settings of BindAddr,
+	// see ListenerConfig for the details
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// MetricsAddr is the address of the HTTP listener exposing the metrics in the Prometheus text format on /metrics,
+	// the metrics are not exposed if it's empty
+	MetricsAddr string
+	// GatewayAddr is the address of the HTTP/JSON gateway serving /jobs/, the gateway is disabled if it's empty,
+	// it can be the same as MetricsAddr
+	GatewayAddr string
+	// ResultStoreType is memory or sql to keep the results of the background jobs, disabled if it's empty
+	// the sql result store keeps the results in the database of the sql queue, QueueType must be sql
+	ResultStoreType string
+	ResultTableName string
+	// ResultTTL is how long the results are kept, defaultResultTTL if it's 0
+	ResultTTL time.Duration
+	// Listeners are the addresses the server accepts connections on, BindAddr is used if it's empty
+	Listeners []ListenerConfig
+	// MaxQueue is the max queued jobs of the functions, the submissions over it get a queue_full ERROR,
+	// it can be changed by the admin command maxqueue at runtime
+	MaxQueue map[string]QueueLimit
+	// HandleGenerator generates the job handles, H:<hostname>:<counter> are generated if it's nil
+	HandleGenerator HandleGenerator
+	// DispatchPolicy is the order the queued jobs are dispatched in: priority, fifo or round-robin,
+	// priority if it's empty, see dispatch_policy.go
+	DispatchPolicy string
+	// FunctionWeights are the weights of the functions for the round-robin dispatch policy, 1 if not set
+	FunctionWeights map[string]int
+	// IdleTimeout is how long a sleeping worker waits for the next packet before the server probes it with NOOP,
+	// the worker is reaped if it doesn't answer in another IdleTimeout,
+	// a packet stalled and a write blocked for it fail too, 0 means the connections never timeout
+	IdleTimeout time.Duration
+}
+
+// QueueLimit is the max queued jobs of a function by priority: high, normal and low, 0 means no limit
+type QueueLimit [3]int
+
+var errInvalidQueueLimit = errors.New("Invalid max queue size")
+
+// ParseQueueLimit parses the max queue sizes of high, normal and low priority like the admin command maxqueue,
+// a missing size is the same as the previous one, so a single size limits all priorities
+func ParseQueueLimit(sizes []string) (QueueLimit, error) {
+	var limit QueueLimit
+	if len(sizes) == 0 || len(sizes) > len(limit) {
+		return limit, errInvalidQueueLimit
+	}
+	for i := range limit {
+		if i >= len(sizes) {
+			limit[i] = limit[i-1]
+			continue
+		}
+		size, err := strconv.Atoi(sizes[i])
+		if err != nil || size < 0 {
+			return QueueLimit{}, errInvalidQueueLimit
+		}
+		limit[i] = size
+	}
+	return limit, nil
+}
+
+// ListenerConfig is the settings of a listener of the server
+type ListenerConfig struct {
+	// Addr is tcp://HOST:PORT or unix:///PATH/TO/SOCKET, an address without scheme is a TCP address
+	Addr string
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and key of the server,
+	// the listener accepts TLS connections only if they're set
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile is the PEM encoded CA certificates to verify the client certificates,
+	// the clients must present a certificate signed by them if it's set
+	TLSClientCAFile string
+	// AdminOnly makes the connections only accept the administrative protocol
+	AdminOnly bool
+}
+
+// resultTTL returns how long the results of the background jobs are kept
+func (cfg *Config) resultTTL() time.Duration {
+	if cfg.ResultTTL > 0 {
+		return cfg.ResultTTL
+	}
+	return defaultResultTTL
+}
+
+// jobRetries returns the max times a job is requeued
+func (cfg *Config) jobRetries() int {
+	if cfg.JobRetries == 0 {
+		return DefaultJobRetries
+	}
+	return cfg.JobRetries
+}
+
+// listeners returns the listeners to accept connections on
+func (cfg *Config) listeners() []ListenerConfig {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	return []ListenerConfig{{
+		Addr:            cfg.BindAddr,
+		TLSCertFile:     cfg.TLSCertFile,
+		TLSKeyFile:      cfg.TLSKeyFile,
+		TLSClientCAFile: cfg.TLSClientCAFile,
+	}}
 }
@@ -2,18 +2,33 @@ package server
 
 import (
 	"sync"
+	"time"
 
 	"github.com/peonone/gearman"
 )
 
 // conn represents a connection in the server side
+// supportFunctions is only modified in the goroutine serving the connection(with mu locked),
+// other goroutines should read it by functions()
 type conn struct {
 	gearman.Conn
 	mu               sync.Mutex
 	supportFunctions supportFunctions
 	option           *connOption
 	worker           bool
+	exclusive        bool   // the worker sent ALL_YOURS, it only takes jobs from this server
 	clientID         string // the id set by worker side
+	fd               int    // the file descriptor of the underlying connection, for admin output only
+	remoteAddr       string
+	adminOnly        bool // accepted by an admin only listener, set before serving
+	probed           bool // the NOOP probe is not answered yet, only touched by the goroutine serving the connection
+
+	// the functions called once the connection is closed, see notifyClose
+	closeMu      sync.Mutex
+	closeFns     map[uint64]func()
+	closeSeq     uint64
+	closeWatched bool
+	closeFired   bool
 }
 
 type connOption struct {
@@ -53,9 +68,53 @@ func (c *conn) isWorker() bool {
 	return c.worker
 }
 
+func (c *conn) canDo(function string, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.supportFunctions.canDo(function, timeout)
+}
+
+func (c *conn) cantDo(function string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.supportFunctions.cantDo(function)
+}
+
+func (c *conn) resetAbilities() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.supportFunctions.reset()
+}
+
+// functions returns a copy of the functions the worker can do
+func (c *conn) functions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.supportFunctions.toSlice()
+}
+
+// supports reports whether the worker can do the function
+func (c *conn) supports(function string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.supportFunctions.support(function)
+}
+
+func (c *conn) setExclusive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exclusive = true
+}
+
+func (c *conn) isExclusive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exclusive
+}
+
 func (c *conn) getClientID() string {
 	c.mu.Lock()
-	c.mu.Unlock()
+	defer c.mu.Unlock()
 
 	return c.clientID
 }
@@ -66,6 +125,45 @@ func (c *conn) setClientID(clientID string) {
 	c.clientID = clientID
 }
 
+// notifyClose registers fn to be called once the connection is closed, fn is called at once if it's closed already
+// a goroutine per connection waits for the close, the returned id unregisters fn with stopNotifyClose
+func (c *conn) notifyClose(fn func()) uint64 {
+	c.closeMu.Lock()
+	if c.closeFired {
+		c.closeMu.Unlock()
+		fn()
+		return 0
+	}
+	if !c.closeWatched {
+		c.closeWatched = true
+		c.closeFns = make(map[uint64]func())
+		go c.watchClose()
+	}
+	c.closeSeq++
+	id := c.closeSeq
+	c.closeFns[id] = fn
+	c.closeMu.Unlock()
+	return id
+}
+
+func (c *conn) stopNotifyClose(id uint64) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	delete(c.closeFns, id)
+}
+
+func (c *conn) watchClose() {
+	<-c.Closed()
+	c.closeMu.Lock()
+	fns := c.closeFns
+	c.closeFns = nil
+	c.closeFired = true
+	c.closeMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
 type mockConn struct {
 	srvConn *conn
 	*gearman.MockConn
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// the interval to query the queue again after a failed query
+const delayedRetryInterval = time.Second * 5
+
+// delayedScheduler wakes up the workers when the delayed jobs are due,
+// one timer is set to the earliest due time of the queue instead of one for each job,
+// so the delayed jobs persisted before a restart are due in time too
+type delayedScheduler struct {
+	q      queue
+	logger *log.Logger
+	wakeUp func(function string)
+	// resetCh is notified when a delayed job is enqueued, the next due time may change
+	resetCh  chan struct{}
+	stopCh   chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newDelayedScheduler(q queue, logger *log.Logger, wakeUp func(function string)) *delayedScheduler {
+	return &delayedScheduler{
+		q:       q,
+		logger:  logger,
+		wakeUp:  wakeUp,
+		resetCh: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// run waits the delayed jobs due one time after another until stop is called,
+// the jobs already due when it starts are dispatched to the workers asking for jobs
+func (s *delayedScheduler) run() {
+	defer close(s.done)
+	after := time.Now()
+	for {
+		next, functions, err := s.q.nextDelayed(context.Background(), after)
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if err != nil {
+			s.logger.Printf("failed to query the next delayed jobs: %s", err)
+			timer = time.NewTimer(delayedRetryInterval)
+			timerC = timer.C
+		} else if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(time.Now()))
+			timerC = timer.C
+		}
+		select {
+		case <-timerC:
+			for _, function := range functions {
+				s.wakeUp(function)
+			}
+			if !next.IsZero() {
+				after = next
+			}
+		case <-s.resetCh:
+		case <-s.stopCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// reset makes the scheduler query the next due time again
+func (s *delayedScheduler) reset() {
+	select {
+	case s.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops the scheduler and waits it to return
+func (s *delayedScheduler) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	<-s.done
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDelayedScheduler(t *testing.T) {
+	q := newMemoryQueue(newTestPolicy(DispatchPriority, nil))
+	ctx := context.Background()
+	// the job persisted before the scheduler starts, e.g. before a restart
+	assert.Nil(t, q.enqueue(ctx, &job{
+		function:  "echo",
+		handle:    testIdGen.Generate(),
+		notBefore: time.Now().Add(time.Millisecond * 50),
+	}))
+	woken := make(chan string, 2)
+	s := newDelayedScheduler(q, testLogger, func(function string) {
+		woken <- function
+	})
+	go s.run()
+	select {
+	case function := <-woken:
+		assert.Equal(t, "echo", function)
+	case <-time.After(time.Second):
+		t.Fatal("workers are not woken up when the persisted delayed job is due")
+	}
+
+	// the job due before the one the scheduler waits for
+	assert.Nil(t, q.enqueue(ctx, &job{
+		function:  "reverse",
+		handle:    testIdGen.Generate(),
+		notBefore: time.Now().Add(time.Hour),
+	}))
+	s.reset()
+	assert.Nil(t, q.enqueue(ctx, &job{
+		function:  "echo",
+		handle:    testIdGen.Generate(),
+		notBefore: time.Now().Add(time.Millisecond * 50),
+	}))
+	s.reset()
+	select {
+	case function := <-woken:
+		assert.Equal(t, "echo", function)
+	case <-time.After(time.Second):
+		t.Fatal("workers are not woken up when the delayed job is due")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the scheduler is not stopped")
+	}
+	assert.Empty(t, woken)
+}
+
+func TestDelayedSchedulerQueueError(t *testing.T) {
+	q := new(mockQueue)
+	queried := make(chan struct{}, 1)
+	q.On("nextDelayed", mock.Anything).Return(time.Time{}, nil, errors.New("queue error")).Run(func(mock.Arguments) {
+		queried <- struct{}{}
+	})
+	s := newDelayedScheduler(q, testLogger, func(function string) {
+		t.Error("no worker should be woken up")
+	})
+	go s.run()
+	<-queried
+	// the scheduler waits the retry interval, it's stopped before that
+	s.stop()
+	q.AssertNumberOfCalls(t, "nextDelayed", 1)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// the dispatch policies decide which of the queued jobs of a worker's functions is dispatched first,
+// all the queue types apply them in the same way
+const (
+	// DispatchPriority dispatches the job with the highest priority, the jobs with the same priority in FIFO order
+	DispatchPriority = "priority"
+	// DispatchFIFO dispatches the job queued first regardless of the priority
+	DispatchFIFO = "fifo"
+	// DispatchRoundRobin picks one of the worker's functions with queued jobs by weighted round robin,
+	// then dispatches the job of the function like DispatchPriority
+	DispatchRoundRobin = "round-robin"
+)
+
+var errUnknownDispatchPolicy = errors.New("Unknown dispatch policy")
+
+type dispatchPolicy struct {
+	name string
+	// weights are the weights of the functions for DispatchRoundRobin, 1 if not set
+	weights map[string]int
+	mu      sync.Mutex
+	// current is the current weights of the functions of the smooth weighted round robin
+	current map[string]int
+}
+
+// newDispatchPolicy creates the dispatch policy of the name, DispatchPriority if it's empty
+func newDispatchPolicy(name string, weights map[string]int) (*dispatchPolicy, error) {
+	switch name {
+	case "":
+		name = DispatchPriority
+	case DispatchPriority, DispatchFIFO, DispatchRoundRobin:
+	default:
+		return nil, errUnknownDispatchPolicy
+	}
+	return &dispatchPolicy{
+		name:    name,
+		weights: weights,
+		current: make(map[string]int),
+	}, nil
+}
+
+// byPriority reports whether the jobs are ordered by priority before the enqueue order
+func (p *dispatchPolicy) byPriority() bool {
+	return p.name != DispatchFIFO
+}
+
+// roundRobin reports whether the function is picked before the job
+func (p *dispatchPolicy) roundRobin() bool {
+	return p.name == DispatchRoundRobin
+}
+
+func (p *dispatchPolicy) weight(function string) int {
+	if w := p.weights[function]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// pickFunction picks one of the functions with queued jobs by the smooth weighted round robin,
+// a function gets its weight's share of the dispatches while the others have queued jobs too,
+// and the picks of the functions are interleaved instead of in bursts
+func (p *dispatchPolicy) pickFunction(functions []string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var picked string
+	total := 0
+	for _, function := range functions {
+		w := p.weight(function)
+		total += w
+		p.current[function] += w
+		if picked == "" || p.current[function] > p.current[picked] {
+			picked = function
+		}
+	}
+	p.current[picked] -= total
+	return picked
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDispatchPolicy(t *testing.T) {
+	p, err := newDispatchPolicy("", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, DispatchPriority, p.name)
+	assert.True(t, p.byPriority())
+	assert.False(t, p.roundRobin())
+
+	p, err = newDispatchPolicy(DispatchFIFO, nil)
+	assert.Nil(t, err)
+	assert.False(t, p.byPriority())
+
+	_, err = newDispatchPolicy("random", nil)
+	assert.Equal(t, errUnknownDispatchPolicy, err)
+}
+
+func TestPickFunction(t *testing.T) {
+	p := newTestPolicy(DispatchRoundRobin, map[string]int{"echo": 2})
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, p.pickFunction([]string{"echo", "reverse"}))
+	}
+	// the picks are interleaved by the weights
+	assert.Equal(t, []string{"echo", "reverse", "echo", "echo", "reverse", "echo"}, picked)
+
+	// the functions without queued jobs are not picked
+	assert.Equal(t, "reverse", p.pickFunction([]string{"reverse"}))
+}
+
+func TestDispatchPolicyMemory(t *testing.T) {
+	testDispatchPolicies(t, func(policy *dispatchPolicy) queue {
+		return newMemoryQueue(policy)
+	})
+}
+
+func TestDispatchPolicySqlite3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	testDispatchPolicies(t, func(policy *dispatchPolicy) queue {
+		q, err := newSQLQueue(QueueSqlite3Driver, filepath.Join(dir, policy.name+".db"), "gearman_queue", policy)
+		assert.Nil(t, err)
+		return q
+	})
+}
+
+// testDispatchPolicies tests the order of the dispatched jobs of each policy with the queue created by newQueue
+func testDispatchPolicies(t *testing.T, newQueue func(policy *dispatchPolicy) queue) {
+	bgCtx := context.Background()
+	functions := []string{"echo", "reverse"}
+	enqueue := func(q queue, function string, p priority) *job {
+		j := &job{function: function, handle: testIdGen.Generate(), priority: p}
+		assert.Nil(t, q.enqueue(bgCtx, j))
+		return j
+	}
+	dequeueAll := func(q queue) []string {
+		var handles []string
+		for {
+			j, err := q.dequeue(bgCtx, functions)
+			assert.Nil(t, err)
+			if j == nil {
+				return handles
+			}
+			handles = append(handles, j.handle.String())
+		}
+	}
+	handles := func(jobs ...*job) []string {
+		ret := make([]string, len(jobs))
+		for i, j := range jobs {
+			ret[i] = j.handle.String()
+		}
+		return ret
+	}
+
+	// the highest priority first, FIFO within a priority
+	q := newQueue(newTestPolicy(DispatchPriority, nil))
+	low := enqueue(q, "echo", priorityLow)
+	high1 := enqueue(q, "reverse", priorityHigh)
+	high2 := enqueue(q, "echo", priorityHigh)
+	mid := enqueue(q, "echo", priorityMid)
+	high3 := enqueue(q, "reverse", priorityHigh)
+	assert.Equal(t, handles(high1, high2, high3, mid, low), dequeueAll(q))
+	assert.Nil(t, q.dispose())
+
+	// the enqueue order regardless of the priority
+	q = newQueue(newTestPolicy(DispatchFIFO, nil))
+	low = enqueue(q, "echo", priorityLow)
+	high1 = enqueue(q, "reverse", priorityHigh)
+	mid = enqueue(q, "echo", priorityMid)
+	high2 = enqueue(q, "echo", priorityHigh)
+	assert.Equal(t, handles(low, high1, mid, high2), dequeueAll(q))
+	assert.Nil(t, q.dispose())
+
+	// the busy function doesn't starve the other one, the functions share the dispatches by weight
+	q = newQueue(newTestPolicy(DispatchRoundRobin, map[string]int{"echo": 2}))
+	var echoJobs, reverseJobs []*job
+	for i := 0; i < 6; i++ {
+		echoJobs = append(echoJobs, enqueue(q, "echo", priorityHigh))
+	}
+	reverseJobs = append(reverseJobs, enqueue(q, "reverse", priorityLow))
+	reverseJobs = append(reverseJobs, enqueue(q, "reverse", priorityLow))
+	// the jobs of a function are still dispatched by priority
+	reverseJobs = append([]*job{enqueue(q, "reverse", priorityMid)}, reverseJobs...)
+	expected := handles(echoJobs[0], reverseJobs[0], echoJobs[1],
+		echoJobs[2], reverseJobs[1], echoJobs[3],
+		echoJobs[4], reverseJobs[2], echoJobs[5])
+	assert.Equal(t, expected, dequeueAll(q))
+	assert.Nil(t, q.dispose())
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+// jobDispatcher runs the dispatched jobs on a fixed number of event loops(shards)
+// instead of a goroutine selecting on the channels of each job
+// a dispatch of a job is handled by one shard, the state of the dispatch is only touched by the goroutine of the shard
+// the events of the job: status updates, new listening clients, status queries, timeout, cancel
+// and the disconnection of the worker or a client are posted to the shard
+// posting an event never blocks, and a shard never blocks either as it neither does IO nor takes the jobs manager's lock,
+// so the jobs manager can post the events and wait for the replies with its lock held
+// the updates are written to the clients by the goroutine posting them,
+// and the finished jobs are removed or requeued out of the shard
+type jobDispatcher struct {
+	shards []*dispatchShard
+	next   uint32
+}
+
+type dispatchShard struct {
+	mu      sync.Mutex
+	events  []jobEvent
+	wake    chan struct{}
+	stopped bool
+	done    chan struct{} // closed when the loop returns
+}
+
+type jobEventType int
+
+const (
+	jobEventStart        jobEventType = iota // the job is dispatched
+	jobEventUpdate                           // a status update from the worker
+	jobEventNewConn                          // a client starts listening the job
+	jobEventQuery                            // query the status of the job
+	jobEventTimeout                          // the job timeouted
+	jobEventWorkerClosed                     // the worker disconnected
+	jobEventClientClosed                     // a listening client disconnected
+	jobEventCancel                           // the job is cancelled
+)
+
+type jobEvent struct {
+	typ   jobEventType
+	run   *jobRun
+	conn  *conn
+	msg   *gearman.Message
+	reply chan *jobEventReply
+}
+
+// jobEventReply is the reply to the events sent by the jobs manager
+type jobEventReply struct {
+	// ok is false if the dispatch was finished before the event
+	ok     bool
+	status *jobStatus
+	// forward is the listening clients an update should be forwarded to
+	forward []*conn
+	// end is set if the update finishes the job
+	end *jobEnd
+}
+
+// jobEnd is how a dispatch of a job ends
+type jobEnd struct {
+	requeue bool
+	reduce  bool
+	// result is counted by metrics
+	result string
+	// resultStatus and resultData are kept for the background jobs if resultStatus is not empty
+	resultStatus string
+	resultData   string
+	// notify is sent to the listening clients, WORK_FAIL or WORK_EXCEPTION(with jobTimeoutErrMsg)
+	notify gearman.PacketType
+}
+
+// jobRun is a dispatch of a job, the fields are only touched by the shard after the start event
+type jobRun struct {
+	job        *pendingJob
+	manager    *srvJobsManager
+	shard      *dispatchShard
+	timeout    time.Duration
+	workerConn *conn
+	timer      *time.Timer
+	// the ids of the close notifications of the worker and the listening clients
+	workerCloseID  uint64
+	clientCloseIDs map[gearman.ID]uint64
+	numerator      int
+	denominator    int
+	finished       bool
+}
+
+func newJobDispatcher(shardCnt int) *jobDispatcher {
+	if shardCnt <= 0 {
+		shardCnt = runtime.GOMAXPROCS(0)
+	}
+	d := &jobDispatcher{shards: make([]*dispatchShard, shardCnt)}
+	for i := range d.shards {
+		s := &dispatchShard{wake: make(chan struct{}, 1), done: make(chan struct{})}
+		d.shards[i] = s
+		go s.loop()
+	}
+	return d
+}
+
+// stop stops the shards and waits the events posted before to be handled,
+// the events posted after that are dropped, and the calls get the reply of a finished dispatch
+func (d *jobDispatcher) stop() {
+	for _, s := range d.shards {
+		s.mu.Lock()
+		if !s.stopped {
+			s.stopped = true
+			close(s.wake)
+		}
+		s.mu.Unlock()
+	}
+	for _, s := range d.shards {
+		<-s.done
+	}
+}
+
+// shard picks a shard for a new dispatch in turn
+func (d *jobDispatcher) shard() *dispatchShard {
+	i := atomic.AddUint32(&d.next, 1)
+	return d.shards[int(i)%len(d.shards)]
+}
+
+func (s *dispatchShard) post(ev jobEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		if ev.reply != nil {
+			ev.reply <- finishedReply
+		}
+		return
+	}
+	s.events = append(s.events, ev)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *dispatchShard) loop() {
+	defer close(s.done)
+	var events []jobEvent
+	for range s.wake {
+		s.mu.Lock()
+		events, s.events = s.events, events[:0]
+		s.mu.Unlock()
+		for i := range events {
+			events[i].run.handle(&events[i])
+			// drop the references to the finished jobs
+			events[i] = jobEvent{}
+		}
+	}
+}
+
+func (r *jobRun) post(typ jobEventType, c *conn, msg *gearman.Message, reply chan *jobEventReply) {
+	r.shard.post(jobEvent{typ: typ, run: r, conn: c, msg: msg, reply: reply})
+}
+
+// call posts the event and waits for the reply, it doesn't take long as the shard never blocks
+func (r *jobRun) call(typ jobEventType, c *conn, msg *gearman.Message) *jobEventReply {
+	reply := make(chan *jobEventReply, 1)
+	r.post(typ, c, msg, reply)
+	return <-reply
+}
+
+var finishedReply = &jobEventReply{}
+
+func (r *jobRun) handle(ev *jobEvent) {
+	if r.finished {
+		if ev.reply != nil {
+			ev.reply <- finishedReply
+		}
+		return
+	}
+	switch ev.typ {
+	case jobEventStart:
+		r.start()
+	case jobEventUpdate:
+		ev.reply <- r.update(ev.msg)
+	case jobEventNewConn:
+		r.listen(ev.conn)
+		ev.reply <- &jobEventReply{ok: true}
+	case jobEventQuery:
+		ev.reply <- &jobEventReply{ok: true, status: &jobStatus{
+			handle:       r.job.handle,
+			known:        true,
+			running:      true,
+			numerator:    r.numerator,
+			denominator:  r.denominator,
+			waitingCount: len(r.job.clientConns),
+		}}
+	case jobEventTimeout:
+		if r.job.cfg.Verbose {
+			r.job.logger.Printf("job %s timeouted", r.job)
+		}
+		if r.job.retries < r.job.cfg.jobRetries() {
+			r.end(&jobEnd{requeue: true})
+		} else {
+			r.end(&jobEnd{result: jobTimeout, resultStatus: resultException, resultData: jobTimeoutErrMsg,
+				notify: gearman.WORK_EXCEPTION})
+		}
+	case jobEventWorkerClosed:
+		if r.job.cfg.Verbose {
+			r.job.logger.Printf("worker of job %s disconnected", r.job)
+		}
+		if r.job.retries < r.job.cfg.jobRetries() {
+			r.end(&jobEnd{requeue: true})
+		} else {
+			r.end(&jobEnd{result: jobFailed, resultStatus: resultFail, notify: gearman.WORK_FAIL})
+		}
+	case jobEventClientClosed:
+		id := *ev.conn.ID()
+		if r.job.clientConns[id] == ev.conn {
+			delete(r.job.clientConns, id)
+			delete(r.clientCloseIDs, id)
+		}
+	case jobEventCancel:
+		if r.job.cfg.Verbose {
+			r.job.logger.Printf("job %s cancelled", r.job)
+		}
+		r.end(&jobEnd{result: jobCancelled, resultStatus: resultFail, notify: gearman.WORK_FAIL})
+	}
+}
+
+func (r *jobRun) start() {
+	if r.job.cfg.Verbose {
+		r.job.logger.Printf("job %s started", r.job)
+	}
+	if r.workerConn != nil {
+		r.workerCloseID = r.workerConn.notifyClose(func() {
+			r.post(jobEventWorkerClosed, nil, nil, nil)
+		})
+	}
+	r.clientCloseIDs = make(map[gearman.ID]uint64, len(r.job.clientConns))
+	for _, c := range r.job.clientConns {
+		r.watchClient(c)
+	}
+	if r.timeout > 0 {
+		r.timer = time.AfterFunc(r.timeout, func() {
+			r.post(jobEventTimeout, nil, nil, nil)
+		})
+	}
+}
+
+func (r *jobRun) watchClient(c *conn) {
+	r.clientCloseIDs[*c.ID()] = c.notifyClose(func() {
+		r.post(jobEventClientClosed, c, nil, nil)
+	})
+}
+
+func (r *jobRun) listen(c *conn) {
+	id := *c.ID()
+	if old, ok := r.job.clientConns[id]; ok {
+		old.stopNotifyClose(r.clientCloseIDs[id])
+	}
+	r.job.clientConns[id] = c
+	r.watchClient(c)
+}
+
+// update handles a status update of the worker, the update is forwarded to the clients by the caller
+// the message is not modified or recycled, the caller owns it
+func (r *jobRun) update(msg *gearman.Message) *jobEventReply {
+	reply := &jobEventReply{ok: true}
+	if r.job.mapping() {
+		// the sub-results of the mapper are collected instead of forwarded
+		switch msg.PacketType {
+		case gearman.WORK_DATA:
+			r.job.mapResults = append(r.job.mapResults, []byte(msg.Arguments[1]))
+			return reply
+		case gearman.WORK_COMPLETE:
+			// the data of WORK_COMPLETE is the last sub-result if not empty
+			if msg.Arguments[1] != "" {
+				r.job.mapResults = append(r.job.mapResults, []byte(msg.Arguments[1]))
+			}
+			reply.end = &jobEnd{reduce: true}
+			r.finish()
+			return reply
+		}
+	}
+	switch msg.PacketType {
+	case gearman.WORK_STATUS:
+		num, numErr := strconv.Atoi(msg.Arguments[1])
+		den, denErr := strconv.Atoi(msg.Arguments[2])
+		if numErr == nil && denErr == nil {
+			r.numerator = num
+			r.denominator = den
+		}
+	case gearman.WORK_COMPLETE:
+		reply.end = &jobEnd{result: jobCompleted, resultStatus: resultComplete, resultData: msg.Arguments[1]}
+	case gearman.WORK_FAIL:
+		reply.end = &jobEnd{result: jobFailed, resultStatus: resultFail}
+	case gearman.WORK_EXCEPTION:
+		reply.end = &jobEnd{result: jobFailed, resultStatus: resultException, resultData: msg.Arguments[1]}
+	}
+	if len(r.job.clientConns) > 0 {
+		reply.forward = make([]*conn, 0, len(r.job.clientConns))
+		for _, c := range r.job.clientConns {
+			reply.forward = append(reply.forward, c)
+		}
+	}
+	if reply.end != nil {
+		r.finish()
+	}
+	return reply
+}
+
+// end finishes the dispatch on an event of the shard, the job is removed or requeued out of the shard
+func (r *jobRun) end(end *jobEnd) {
+	r.finish()
+	go r.manager.endRun(r.job, end)
+}
+
+// finish stops the timer and the close notifications, no more events are handled after that
+func (r *jobRun) finish() {
+	r.finished = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.workerConn != nil {
+		r.workerConn.stopNotifyClose(r.workerCloseID)
+	}
+	for _, c := range r.job.clientConns {
+		c.stopNotifyClose(r.clientCloseIDs[*c.ID()])
+	}
+	r.clientCloseIDs = nil
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherClientClosed(t *testing.T) {
+	d := newJobDispatcher(2)
+	defer d.stop()
+	client1 := newMockSConn(10, 10)
+	client2 := newMockSConn(10, 10)
+	pJob := &pendingJob{
+		handle:      testIdGen.Generate(),
+		clientConns: map[gearman.ID]*conn{*client1.ID(): client1.srvConn, *client2.ID(): client2.srvConn},
+		logger:      testLogger,
+		cfg:         new(Config),
+	}
+	run := &jobRun{job: pJob, shard: d.shard()}
+	run.post(jobEventStart, nil, nil, nil)
+
+	client1.Close()
+	time.Sleep(time.Millisecond * 10)
+	reply := run.call(jobEventQuery, nil, nil)
+	assert.True(t, reply.ok)
+	assert.Equal(t, 1, reply.status.waitingCount)
+
+	msg := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_STATUS,
+		Arguments:  []string{pJob.handle.String(), "1", "2"},
+	}
+	reply = run.call(jobEventUpdate, nil, msg)
+	assert.True(t, reply.ok)
+	assert.Nil(t, reply.end)
+	assert.Equal(t, []*conn{client2.srvConn}, reply.forward)
+
+	msg = &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{pJob.handle.String(), "done"},
+	}
+	reply = run.call(jobEventUpdate, nil, msg)
+	assert.True(t, reply.ok)
+	assert.Equal(t, &jobEnd{result: jobCompleted, resultStatus: resultComplete, resultData: "done"}, reply.end)
+
+	// the events are dropped once the dispatch is finished
+	assert.False(t, run.call(jobEventQuery, nil, nil).ok)
+	assert.False(t, run.call(jobEventNewConn, client1.srvConn, nil).ok)
+	client2.srvConn.closeMu.Lock()
+	assert.Empty(t, client2.srvConn.closeFns)
+	client2.srvConn.closeMu.Unlock()
+}
+
+func TestDispatcherStop(t *testing.T) {
+	d := newJobDispatcher(2)
+	pJob := &pendingJob{
+		handle:      testIdGen.Generate(),
+		clientConns: make(map[gearman.ID]*conn),
+		logger:      testLogger,
+		cfg:         new(Config),
+	}
+	run := &jobRun{job: pJob, shard: d.shard(), timeout: time.Hour}
+	run.post(jobEventStart, nil, nil, nil)
+	reply := make(chan *jobEventReply, 1)
+	run.post(jobEventQuery, nil, nil, reply)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the shards are not stopped")
+	}
+	// the events posted before are handled
+	assert.True(t, (<-reply).ok)
+	for _, s := range d.shards {
+		<-s.done
+	}
+	// and the ones after are dropped
+	assert.False(t, run.call(jobEventQuery, nil, nil).ok)
+	d.stop()
+}
+
+func TestConnNotifyClose(t *testing.T) {
+	c := newMockSConn(10, 10)
+	fired := make(chan int, 3)
+	c.srvConn.notifyClose(func() { fired <- 1 })
+	id := c.srvConn.notifyClose(func() { fired <- 2 })
+	c.srvConn.stopNotifyClose(id)
+	c.Close()
+	assert.Equal(t, 1, <-fired)
+
+	// called at once if it's closed already
+	for {
+		c.srvConn.closeMu.Lock()
+		closeFired := c.srvConn.closeFired
+		c.srvConn.closeMu.Unlock()
+		if closeFired {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.srvConn.notifyClose(func() { fired <- 3 })
+	assert.Equal(t, 3, <-fired)
+	assert.Equal(t, 0, len(fired))
+}
+
+// the dispatched jobs and the listening clients of each job in the benchmarks
+const (
+	benchJobs    = 10000
+	benchClients = 3
+)
+
+// reflectSelectJob is the job loop replaced by the dispatcher, kept as the baseline of the benchmarks
+// each job has a goroutine rebuilding the select cases with one case per client in every iteration
+type reflectSelectJob struct {
+	statusUpdateChan chan *gearman.Message
+	newConnChan      chan *conn
+	statusQueryChan  chan chan *jobStatus
+	workerClosed     chan struct{}
+	timer            *time.Timer
+	clientConns      map[gearman.ID]*conn
+	numerator        int
+	denominator      int
+}
+
+const (
+	benchIdxStatusUpdate = iota
+	benchIdxTimeout
+	benchIdxNewConn
+	benchIdxQueryStatus
+	benchIdxWorkerClosed
+
+	benchStaticSelectCnt
+)
+
+func (j *reflectSelectJob) run() {
+	for {
+		cases := make([]reflect.SelectCase, len(j.clientConns)+benchStaticSelectCnt)
+		casesConnMap := make(map[int]gearman.Conn)
+		cases[benchIdxStatusUpdate] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(j.statusUpdateChan)}
+		cases[benchIdxTimeout] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(j.timer.C)}
+		cases[benchIdxNewConn] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(j.newConnChan)}
+		cases[benchIdxQueryStatus] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(j.statusQueryChan)}
+		cases[benchIdxWorkerClosed] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(j.workerClosed)}
+		i := benchStaticSelectCnt
+		for _, conn := range j.clientConns {
+			casesConnMap[i] = conn
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(conn.Closed())}
+			i++
+		}
+		chosen, value, _ := reflect.Select(cases)
+		switch chosen {
+		case benchIdxStatusUpdate:
+			msg := value.Interface().(*gearman.Message)
+			num, numErr := strconv.Atoi(msg.Arguments[1])
+			den, denErr := strconv.Atoi(msg.Arguments[2])
+			if numErr == nil && denErr == nil {
+				j.numerator = num
+				j.denominator = den
+			}
+		case benchIdxTimeout, benchIdxWorkerClosed:
+			return
+		case benchIdxNewConn:
+			conn := value.Interface().(*conn)
+			j.clientConns[*conn.ID()] = conn
+		case benchIdxQueryStatus:
+			value.Interface().(chan *jobStatus) <- &jobStatus{
+				known:        true,
+				running:      true,
+				numerator:    j.numerator,
+				denominator:  j.denominator,
+				waitingCount: len(j.clientConns),
+			}
+		default:
+			delete(j.clientConns, *casesConnMap[chosen].ID())
+		}
+	}
+}
+
+func benchClientConns() map[gearman.ID]*conn {
+	conns := make(map[gearman.ID]*conn, benchClients)
+	for i := 0; i < benchClients; i++ {
+		c := newMockSConn(0, 0)
+		conns[*c.ID()] = c.srvConn
+	}
+	return conns
+}
+
+func startReflectSelectJobs(b *testing.B) []*reflectSelectJob {
+	jobs := make([]*reflectSelectJob, benchJobs)
+	for i := range jobs {
+		jobs[i] = &reflectSelectJob{
+			statusUpdateChan: make(chan *gearman.Message),
+			newConnChan:      make(chan *conn),
+			statusQueryChan:  make(chan chan *jobStatus),
+			workerClosed:     make(chan struct{}),
+			timer:            time.NewTimer(time.Hour),
+			clientConns:      benchClientConns(),
+		}
+		go jobs[i].run()
+	}
+	b.Cleanup(func() {
+		for _, j := range jobs {
+			close(j.workerClosed)
+		}
+	})
+	return jobs
+}
+
+func startDispatchedJobs(b *testing.B) []*jobRun {
+	d := newJobDispatcher(0)
+	runs := make([]*jobRun, benchJobs)
+	for i := range runs {
+		pJob := &pendingJob{
+			handle:      testIdGen.Generate(),
+			clientConns: benchClientConns(),
+			logger:      testLogger,
+			cfg:         new(Config),
+		}
+		runs[i] = &jobRun{job: pJob, shard: d.shard(), timeout: time.Hour}
+		runs[i].post(jobEventStart, nil, nil, nil)
+	}
+	b.Cleanup(func() {
+		for _, r := range runs {
+			r.call(jobEventUpdate, nil, &gearman.Message{PacketType: gearman.WORK_FAIL})
+		}
+		d.stop()
+	})
+	return runs
+}
+
+func benchStatusMsg() *gearman.Message {
+	return &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_STATUS,
+		Arguments:  []string{"H", "1", "2"},
+	}
+}
+
+func BenchmarkJobStatusUpdateReflectSelect(b *testing.B) {
+	jobs := startReflectSelectJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := benchStatusMsg()
+		for pb.Next() {
+			jobs[int(atomic.AddUint32(&next, 1))%len(jobs)].statusUpdateChan <- msg
+		}
+	})
+}
+
+func BenchmarkJobStatusUpdateDispatcher(b *testing.B) {
+	runs := startDispatchedJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := benchStatusMsg()
+		for pb.Next() {
+			runs[int(atomic.AddUint32(&next, 1))%len(runs)].call(jobEventUpdate, nil, msg)
+		}
+	})
+}
+
+func BenchmarkJobStatusQueryReflectSelect(b *testing.B) {
+	jobs := startReflectSelectJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			reply := make(chan *jobStatus)
+			jobs[int(atomic.AddUint32(&next, 1))%len(jobs)].statusQueryChan <- reply
+			<-reply
+		}
+	})
+}
+
+func BenchmarkJobStatusQueryDispatcher(b *testing.B) {
+	runs := startDispatchedJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			runs[int(atomic.AddUint32(&next, 1))%len(runs)].call(jobEventQuery, nil, nil)
+		}
+	})
+}
+
+func BenchmarkJobListenReflectSelect(b *testing.B) {
+	jobs := startReflectSelectJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := newMockSConn(0, 0).srvConn
+		for pb.Next() {
+			jobs[int(atomic.AddUint32(&next, 1))%len(jobs)].newConnChan <- c
+		}
+	})
+}
+
+func BenchmarkJobListenDispatcher(b *testing.B) {
+	runs := startDispatchedJobs(b)
+	var next uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := newMockSConn(0, 0).srvConn
+		for pb.Next() {
+			runs[int(atomic.AddUint32(&next, 1))%len(runs)].call(jobEventNewConn, c, nil)
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+// the default and the max time a foreground job submitted to the gateway is waited
+const (
+	gatewayDefaultWait = time.Second * 30
+	gatewayMaxWait     = time.Minute * 10
+)
+
+const (
+	errCodeInternal    = "internal_error"
+	errCodeWaitTimeout = "wait_timeout"
+)
+
+var errGatewayConnClosed = errors.New("Gateway connection closed")
+var errGatewayWaitTimeout = errors.New("Wait elapsed, the result can't be waited again without a unique ID")
+var errGatewayTxtMsg = errors.New("Text message is not supported by the gateway connection")
+
+// gateway is the HTTP/JSON gateway for the services can't speak the binary protocol
+//
+//	POST /jobs/FUNCTION?unique=ID&priority=high|normal|low&background=1&wait=30s
+//	GET  /jobs/HANDLE
+//
+// the body of POST is the data of the job, a foreground job is long polled until it's done or wait elapsed,
+// its result is kept in the result store if the wait elapsed, GET returns it once the job is done
+type gateway struct {
+	handleGen    HandleGenerator
+	connIDGen    *gearman.IDGenerator
+	sleepManager *sleepManager
+	jobsManager  jobsManager
+	connManager  *gearman.ConnManager
+	results      resultStore // nil if the results are not kept
+	cfg          *Config
+	logger       *log.Logger
+}
+
+func (s *Server) newGateway() *gateway {
+	return &gateway{
+		handleGen:    s.jobHandleGenerator,
+		connIDGen:    s.clientIDGenerator,
+		sleepManager: s.sleepManager,
+		jobsManager:  s.jobsManager,
+		connManager:  s.connManager,
+		results:      s.results,
+		cfg:          s.cfg,
+		logger:       s.logger,
+	}
+}
+
+// gatewayJobResp is the response of the jobs submitted
+type gatewayJobResp struct {
+	Handle string `json:"handle"`
+	// Status is queued for the background jobs, running if the wait elapsed,
+	// complete, fail or exception if the job is done
+	Status string `json:"status"`
+	// Data is the result of a completed job, base64 encoded in JSON
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// gatewayStatusResp is the response of GET /jobs/HANDLE, the same as STATUS_RES,
+// Status, Data and Error are set like gatewayJobResp if the job is done and its result is kept
+type gatewayStatusResp struct {
+	Handle      string `json:"handle"`
+	Known       bool   `json:"known"`
+	Running     bool   `json:"running"`
+	Numerator   int    `json:"numerator"`
+	Denominator int    `json:"denominator"`
+	Status      string `json:"status,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type gatewayErrorResp struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	arg := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if arg == "" || arg == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		g.submit(w, r, arg)
+	case http.MethodGet:
+		g.status(w, r, arg)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		g.writeError(w, http.StatusMethodNotAllowed, errCodeInvalidArgument, errors.New("Method not allowed"))
+	}
+}
+
+// requestContext returns the context to call the jobs manager with the request timeout applied
+func (g *gateway) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if g.cfg.RequestTimeout > 0 {
+		return context.WithTimeout(r.Context(), g.cfg.RequestTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+func (g *gateway) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		g.logger.Printf("failed to write gateway response: %s", err)
+	}
+}
+
+func (g *gateway) writeError(w http.ResponseWriter, code int, errCode string, err error) {
+	g.writeJSON(w, code, &gatewayErrorResp{errCode, err.Error()})
+}
+
+// parseSubmitArgs parses the query of POST /jobs/FUNCTION
+func parseSubmitArgs(r *http.Request) (priority, jobBackgroud, time.Duration, error) {
+	query := r.URL.Query()
+	p := priorityMid
+	switch query.Get("priority") {
+	case "high":
+		p = priorityHigh
+	case "low":
+		p = priorityLow
+	case "", "normal":
+	default:
+		return 0, false, 0, fmt.Errorf("Invalid priority %q, high, normal or low expected", query.Get("priority"))
+	}
+	bg := nonBackgroud
+	switch query.Get("background") {
+	case "1", "true":
+		bg = backgroud
+	case "", "0", "false":
+	default:
+		return 0, false, 0, fmt.Errorf("Invalid background %q", query.Get("background"))
+	}
+	wait := gatewayDefaultWait
+	if waitStr := query.Get("wait"); waitStr != "" {
+		var err error
+		wait, err = time.ParseDuration(waitStr)
+		if err != nil || wait < 0 || wait > gatewayMaxWait {
+			return 0, false, 0, fmt.Errorf("Invalid wait %q, a duration up to %s expected", waitStr, gatewayMaxWait)
+		}
+	}
+	return p, bg, wait, nil
+}
+
+func (g *gateway) submit(w http.ResponseWriter, r *http.Request, function string) {
+	priority, bg, wait, err := parseSubmitArgs(r)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, errCodeInvalidArgument, err)
+		return
+	}
+	body := r.Body
+	if g.cfg.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, int64(g.cfg.MaxBodySize))
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		g.writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, err)
+		return
+	}
+	j := &job{
+		function: function,
+		handle:   g.handleGen.Generate(),
+		uniqueID: r.URL.Query().Get("unique"),
+		priority: priority,
+		data:     string(data),
+	}
+	var listenConn *conn
+	var gwConn *gatewayConn
+	if bg == nonBackgroud {
+		gwConn = newGatewayConn(g.connIDGen.Generate())
+		defer gwConn.Close()
+		listenConn = newServerConn(gwConn)
+		listenConn.setForwardException(true)
+	}
+	ctx, cancel := g.requestContext(r)
+	handle, err := g.jobsManager.submitJob(ctx, j, listenConn)
+	cancel()
+	if err == errQueueFull {
+		g.writeError(w, http.StatusServiceUnavailable, errCodeQueueFull, err)
+		return
+	} else if err == errShuttingDown {
+		g.writeError(w, http.StatusServiceUnavailable, errCodeShuttingDown, err)
+		return
+	} else if err != nil {
+		g.logger.Printf("failed to submit job %s from gateway: %s", function, err)
+		g.writeError(w, http.StatusInternalServerError, errCodeInternal, err)
+		return
+	}
+	g.sleepManager.wakeUp(g.connManager, function)
+
+	resp := &gatewayJobResp{Handle: handle.String(), Status: "queued"}
+	if bg == backgroud {
+		g.writeJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	resp.Status = "running"
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-gwConn.msgs:
+			switch msg.PacketType {
+			case gearman.WORK_COMPLETE:
+				resp.Status = "complete"
+				resp.Data = []byte(msg.Arguments[1])
+			case gearman.WORK_FAIL:
+				resp.Status = "fail"
+			case gearman.WORK_EXCEPTION:
+				resp.Status = "exception"
+				resp.Error = msg.Arguments[1]
+			default:
+				// WORK_DATA, WORK_STATUS and WORK_WARNING are not forwarded
+				continue
+			}
+			g.writeJSON(w, http.StatusOK, resp)
+			return
+		case <-timer.C:
+			if g.results != nil {
+				if !g.jobsManager.keepResult(handle) {
+					// the job is just done, its result is on the way
+					continue
+				}
+			} else if j.uniqueID == "" {
+				g.writeError(w, http.StatusGatewayTimeout, errCodeWaitTimeout, errGatewayWaitTimeout)
+				return
+			}
+			// GET the result later, or submit again with the same unique ID to wait for the running job
+			g.writeJSON(w, http.StatusAccepted, resp)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (g *gateway) status(w http.ResponseWriter, r *http.Request, handleStr string) {
+	resp := &gatewayStatusResp{Handle: handleStr}
+	handle, err := gearman.UnmarshalID(handleStr)
+	if err != nil {
+		g.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	ctx, cancel := g.requestContext(r)
+	defer cancel()
+	js := g.jobsManager.getJobStatus(ctx, handle, "")
+	resp.Known = js.known
+	if js.running {
+		resp.Running = true
+		resp.Numerator = js.numerator
+		resp.Denominator = js.denominator
+	}
+	if !js.known && g.results != nil {
+		result, err := g.results.get(ctx, handleStr, "")
+		if err != nil {
+			g.logger.Printf("failed to get the result of job %s from gateway: %s", handleStr, err)
+			g.writeError(w, http.StatusInternalServerError, errCodeInternal, err)
+			return
+		}
+		if result != nil {
+			resp.Status = result.status
+			switch result.status {
+			case resultComplete:
+				resp.Data = []byte(result.data)
+			case resultException:
+				resp.Error = result.data
+			}
+		}
+	}
+	g.writeJSON(w, http.StatusOK, resp)
+}
+
+// gatewayConn is the connection the WORK_* packets of a job submitted to the gateway are sent to
+type gatewayConn struct {
+	id        *gearman.ID
+	msgs      chan *gearman.Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newGatewayConn(id *gearman.ID) *gatewayConn {
+	return &gatewayConn{
+		id:     id,
+		msgs:   make(chan *gearman.Message, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+// ReadMsg returns io.EOF as nothing is sent from the gateway connection
+func (c *gatewayConn) ReadMsg() (*gearman.Message, string, error) {
+	return nil, "", io.EOF
+}
+
+// WriteMsg passes a copy of the message to the waiting request, it blocks until the request takes it or goes away
+func (c *gatewayConn) WriteMsg(m *gearman.Message) error {
+	msgCopy := *m
+	msgCopy.Arguments = append([]string(nil), m.Arguments...)
+	select {
+	case c.msgs <- &msgCopy:
+		return nil
+	case <-c.closed:
+		return errGatewayConnClosed
+	}
+}
+
+func (c *gatewayConn) WriteTxtMsg(content string) error {
+	return errGatewayTxtMsg
+}
+
+func (c *gatewayConn) WriteBin(binData []byte) error {
+	msg, _, err := gearman.NextMessage(bufio.NewReader(bytes.NewReader(binData)))
+	if err != nil {
+		return err
+	}
+	return c.WriteMsg(msg)
+}
+
+func (c *gatewayConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *gatewayConn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *gatewayConn) ID() *gearman.ID {
+	return c.id
+}
+
+func (c *gatewayConn) String() string {
+	return fmt.Sprintf("gateway(%s)", c.id)
+}
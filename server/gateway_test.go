@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+)
+
+func gatewayCall(t *testing.T, g *gateway, method, url string, body []byte, resp interface{}) int {
+	recorder := httptest.NewRecorder()
+	g.ServeHTTP(recorder, httptest.NewRequest(method, url, bytes.NewReader(body)))
+	if resp != nil {
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), resp), recorder.Body.String())
+	}
+	return recorder.Code
+}
+
+func TestGatewayBackground(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	g := s.newGateway()
+
+	var resp gatewayJobResp
+	code := gatewayCall(t, g, http.MethodPost, "/jobs/echo?background=1&priority=high&unique=job1", []byte("hello"), &resp)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "queued", resp.Status)
+
+	var status gatewayStatusResp
+	code = gatewayCall(t, g, http.MethodGet, "/jobs/"+resp.Handle, nil, &status)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, gatewayStatusResp{Handle: resp.Handle, Known: true}, status)
+
+	j, err := s.queue.dequeue(context.Background(), []string{"echo"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", j.data)
+	assert.Equal(t, "job1", j.uniqueID)
+	assert.Equal(t, priorityHigh, j.priority)
+
+	code = gatewayCall(t, g, http.MethodGet, "/jobs/H:unknown:1", nil, &status)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, gatewayStatusResp{Handle: "H:unknown:1"}, status)
+
+	var errResp gatewayErrorResp
+	code = gatewayCall(t, g, http.MethodPost, "/jobs/echo?priority=urgent", nil, &errResp)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, errCodeInvalidArgument, errResp.Code)
+	code = gatewayCall(t, g, http.MethodPost, "/jobs/echo?wait=forever", nil, &errResp)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code = gatewayCall(t, g, http.MethodPut, "/jobs/echo", nil, &errResp)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code = gatewayCall(t, g, http.MethodGet, "/jobs/", nil, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// job1 is still counted as queued by the jobs manager
+	s.jobsManager.setMaxQueue("echo", QueueLimit{1, 1, 1})
+	code = gatewayCall(t, g, http.MethodPost, "/jobs/echo?background=1&priority=high", nil, &errResp)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, errCodeQueueFull, errResp.Code)
+}
+
+func TestGatewayForeground(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	g := s.newGateway()
+	worker := serveForTest(s)
+	defer close(worker.ReadCh)
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+
+	// no worker takes the job before the wait elapsed
+	var resp gatewayJobResp
+	code := gatewayCall(t, g, http.MethodPost, "/jobs/reverse?wait=50ms&unique=job1", []byte("hello"), &resp)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "running", resp.Status)
+	// the result can't be waited again without a unique ID or the result store
+	var errResp gatewayErrorResp
+	code = gatewayCall(t, g, http.MethodPost, "/jobs/reverse?wait=50ms", []byte("hello"), &errResp)
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+	assert.Equal(t, errCodeWaitTimeout, errResp.Code)
+
+	cases := []struct {
+		packet   gearman.PacketType
+		args     []string
+		expected gatewayJobResp
+	}{
+		{gearman.WORK_COMPLETE, []string{"olleh"}, gatewayJobResp{Status: "complete", Data: []byte("olleh")}},
+		{gearman.WORK_FAIL, nil, gatewayJobResp{Status: "fail"}},
+		{gearman.WORK_EXCEPTION, []string{"boom"}, gatewayJobResp{Status: "exception", Error: "boom"}},
+	}
+	for _, c := range cases {
+		type result struct {
+			code int
+			resp gatewayJobResp
+		}
+		results := make(chan result, 1)
+		go func() {
+			var resp gatewayJobResp
+			code := gatewayCall(t, g, http.MethodPost, "/jobs/echo?unique="+c.packet.String(), []byte("hello"), &resp)
+			results <- result{code, resp}
+		}()
+		var assign *gearman.Message
+		for i := 0; i < 100; i++ {
+			assign = request(t, worker, gearman.GRAB_JOB)
+			if assign.PacketType == gearman.JOB_ASSIGN {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, gearman.JOB_ASSIGN, assign.PacketType)
+		assert.Equal(t, "hello", assign.Arguments[2])
+		handle := assign.Arguments[0]
+		worker.ReadCh <- &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: gearman.WORK_STATUS,
+			Arguments:  []string{handle, "1", "2"},
+		}
+		worker.ReadCh <- &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: c.packet,
+			Arguments:  append([]string{handle}, c.args...),
+		}
+		select {
+		case r := <-results:
+			assert.Equal(t, http.StatusOK, r.code)
+			c.expected.Handle = handle
+			assert.Equal(t, c.expected, r.resp)
+		case <-time.After(time.Second):
+			t.Fatalf("no gateway response for %s", c.packet)
+		}
+	}
+}
+
+func TestGatewayKeepResult(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	s.results = newMemoryResultStore()
+	s.jobsManager.(*srvJobsManager).results = s.results
+	g := s.newGateway()
+	worker := serveForTest(s)
+	defer close(worker.ReadCh)
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+
+	// the wait elapsed before a worker takes the job
+	var resp gatewayJobResp
+	code := gatewayCall(t, g, http.MethodPost, "/jobs/echo?wait=50ms", []byte("hello"), &resp)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "running", resp.Status)
+
+	assign := request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, assign.PacketType)
+	assert.Equal(t, resp.Handle, assign.Arguments[0])
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{resp.Handle, "olleh"},
+	}
+
+	var status gatewayStatusResp
+	for i := 0; i < 100; i++ {
+		gatewayCall(t, g, http.MethodGet, "/jobs/"+resp.Handle, nil, &status)
+		if status.Status != "" {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, gatewayStatusResp{Handle: resp.Handle, Status: "complete", Data: []byte("olleh")}, status)
+}
@@ -1,25 +1,158 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/peonone/gearman/server"
 )
 
 var bindAddr = flag.String("bind-addr", ":4730", "Addr the server should listen on.")
+var listenAddrs addrsFlag
+var adminListenAddrs addrsFlag
 var logFile = flag.String("log-file", "/usr/local/var/log/gearmand.log", "the log file")
 var logToStdErr = flag.Bool("log-stderr", true, "print logs to stderr")
 var verbose = flag.Bool("verbose", false, "enable verbose mode")
-var queueType = flag.String("queue-type", server.QueueSQL, "queue type")
-var sqlQueueDriver = flag.String("sql-queue-driver", server.QueueSqlite3Driver, "sql queue driver")
+var queueType = flag.String("queue-type", server.QueueSQL, "queue type, sql or memory")
+var sqlQueueDriver = flag.String("sql-queue-driver", server.QueueSqlite3Driver, "sql queue driver, sqlite3, postgres or mysql")
 var sqlQueueDataSource = flag.String("sql-queue-datasource", "gearmand.dat", "sql queue datasource")
 var requestTimeout = flag.Duration("request-timeout", time.Second*1, "request timeout")
+var maxBodySize = flag.Uint("max-body-size", 64*1024*1024, "max body size of a packet in bytes up to 4294967295, 0 means no limit")
+var jobRetries = flag.Int("job-retries", server.DefaultJobRetries, "max times a job is requeued after its worker disconnected or timeouted, negative disables requeueing")
+var tlsCert = flag.String("tls-cert", "", "PEM encoded certificate file, the server accepts TLS connections only if it's set")
+var tlsKey = flag.String("tls-key", "", "PEM encoded private key file of the certificate")
+var tlsClientCA = flag.String("tls-client-ca", "", "PEM encoded CA file to verify the client certificates, the clients must present a certificate if it's set")
+var metricsAddr = flag.String("metrics-addr", "", "HTTP addr exposing the Prometheus metrics on /metrics, disabled if empty")
+var gatewayAddr = flag.String("gateway-addr", "", "HTTP addr of the JSON gateway serving /jobs/, disabled if empty, can be the same as -metrics-addr")
+var resultStoreType = flag.String("result-store", "", "memory or sql to keep the results of the background jobs, disabled if empty, sql shares the database of the sql queue")
+var resultTTL = flag.Duration("result-ttl", time.Hour*24, "how long the results of the background jobs are kept")
+var dispatchPolicy = flag.String("dispatch-policy", server.DispatchPriority, "order the queued jobs are dispatched in, priority, fifo or round-robin")
+var idleTimeout = flag.Duration("idle-timeout", time.Minute*5, "how long a sleeping worker waits for the next packet before it's probed with NOOP, the worker not answering in another timeout is reaped, the busy workers and the clients are never probed, 0 disables")
+var shutdownTimeout = flag.Duration("shutdown-timeout", time.Second*30, "max time to wait the dispatched jobs done on SIGTERM or SIGINT")
+
+// addrsFlag collects the values of a flag given more than once
+type addrsFlag []string
+
+func (f *addrsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *addrsFlag) Set(addr string) error {
+	*f = append(*f, addr)
+	return nil
+}
+
+// maxQueueFlag collects the max queue sizes of the functions given as FUNCTION=SIZE or FUNCTION=HIGH,NORMAL,LOW
+type maxQueueFlag map[string]server.QueueLimit
+
+var maxQueue = make(maxQueueFlag)
+
+func (f maxQueueFlag) String() string {
+	var ret []string
+	for function, limit := range f {
+		ret = append(ret, fmt.Sprintf("%s=%d,%d,%d", function, limit[0], limit[1], limit[2]))
+	}
+	return strings.Join(ret, " ")
+}
+
+func (f maxQueueFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid max queue %q, FUNCTION=SIZE or FUNCTION=HIGH,NORMAL,LOW expected", value)
+	}
+	limit, err := server.ParseQueueLimit(strings.Split(parts[1], ","))
+	if err != nil {
+		return err
+	}
+	f[parts[0]] = limit
+	return nil
+}
+
+// weightsFlag collects the weights of the functions given as FUNCTION=WEIGHT
+type weightsFlag map[string]int
+
+var weights = make(weightsFlag)
+
+func (f weightsFlag) String() string {
+	var ret []string
+	for function, weight := range f {
+		ret = append(ret, fmt.Sprintf("%s=%d", function, weight))
+	}
+	return strings.Join(ret, " ")
+}
+
+func (f weightsFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid weight %q, FUNCTION=WEIGHT expected", value)
+	}
+	weight, err := strconv.Atoi(parts[1])
+	if err != nil || weight <= 0 {
+		return fmt.Errorf("invalid weight %q, a positive integer expected", value)
+	}
+	f[parts[0]] = weight
+	return nil
+}
+
+func init() {
+	flag.Var(weights, "weight", "FUNCTION=WEIGHT weight of the function for the round-robin dispatch policy, 1 by default, can be given more than once")
+	flag.Var(maxQueue, "maxqueue", "FUNCTION=SIZE or FUNCTION=HIGH,NORMAL,LOW max queued jobs of the function by priority, can be given more than once")
+	flag.Var(&listenAddrs, "listen", "tcp://HOST:PORT or unix:///PATH to listen on, can be given more than once, overrides -bind-addr, the -tls-* flags apply unless overridden by ?tls-cert=FILE&tls-key=FILE&tls-client-ca=FILE, or ?tls=off for plaintext")
+	flag.Var(&adminListenAddrs, "admin-listen", "tcp://HOST:PORT or unix:///PATH accepting the administrative protocol only, can be given more than once, plaintext unless ?tls-cert=FILE&tls-key=FILE[&tls-client-ca=FILE] is given")
+}
+
+// listeners returns the listeners of the flags, the TLS flags apply to the -listen ones without their own TLS options
+// nil is returned if neither -listen nor -admin-listen is given, then -bind-addr is used
+func listeners() ([]server.ListenerConfig, error) {
+	var ret []server.ListenerConfig
+	if len(listenAddrs) == 0 && len(adminListenAddrs) > 0 {
+		listenAddrs = addrsFlag{*bindAddr}
+	}
+	base := server.ListenerConfig{
+		TLSCertFile:     *tlsCert,
+		TLSKeyFile:      *tlsKey,
+		TLSClientCAFile: *tlsClientCA,
+	}
+	for _, addr := range listenAddrs {
+		l, err := server.ParseListenerConfig(addr, base)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	for _, addr := range adminListenAddrs {
+		l, err := server.ParseListenerConfig(addr, server.ListenerConfig{AdminOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
 
 func main() {
 	flag.Parse()
+	if *maxBodySize > math.MaxUint32 {
+		log.Printf("invalid -max-body-size %d, at most %d", *maxBodySize, uint64(math.MaxUint32))
+		return
+	}
+	listenerCfgs, err := listeners()
+	if err != nil {
+		log.Printf("invalid listeners: %s", err)
+		return
+	}
 	cfg := &server.Config{
 		BindAddr:        *bindAddr,
 		LogFilePath:     *logFile,
@@ -29,12 +162,40 @@ func main() {
 		QueueDriver:     *sqlQueueDriver,
 		QueueTableName:  "queue",
 		QueueDataSource: *sqlQueueDataSource,
+		ResultStoreType: *resultStoreType,
+		ResultTableName: "results",
+		ResultTTL:       *resultTTL,
 		RequestTimeout:  *requestTimeout,
+		MaxBodySize:     uint32(*maxBodySize),
+		JobRetries:      *jobRetries,
+		TLSCertFile:     *tlsCert,
+		TLSKeyFile:      *tlsKey,
+		TLSClientCAFile: *tlsClientCA,
+		MetricsAddr:     *metricsAddr,
+		GatewayAddr:     *gatewayAddr,
+		Listeners:       listenerCfgs,
+		MaxQueue:        maxQueue,
+		DispatchPolicy:  *dispatchPolicy,
+		FunctionWeights: weights,
+		IdleTimeout:     *idleTimeout,
 	}
 	srv, err := server.NewServer(cfg)
 	if err != nil {
 		log.Printf("failed to initialize server: %s", err)
 		return
 	}
-	srv.Run()
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigCh
+		log.Printf("received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("failed to shutdown gracefully: %s", err)
+		}
+	}()
+	if err := srv.Run(); err != nil {
+		log.Printf("server exited: %s", err)
+	}
 }
@@ -27,9 +27,6 @@ func (h *getStatusHandler) handle(ctx context.Context, m *gearman.Message, conn
 	switch m.PacketType {
 	case gearman.GET_STATUS:
 		handle, err = gearman.UnmarshalID(m.Arguments[0])
-		if err != nil {
-			return true, err
-		}
 		packet = gearman.STATUS_RES
 		argsLen = 5
 	case gearman.GET_STATUS_UNIQUE:
@@ -37,22 +34,27 @@ func (h *getStatusHandler) handle(ctx context.Context, m *gearman.Message, conn
 		packet = gearman.STATUS_RES_UNIQUE
 		argsLen = 6
 	}
-	jobStatus := h.jobsManager.getJobStatus(ctx, handle, uniqueID)
+	var js *jobStatus
+	if err != nil {
+		// the handle is empty, so the job is unknown
+		js = &jobStatus{known: false}
+	} else {
+		js = h.jobsManager.getJobStatus(ctx, handle, uniqueID)
+	}
 	args := make([]string, argsLen)
 
 	knownStr, runningStr, numStr, denStr, waitingCntStr := "0", "0", "0", "0", "0"
-	if jobStatus.known {
+	if js.known {
 		knownStr = "1"
-		if jobStatus.running {
+		if js.running {
 			runningStr = "1"
-			numStr = strconv.Itoa(jobStatus.numerator)
-			denStr = strconv.Itoa(jobStatus.denominator)
+			numStr = strconv.Itoa(js.numerator)
+			denStr = strconv.Itoa(js.denominator)
 		}
-		waitingCntStr = strconv.Itoa(jobStatus.waitingCount)
-	}
-	if jobStatus.handle != nil {
-		args[0] = jobStatus.handle.String()
+		waitingCntStr = strconv.Itoa(js.waitingCount)
 	}
+	// the first argument is the handle for STATUS_RES, and the unique ID for STATUS_RES_UNIQUE
+	args[0] = m.Arguments[0]
 	args[1] = knownStr
 	args[2] = runningStr
 	args[3] = numStr
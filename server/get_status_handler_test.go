@@ -69,7 +69,7 @@ func TestGetStatusHandler(t *testing.T) {
 		assert.Equal(t, gearman.MagicRes, sentMsg.MagicType)
 		assert.Equal(t, sentPacket, sentMsg.PacketType)
 		assert.Equal(t, argsLen, len(sentMsg.Arguments))
-		assert.Equal(t, handle.String(), sentMsg.Arguments[0])
+		assert.Equal(t, id, sentMsg.Arguments[0])
 		switch testData.known {
 		case true:
 			assert.Equal(t, "1", sentMsg.Arguments[1])
@@ -104,6 +104,21 @@ func TestGetStatusHandler(t *testing.T) {
 	sentMsg := <-conn.WriteCh
 	assert.Equal(t, gearman.MagicRes, sentMsg.MagicType)
 	assert.Equal(t, gearman.STATUS_RES_UNIQUE, sentMsg.PacketType)
-	assert.Equal(t, "", sentMsg.Arguments[0])
+	assert.Equal(t, notExistsUniqueID, sentMsg.Arguments[0])
+	assert.Equal(t, "0", sentMsg.Arguments[1])
+
+	// the handles generated by other servers are looked up as well
+	unknownHandle := gearman.ID("H:unknown:1")
+	jobsManager.On("getJobStatus", ctx, &unknownHandle, "").Return(&jobStatus{known: false}).Once()
+	msg = &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.GET_STATUS,
+		Arguments:  []string{"H:unknown:1"},
+	}
+	handler.handle(ctx, msg, conn.srvConn)
+	assert.Equal(t, 1, len(conn.WriteCh))
+	sentMsg = <-conn.WriteCh
+	assert.Equal(t, gearman.STATUS_RES, sentMsg.PacketType)
+	assert.Equal(t, []string{"H:unknown:1", "0", "0", "0", "0"}, sentMsg.Arguments)
 	jobsManager.AssertExpectations(t)
 }
@@ -6,29 +6,30 @@ import (
 	gearman "github.com/peonone/gearman"
 )
 
-// TODO add support for gearman.GRAB_JOB_UNIQ,
-
 var noJobMsg = &gearman.Message{
 	MagicType:  gearman.MagicRes,
 	PacketType: gearman.NO_JOB,
 }
 
 type grabJobHandler struct {
-	jobsManager jobsManager
+	jobsManager  jobsManager
+	sleepManager *sleepManager
 }
 
 func (h *grabJobHandler) supportPacketTypes() []gearman.PacketType {
 	return []gearman.PacketType{
-		gearman.GRAB_JOB, gearman.GRAB_JOB_ALL,
+		gearman.GRAB_JOB, gearman.GRAB_JOB_UNIQ, gearman.GRAB_JOB_ALL,
 	}
 }
 
 func (h *grabJobHandler) handle(ctx context.Context, m *gearman.Message, conn *conn) (bool, error) {
+	// the worker is awake until it sends PRE_SLEEP again
+	h.sleepManager.removeSleepWorker(conn.ID())
 	functions := conn.supportFunctions
 	if len(functions) == 0 {
 		return true, conn.WriteMsg(noJobMsg)
 	}
-	j, err := h.jobsManager.grabJob(ctx, functions)
+	j, err := h.jobsManager.grabJob(ctx, functions, conn)
 	if j != nil {
 		var args []string
 		var packet gearman.PacketType
@@ -36,6 +37,9 @@ func (h *grabJobHandler) handle(ctx context.Context, m *gearman.Message, conn *c
 		case gearman.GRAB_JOB:
 			packet = gearman.JOB_ASSIGN
 			args = []string{j.handle.String(), j.function, j.data}
+		case gearman.GRAB_JOB_UNIQ:
+			packet = gearman.JOB_ASSIGN_UNIQ
+			args = []string{j.handle.String(), j.function, j.uniqueID, j.data}
 		case gearman.GRAB_JOB_ALL:
 			packet = gearman.JOB_ASSIGN_ALL
 			args = []string{j.handle.String(), j.function, j.uniqueID, j.reducer, j.data}
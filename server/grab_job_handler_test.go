@@ -14,7 +14,7 @@ import (
 func TestGrabJobHandler(t *testing.T) {
 	jobsManager := new(mockJobsManager)
 
-	h := &grabJobHandler{jobsManager}
+	h := &grabJobHandler{jobsManager, newSleepManager()}
 
 	workerConn := gearman.NewMockConn(10, 10)
 	workerSrvConn := newServerConn(workerConn)
@@ -44,12 +44,12 @@ func TestGrabJobHandler(t *testing.T) {
 			MagicType:  gearman.MagicReq,
 			PacketType: packet,
 		}
-		jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions).Return(nil, nil).Once()
+		jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions, workerSrvConn).Return(nil, nil).Once()
 		msgRecyclable, err = h.handle(ctx, msg, workerSrvConn)
 		assert.Equal(t, 1, len(workerConn.WriteCh))
 		assert.Equal(t, noJobMsg, <-workerConn.WriteCh)
 
-		jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions).Return(j, nil).Once()
+		jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions, workerSrvConn).Return(j, nil).Once()
 		msgRecyclable, err = h.handle(ctx, msg, workerSrvConn)
 		assert.True(t, msgRecyclable)
 		assert.Nil(t, err)
@@ -62,6 +62,9 @@ func TestGrabJobHandler(t *testing.T) {
 			assert.Equal(t, j.handle.String(), sentMsg.Arguments[0])
 			assert.Equal(t, j.function, sentMsg.Arguments[1])
 			assert.Equal(t, j.data, sentMsg.Arguments[2])
+		case gearman.GRAB_JOB_UNIQ:
+			assert.Equal(t, gearman.JOB_ASSIGN_UNIQ, sentMsg.PacketType)
+			assert.Equal(t, []string{j.handle.String(), j.function, j.uniqueID, j.data}, sentMsg.Arguments)
 		case gearman.GRAB_JOB_ALL:
 			assert.Equal(t, gearman.JOB_ASSIGN_ALL, sentMsg.PacketType)
 			assert.Equal(t, j.handle.String(), sentMsg.Arguments[0])
@@ -72,7 +75,7 @@ func TestGrabJobHandler(t *testing.T) {
 		}
 	}
 
-	jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions).Return(nil, errors.New("internal error")).Once()
+	jobsManager.On("grabJob", ctx, workerSrvConn.supportFunctions, workerSrvConn).Return(nil, errors.New("internal error")).Once()
 	msgRecyclable, err = h.handle(ctx, msg, workerSrvConn)
 	assert.NotNil(t, err)
 }
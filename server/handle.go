@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+// HandleGenerator generates the handles of the submitted jobs
+// the handles must be unique across restarts, as the jobs are persisted by the sql queue
+// and the results of the background jobs are kept by handle
+// *gearman.IDGenerator can be used to generate UUID handles
+type HandleGenerator interface {
+	Generate() *gearman.ID
+}
+
+// maxHandleLength is the max length of the job handles of the upstream gearmand,
+// it's also the size of the handle column of the sql queues
+const maxHandleLength = 64
+
+// hostHandleGenerator is the default handle generator, it generates H:<hostname>:<counter> like the upstream gearmand
+// the counter is seeded with the current time in nanoseconds, so it doesn't go back after a restart
+// unless the server generated more than a handle per nanosecond
+// the full hostname is kept, the servers sharing a short name like web1.dc1 and web1.dc2 may start their counters
+// at the same time, so they must be told apart by the hostname, the servers with the same hostname are not supported
+type hostHandleGenerator struct {
+	prefix  string
+	counter uint64
+}
+
+func newHostHandleGenerator(hostname string) *hostHandleGenerator {
+	// a long hostname is truncated to keep the handles within maxHandleLength with a 20 digits counter,
+	// the hash of the full hostname replaces the tail, so the hostnames with the same head are told apart
+	maxHostLength := maxHandleLength - len("H::") - len(strconv.FormatUint(^uint64(0), 10))
+	if len(hostname) > maxHostLength {
+		h := fnv.New32a()
+		h.Write([]byte(hostname))
+		hostname = fmt.Sprintf("%s-%08x", hostname[:maxHostLength-9], h.Sum32())
+	}
+	return &hostHandleGenerator{
+		prefix:  "H:" + hostname + ":",
+		counter: uint64(time.Now().UnixNano()),
+	}
+}
+
+// newDefaultHandleGenerator creates the handle generator with the hostname of the server
+func newDefaultHandleGenerator() *hostHandleGenerator {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	return newHostHandleGenerator(hostname)
+}
+
+func (g *hostHandleGenerator) Generate() *gearman.ID {
+	counter := atomic.AddUint64(&g.counter, 1)
+	handle := gearman.ID(g.prefix + strconv.FormatUint(counter, 10))
+	return &handle
+}
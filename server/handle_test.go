@@ -0,0 +1,45 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostHandleGenerator(t *testing.T) {
+	g := newHostHandleGenerator("gearman1.example.com")
+	h1 := g.Generate().String()
+	h2 := g.Generate().String()
+	format := regexp.MustCompile(`^H:gearman1\.example\.com:([0-9]+)$`)
+	assert.Regexp(t, format, h1)
+	assert.Regexp(t, format, h2)
+	c1, err := strconv.ParseUint(format.FindStringSubmatch(h1)[1], 10, 64)
+	assert.Nil(t, err)
+	c2, err := strconv.ParseUint(format.FindStringSubmatch(h2)[1], 10, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, c1+1, c2)
+
+	// a restarted server doesn't reuse the handles
+	restarted := newHostHandleGenerator("gearman1.example.com")
+	h3 := restarted.Generate().String()
+	assert.Regexp(t, format, h3)
+	c3, err := strconv.ParseUint(format.FindStringSubmatch(h3)[1], 10, 64)
+	assert.Nil(t, err)
+	assert.True(t, c3 > c2)
+
+	// the servers sharing a short name don't share the handles
+	assert.Regexp(t, `^H:web1\.dc1:[0-9]+$`, newHostHandleGenerator("web1.dc1").Generate().String())
+	assert.Regexp(t, `^H:web1\.dc2:[0-9]+$`, newHostHandleGenerator("web1.dc2").Generate().String())
+
+	// the long hostnames are truncated with the hash of the full one
+	long1 := newHostHandleGenerator(strings.Repeat("h", 100) + ".dc1").Generate().String()
+	long2 := newHostHandleGenerator(strings.Repeat("h", 100) + ".dc2").Generate().String()
+	longFormat := regexp.MustCompile(`^H:(h+-[0-9a-f]{8}):[0-9]+$`)
+	assert.Regexp(t, longFormat, long1)
+	assert.Regexp(t, longFormat, long2)
+	assert.NotEqual(t, longFormat.FindStringSubmatch(long1)[1], longFormat.FindStringSubmatch(long2)[1])
+	assert.True(t, len(long1) <= maxHandleLength)
+}
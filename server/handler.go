@@ -23,6 +23,7 @@ type serverMessageHandlerManager struct {
 	mu         sync.Mutex
 	handlers   map[gearman.PacketType]serverMessageHandler
 	reqTimeout time.Duration
+	metrics    *metrics
 }
 
 // newServerHandlerManager creates an empty handler manager
@@ -59,7 +60,11 @@ func (m *serverMessageHandlerManager) handleMessage(msg *gearman.Message, conn *
 	if m.reqTimeout > 0 {
 		ctx, _ = context.WithTimeout(ctx, m.reqTimeout)
 	}
-	return handler.handle(ctx, msg, conn)
+	packetType := msg.PacketType
+	start := time.Now()
+	recyclable, err := handler.handle(ctx, msg, conn)
+	m.metrics.handled(packetType, time.Since(start))
+	return recyclable, err
 }
 
 // MockHandler is an implementation for unit test
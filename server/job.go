@@ -2,6 +2,7 @@ package server
 
 import (
 	"errors"
+	"time"
 
 	gearman "github.com/peonone/gearman"
 )
@@ -38,4 +39,14 @@ type job struct {
 	uniqueID string      //The identity from the client (for coalescing)
 	priority priority
 	reducer  string
+	// notBefore is the time the job can be dispatched after, zero means at once
+	notBefore time.Time
+}
+
+// delay returns how long the job should wait before it can be dispatched
+func (j *job) delay(now time.Time) time.Duration {
+	if j.notBefore.After(now) {
+		return j.notBefore.Sub(now)
+	}
+	return 0
 }
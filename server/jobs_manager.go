@@ -24,11 +24,40 @@ type jobStatus struct {
 	waitingCount int
 }
 
+// functionStatus holds the count of jobs of a function
+type functionStatus struct {
+	function         string
+	queued           int
+	queuedByPriority QueueLimit // the queued jobs counted by priority, checked with the max queue sizes
+	running          int
+}
+
+// addQueued changes the count of the queued jobs of the priority
+func (fs *functionStatus) addQueued(p priority, delta int) {
+	fs.queued += delta
+	fs.queuedByPriority[p] += delta
+}
+
 type jobsManager interface {
 	submitJob(ctx context.Context, j *job, clientConn *conn) (*gearman.ID, error)
-	grabJob(ctx context.Context, functions supportFunctions) (*job, error)
+	grabJob(ctx context.Context, functions supportFunctions, workerConn *conn) (*job, error)
 	getJobStatus(ctx context.Context, handle *gearman.ID, uniqueID string) *jobStatus
-	updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message) bool
+	// updateJobStatus returns false if the job is not dispatched to the worker, e.g. requeued after it timeouted
+	updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message, workerConn *conn) bool
+	// cancelJob removes a queued job or ends a dispatched one, false is returned if the job is not found
+	cancelJob(ctx context.Context, handle *gearman.ID, uniqueID string) (bool, error)
+	functionsStatus() []*functionStatus
+	setMaxQueue(function string, limit QueueLimit)
+	// keepResult keeps the result of the job in the result store like the background jobs',
+	// false is returned if the job is not found
+	keepResult(handle *gearman.ID) bool
+	// activeJobCount returns the count of the dispatched jobs not finished
+	activeJobCount() int
+	// drain stops handing out and accepting jobs, grabJob returns no job and submitJob returns errShuttingDown after that,
+	// the jobs whose dispatch ends are not requeued any more
+	drain()
+	// stop stops the dispatcher, it's called after drain when the dispatched jobs are done or abandoned
+	stop()
 }
 
 var _ jobsManager = &srvJobsManager{}
@@ -40,36 +69,52 @@ type srvJobsManager struct {
 	q                 queue
 	pendingJobs       map[gearman.ID]*pendingJob
 	pendingJobsUnique map[string]*pendingJob
+	functions         map[string]*functionStatus
+	maxQueueSizes     map[string]QueueLimit
 	logger            *log.Logger
 	cfg               *Config
-	activeRoutineCnt  *int32
+	dispatcher        *jobDispatcher
+	activeJobCnt      int32
+	draining          int32
+	metrics           *metrics
+	results           resultStore // nil if the results are not kept
+	// wakeUpWorkers is called when a job of the function is put back to the queue or a delayed job is due
+	wakeUpWorkers func(function string)
+	scheduler     *delayedScheduler // nil if not started
 }
 
 var errJobNotFound = errors.New("Job not found")
+var errQueueFull = errors.New("Queue of the function is full")
+var errShuttingDown = errors.New("Server is shutting down")
 
 func newjobsManager(logger *log.Logger, q queue, cfg *Config) *srvJobsManager {
-	var cnt int32
-	return &srvJobsManager{
+	m := &srvJobsManager{
 		q:                 q,
 		pendingJobs:       make(map[gearman.ID]*pendingJob),
 		pendingJobsUnique: make(map[string]*pendingJob),
-		activeRoutineCnt:  &cnt,
+		functions:         make(map[string]*functionStatus),
+		maxQueueSizes:     make(map[string]QueueLimit),
+		dispatcher:        newJobDispatcher(0),
 		logger:            logger,
 		cfg:               cfg,
 	}
+	for function, limit := range cfg.MaxQueue {
+		m.setMaxQueue(function, limit)
+	}
+	return m
 }
 
 func (m *srvJobsManager) submitJob(ctx context.Context, j *job, clientConn *conn) (*gearman.ID, error) {
+	if atomic.LoadInt32(&m.draining) != 0 {
+		return nil, errShuttingDown
+	}
 	m.mu.Lock()
 	pJob, hitByUniq := m.pendingJobsUnique[j.uniqueID]
+	// a cancelled job is going away, start a new one instead
+	hitByUniq = hitByUniq && !pJob.cancelled
 	dispatched := hitByUniq && pJob.dispatched
 	if dispatched && clientConn != nil {
-		newConnCtx, _ := context.WithTimeout(ctx, time.Millisecond*100)
-		registered, err := pJob.registerNewConn(newConnCtx, clientConn)
-		if err != nil {
-			return nil, err
-		}
-		if !registered {
+		if !pJob.run.call(jobEventNewConn, clientConn, nil).ok {
 			// failed to register conn to a running job
 			// then start a new one
 			hitByUniq = false
@@ -77,8 +122,18 @@ func (m *srvJobsManager) submitJob(ctx context.Context, j *job, clientConn *conn
 		}
 	}
 	if !hitByUniq {
+		fs := m.functionStatus(j.function)
+		maxQueueSize := m.maxQueueSizes[j.function][j.priority]
+		if maxQueueSize > 0 && fs.queuedByPriority[j.priority] >= maxQueueSize {
+			m.mu.Unlock()
+			m.metrics.countJob(j.function, jobRejected)
+			return nil, errQueueFull
+		}
+		fs.addQueued(j.priority, 1)
 		pJob = &pendingJob{
 			handle:      j.handle,
+			function:    j.function,
+			priority:    j.priority,
 			uniqueID:    j.uniqueID,
 			clientConns: make(map[gearman.ID]*conn),
 			logger:      m.logger,
@@ -90,36 +145,102 @@ func (m *srvJobsManager) submitJob(ctx context.Context, j *job, clientConn *conn
 	if !dispatched && clientConn != nil {
 		pJob.clientConns[*clientConn.ID()] = clientConn
 	}
+	if clientConn == nil {
+		pJob.background = true
+	}
 	m.mu.Unlock()
 	if !hitByUniq {
-		return j.handle, m.q.enqueue(ctx, j)
+		err := m.q.enqueue(ctx, j)
+		if err != nil {
+			m.removeJob(j.handle)
+			return nil, err
+		}
+		m.metrics.countJob(j.function, jobSubmitted)
+		if j.delay(time.Now()) > 0 && m.scheduler != nil {
+			m.scheduler.reset()
+		}
+		return j.handle, nil
 	}
 
 	return pJob.handle, nil
 }
 
-func (m *srvJobsManager) grabJob(ctx context.Context, functions supportFunctions) (*job, error) {
-	j, err := m.q.dequeue(ctx, functions.toSlice())
-	if err != nil {
-		return nil, err
+// functionStatus returns the status of the function, creates one if not exists
+// the caller should hold m.mu
+func (m *srvJobsManager) functionStatus(function string) *functionStatus {
+	fs, ok := m.functions[function]
+	if !ok {
+		fs = &functionStatus{function: function}
+		m.functions[function] = fs
 	}
-	if j == nil {
+	return fs
+}
+
+func (m *srvJobsManager) grabJob(ctx context.Context, functions supportFunctions, workerConn *conn) (*job, error) {
+	if atomic.LoadInt32(&m.draining) != 0 {
 		return nil, nil
 	}
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	pj, ok := m.pendingJobs[*j.handle]
-	if !ok {
-		return nil, errJobNotFound
+	for {
+		j, err := m.q.dequeue(ctx, functions.toSlice())
+		if err != nil {
+			return nil, err
+		}
+		if j == nil {
+			return nil, nil
+		}
+		m.mu.Lock()
+		pj, ok := m.pendingJobs[*j.handle]
+		if !ok {
+			pj = m.adoptJob(j)
+		}
+		if pj.cancelled {
+			// the job was cancelled while being dequeued, drop it and grab another one
+			m.mu.Unlock()
+			m.finishCancel(pj)
+			continue
+		}
+		m.dispatchJob(j, pj, functions, workerConn)
+		m.mu.Unlock()
+		return j, nil
+	}
+}
+
+// adoptJob makes the pending job of a job dequeued but not submitted to this server,
+// e.g. enqueued by another server sharing the sql queue, or persisted before a restart,
+// it's run as a background job as no client of this server is waiting for it
+// the caller should hold m.mu
+func (m *srvJobsManager) adoptJob(j *job) *pendingJob {
+	if m.cfg.Verbose {
+		m.logger.Printf("job %s is not submitted to this server, adopted", j.handle)
+	}
+	m.functionStatus(j.function).addQueued(j.priority, 1)
+	pj := &pendingJob{
+		handle:      j.handle,
+		function:    j.function,
+		priority:    j.priority,
+		uniqueID:    j.uniqueID,
+		clientConns: make(map[gearman.ID]*conn),
+		background:  true,
+		logger:      m.logger,
+		cfg:         m.cfg,
 	}
+	m.pendingJobs[*pj.handle] = pj
+	if _, ok := m.pendingJobsUnique[j.uniqueID]; !ok {
+		m.pendingJobsUnique[j.uniqueID] = pj
+	}
+	return pj
+}
+
+// dispatchJob starts running the job dispatched to the worker on a shard of the dispatcher
+// the caller should hold m.mu
+func (m *srvJobsManager) dispatchJob(j *job, pj *pendingJob, functions supportFunctions, workerConn *conn) {
 	timeout := functions.timeout(j.function)
 
+	fs := m.functionStatus(pj.function)
+	fs.addQueued(pj.priority, -1)
+	fs.running++
 	pj.dispatched = true
-	pj.newConnChan = make(chan *newConnReq)
-	pj.statusUpdateChan = make(chan *statusUpdateReq)
-	pj.statusQueryChan = make(chan chan *jobStatus)
-	pj.connectionsQueryChan = make(chan chan map[gearman.ID]*conn)
-	pj.done = make(chan struct{})
+	pj.job = j
 
 	for id, conn := range pj.clientConns {
 		select {
@@ -129,9 +250,15 @@ func (m *srvJobsManager) grabJob(ctx context.Context, functions supportFunctions
 		}
 	}
 
-	atomic.AddInt32(m.activeRoutineCnt, 1)
-	go pj.run(timeout, m)
-	return j, nil
+	atomic.AddInt32(&m.activeJobCnt, 1)
+	pj.run = &jobRun{
+		job:        pj,
+		manager:    m,
+		shard:      m.dispatcher.shard(),
+		timeout:    timeout,
+		workerConn: workerConn,
+	}
+	pj.run.post(jobEventStart, nil, nil, nil)
 }
 
 func (m *srvJobsManager) getJobStatus(ctx context.Context, handle *gearman.ID, uniqueID string) (ret *jobStatus) {
@@ -147,15 +274,11 @@ func (m *srvJobsManager) getJobStatus(ctx context.Context, handle *gearman.ID, u
 	if ok {
 		dispacthed = pJob.dispatched
 	}
-	var replyCh chan *jobStatus
+	var reply *jobEventReply
 	var waitingCount int
 	if dispacthed {
-		replyCh = make(chan *jobStatus)
-		select {
-		case <-pJob.done:
-			ok = false
-		case pJob.statusQueryChan <- replyCh:
-		}
+		reply = pJob.run.call(jobEventQuery, nil, nil)
+		ok = reply.ok
 	} else if ok {
 		for id, conn := range pJob.clientConns {
 			select {
@@ -171,58 +294,276 @@ func (m *srvJobsManager) getJobStatus(ctx context.Context, handle *gearman.ID, u
 		return &jobStatus{known: false, handle: handle}
 	}
 	if !dispacthed {
-		return &jobStatus{known: true, running: false, waitingCount: waitingCount, handle: handle}
+		return &jobStatus{known: true, running: false, waitingCount: waitingCount, handle: pJob.handle}
 	}
+	return reply.status
+}
 
-	select {
-	case result := <-replyCh:
-		return result
-	case <-ctx.Done():
-		return &jobStatus{known: false, handle: handle}
+// updateJobStatus handles the status update of the worker, the message is recycled if it succeeds
+// the update is forwarded to the listening clients, and the job is finished by WORK_COMPLETE, WORK_FAIL or WORK_EXCEPTION
+// only the worker the job is dispatched to currently can update it
+func (m *srvJobsManager) updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message,
+	workerConn *conn) bool {
+	m.mu.Lock()
+	pJob, ok := m.pendingJobs[*handle]
+	if !ok || !pJob.dispatched || pJob.run.workerConn != workerConn {
+		// the job may be requeued after its worker timeouted, and dispatched to another worker then
+		m.mu.Unlock()
+		return false
+	}
+	run := pJob.run
+	m.mu.Unlock()
+
+	reply := run.call(jobEventUpdate, nil, msg)
+	if !reply.ok {
+		return false
+	}
+	pJob.forward(msg, reply.forward)
+	gearman.MsgPool.Put(msg)
+	if reply.end != nil {
+		m.endRun(pJob, reply.end)
 	}
+	return true
 }
 
-func (m *srvJobsManager) updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message) (succeed bool) {
+func (m *srvJobsManager) cancelJob(ctx context.Context, handle *gearman.ID, uniqueID string) (bool, error) {
+	m.mu.Lock()
+	var pJob *pendingJob
+	var ok bool
+	if handle != nil {
+		pJob, ok = m.pendingJobs[*handle]
+	} else {
+		pJob, ok = m.pendingJobsUnique[uniqueID]
+	}
+	if !ok || pJob.cancelled {
+		m.mu.Unlock()
+		return false, nil
+	}
+	pJob.cancelled = true
+	if pJob.dispatched {
+		// the shard ends the job with WORK_FAIL
+		pJob.run.post(jobEventCancel, nil, nil, nil)
+		m.mu.Unlock()
+		return true, nil
+	}
+	m.mu.Unlock()
+
+	removed, err := m.q.remove(ctx, pJob.handle)
+	if err != nil {
+		// the job is dropped once it's dequeued
+		return false, err
+	}
+	if removed {
+		m.finishCancel(pJob)
+	}
+	// otherwise it's being dequeued, grabJob or enqueueAgain drops it
+	return true, nil
+}
+
+// finishCancel removes the cancelled job which is not in the queue, and tells the listening clients
+func (m *srvJobsManager) finishCancel(pJob *pendingJob) {
+	if m.cfg.Verbose {
+		m.logger.Printf("job %s cancelled", pJob)
+	}
+	m.metrics.countJob(pJob.function, jobCancelled)
+	m.removeJob(pJob.handle)
+	// no one else can reach the job after it's removed
+	pJob.sendWorkFail()
+}
+
+// endRun removes or requeues the job once its dispatch ends
+func (m *srvJobsManager) endRun(pJob *pendingJob, end *jobEnd) {
+	defer atomic.AddInt32(&m.activeJobCnt, -1)
+	if end.requeue {
+		m.requeueJob(pJob)
+		return
+	}
+	if end.reduce {
+		m.submitReduceJob(pJob)
+		return
+	}
+	if m.cfg.Verbose {
+		m.logger.Printf("job %s done", pJob)
+	}
+	if end.notify != 0 {
+		pJob.notify(end.notify)
+	}
+	m.metrics.countJob(pJob.function, end.result)
+	if end.resultStatus != "" {
+		m.storeResult(pJob, end.resultStatus, end.resultData)
+	}
+	m.removeJob(pJob.handle)
+}
+
+// requeueJob puts a dispatched job back to the queue
+// it's called when the worker disconnected or the job timeouted
+func (m *srvJobsManager) requeueJob(pJob *pendingJob) {
+	if m.cfg.Verbose {
+		m.logger.Printf("job %s requeued, retries: %d", pJob, pJob.retries+1)
+	}
+	m.enqueueAgain(pJob, pJob.job, pJob.retries+1)
+}
+
+// submitReduceJob queues the job again to the reducer function once the mapper completes
+// the clients listening the job get the result of the reducer
+func (m *srvJobsManager) submitReduceJob(pJob *pendingJob) {
+	j := pJob.reduceJob()
+	if m.cfg.Verbose {
+		m.logger.Printf("job %s mapped, reducing by %s", pJob, j.function)
+	}
+	m.enqueueAgain(pJob, j, 0)
+}
+
+// enqueueAgain puts the dispatched job back to the queue as an un-dispatched one
+func (m *srvJobsManager) enqueueAgain(pJob *pendingJob, j *job, retries int) {
+	m.mu.Lock()
+	m.functionStatus(pJob.function).running--
+	m.functionStatus(j.function).addQueued(j.priority, 1)
+	if fs := m.functions[pJob.function]; fs.queued == 0 && fs.running == 0 {
+		delete(m.functions, pJob.function)
+	}
+	pJob.dispatched = false
+	pJob.run = nil
+	pJob.retries = retries
+	pJob.function = j.function
+	pJob.priority = j.priority
+	pJob.job = j
+	pJob.mapResults = nil
+	cancelled := pJob.cancelled
+	m.mu.Unlock()
+	if cancelled {
+		// cancelled after its dispatch ended
+		m.finishCancel(pJob)
+		return
+	}
+	if atomic.LoadInt32(&m.draining) != 0 {
+		// the queue is going to be disposed, the job fails instead
+		m.logger.Printf("job %s failed, not queued again as the server is shutting down", pJob)
+		m.metrics.countJob(pJob.function, jobFailed)
+		m.removeJob(pJob.handle)
+		pJob.sendWorkFail()
+		return
+	}
+
+	err := m.q.enqueue(context.Background(), j)
+	if err != nil {
+		m.logger.Printf("failed to queue job %s again: %s", pJob, err)
+		// no one else can reach the job after it's removed
+		m.removeJob(pJob.handle)
+		pJob.sendWorkFail()
+		return
+	}
+	if m.wakeUpWorkers != nil {
+		m.wakeUpWorkers(j.function)
+	}
+}
+
+func (m *srvJobsManager) removeJob(handle *gearman.ID) bool {
 	m.mu.Lock()
-	pJob, ok := m.pendingJobs[*handle]
 	defer m.mu.Unlock()
+	pJob, ok := m.pendingJobs[*handle]
 	if !ok {
 		return false
 	}
+	delete(m.pendingJobs, *handle)
+	if m.pendingJobsUnique[pJob.uniqueID] == pJob {
+		// a new job with the same unique ID may be submitted while this one finishing
+		delete(m.pendingJobsUnique, pJob.uniqueID)
+	}
+	fs := m.functionStatus(pJob.function)
+	if pJob.dispatched {
+		fs.running--
+	} else {
+		fs.addQueued(pJob.priority, -1)
+	}
+	if fs.queued == 0 && fs.running == 0 {
+		delete(m.functions, pJob.function)
+	}
+	return true
+}
+
+// functionsStatus returns a snapshot of the jobs count of all functions having jobs
+func (m *srvJobsManager) functionsStatus() []*functionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]*functionStatus, 0, len(m.functions))
+	for _, fs := range m.functions {
+		fsCopy := *fs
+		ret = append(ret, &fsCopy)
+	}
+	return ret
+}
 
-	req := &statusUpdateReq{
-		handle: handle,
-		msg:    msg,
+// setMaxQueue sets the max queued jobs of the function by priority, the limit is removed if all of them are 0
+func (m *srvJobsManager) setMaxQueue(function string, limit QueueLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit != (QueueLimit{}) {
+		m.maxQueueSizes[function] = limit
+	} else {
+		delete(m.maxQueueSizes, function)
+	}
+}
+
+// storeResult keeps the result of a background job if the result store is enabled
+func (m *srvJobsManager) storeResult(pJob *pendingJob, status string, data string) {
+	if m.results == nil {
+		return
+	}
+	m.mu.Lock()
+	background := pJob.background
+	m.mu.Unlock()
+	if !background {
+		return
+	}
+	r := &jobResult{
+		handle:   pJob.handle.String(),
+		uniqueID: pJob.uniqueID,
+		status:   status,
+		data:     data,
+		expireAt: time.Now().Add(m.cfg.resultTTL()),
 	}
-	select {
-	case pJob.statusUpdateChan <- req:
-		succeed = true
-	case <-pJob.done:
-		succeed = false
-	case <-ctx.Done():
-		succeed = false
+	ctx := context.Background()
+	if m.cfg.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.RequestTimeout)
+		defer cancel()
+	}
+	if err := m.results.put(ctx, r); err != nil {
+		m.logger.Printf("failed to store the result of job %s: %s", pJob, err)
 	}
-	return
 }
 
-func (m *srvJobsManager) removeJob(handle *gearman.ID) bool {
+func (m *srvJobsManager) keepResult(handle *gearman.ID) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	pJob, ok := m.pendingJobs[*handle]
 	if !ok {
 		return false
 	}
-	delete(m.pendingJobs, *handle)
-	delete(m.pendingJobsUnique, pJob.uniqueID)
+	pJob.background = true
 	return true
 }
 
-func (m *srvJobsManager) jobRoutineDone() {
-	atomic.AddInt32(m.activeRoutineCnt, -1)
+func (m *srvJobsManager) activeJobCount() int {
+	return int(atomic.LoadInt32(&m.activeJobCnt))
+}
+
+// startScheduler starts waking up the workers when the delayed jobs are due, wakeUpWorkers should be set before
+func (m *srvJobsManager) startScheduler() {
+	m.scheduler = newDelayedScheduler(m.q, m.logger, m.wakeUpWorkers)
+	go m.scheduler.run()
 }
 
-func (m *srvJobsManager) activeRoutineCount() int {
-	return int(atomic.LoadInt32(m.activeRoutineCnt))
+func (m *srvJobsManager) drain() {
+	atomic.StoreInt32(&m.draining, 1)
+	if m.scheduler != nil {
+		m.scheduler.stop()
+	}
+}
+
+func (m *srvJobsManager) stop() {
+	m.dispatcher.stop()
 }
 
 type mockJobsManager struct {
@@ -240,8 +581,8 @@ func (m *mockJobsManager) submitJob(ctx context.Context, j *job, clientConn *con
 	return handle, returnVals.Error(1)
 }
 
-func (m *mockJobsManager) grabJob(ctx context.Context, functions supportFunctions) (*job, error) {
-	returnVals := m.Called(ctx, functions)
+func (m *mockJobsManager) grabJob(ctx context.Context, functions supportFunctions, workerConn *conn) (*job, error) {
+	returnVals := m.Called(ctx, functions, workerConn)
 	var j *job
 	if returnVals.Get(0) != nil {
 		j = returnVals.Get(0).(*job)
@@ -254,7 +595,37 @@ func (m *mockJobsManager) getJobStatus(ctx context.Context, handle *gearman.ID,
 	return returnVals.Get(0).(*jobStatus)
 }
 
-func (m *mockJobsManager) updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message) (succeed bool) {
-	returnVals := m.Called(ctx, handle, msg)
+func (m *mockJobsManager) updateJobStatus(ctx context.Context, handle *gearman.ID, msg *gearman.Message,
+	workerConn *conn) (succeed bool) {
+	returnVals := m.Called(ctx, handle, msg, workerConn)
 	return returnVals.Bool(0)
 }
+
+func (m *mockJobsManager) cancelJob(ctx context.Context, handle *gearman.ID, uniqueID string) (bool, error) {
+	returnVals := m.Called(ctx, handle, uniqueID)
+	return returnVals.Bool(0), returnVals.Error(1)
+}
+
+func (m *mockJobsManager) functionsStatus() []*functionStatus {
+	return m.Called().Get(0).([]*functionStatus)
+}
+
+func (m *mockJobsManager) setMaxQueue(function string, limit QueueLimit) {
+	m.Called(function, limit)
+}
+
+func (m *mockJobsManager) keepResult(handle *gearman.ID) bool {
+	return m.Called(handle).Bool(0)
+}
+
+func (m *mockJobsManager) activeJobCount() int {
+	return m.Called().Int(0)
+}
+
+func (m *mockJobsManager) drain() {
+	m.Called()
+}
+
+func (m *mockJobsManager) stop() {
+	m.Called()
+}
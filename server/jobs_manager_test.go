@@ -12,22 +12,24 @@ import (
 	"github.com/stretchr/testify/mock"
 )
 
+// makeJobsManagerForTest creates a jobs manager with a mock queue, the jobs are not requeued unless JobRetries is set
 func makeJobsManagerForTest() (*srvJobsManager, *mockQueue) {
 	q := &mockQueue{}
-	return newjobsManager(testLogger, q, new(Config)), q
+	return newjobsManager(testLogger, q, &Config{JobRetries: -1}), q
 }
 
 func addPendingJob(manager *srvJobsManager, pJob *pendingJob) {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 	if pJob.cfg == nil {
-		pJob.cfg = new(Config)
+		pJob.cfg = manager.cfg
 	}
 	if pJob.logger == nil {
 		pJob.logger = testLogger
 	}
 	manager.pendingJobs[*pJob.handle] = pJob
 	manager.pendingJobsUnique[pJob.uniqueID] = pJob
+	manager.functionStatus(pJob.function).addQueued(pJob.priority, 1)
 }
 
 func loadPendingJob(manager *srvJobsManager, handle *gearman.ID) *pendingJob {
@@ -36,14 +38,20 @@ func loadPendingJob(manager *srvJobsManager, handle *gearman.ID) *pendingJob {
 	return manager.pendingJobs[*handle]
 }
 
+// getPJobConns returns a copy of the listening clients of a dispatched job
+// the events posted before are handled by the shard once the query is replied
 func getPJobConns(pJob *pendingJob) map[gearman.ID]*conn {
-	ch := make(chan map[gearman.ID]*conn)
-	pJob.connectionsQueryChan <- ch
-	return <-ch
+	pJob.run.call(jobEventQuery, nil, nil)
+	conns := make(map[gearman.ID]*conn)
+	for k, v := range pJob.clientConns {
+		conns[k] = v
+	}
+	return conns
 }
 
 func TestSubmitJob(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	j := &job{
@@ -71,6 +79,7 @@ func TestSubmitJob(t *testing.T) {
 
 func TestSubmitJobCoalescingNotdispatched(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	client2 := newMockSConn(10, 10)
@@ -137,6 +146,7 @@ func TestSubmitJobCoalescingNotdispatched(t *testing.T) {
 
 func TestSubmitJobCoalescingdispatched(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	client2 := newMockSConn(10, 10)
@@ -166,7 +176,7 @@ func TestSubmitJobCoalescingdispatched(t *testing.T) {
 	functions := make(map[string]time.Duration)
 	functions["echo"] = time.Second * 5
 	q.On("dequeue", mock.Anything, mock.Anything).Return(j1, nil).Once()
-	grabedJob, err := manager.grabJob(ctx, functions)
+	grabedJob, err := manager.grabJob(ctx, functions, nil)
 	assert.Equal(t, j1, grabedJob)
 	assert.Nil(t, err)
 
@@ -179,6 +189,7 @@ func TestSubmitJobCoalescingdispatched(t *testing.T) {
 
 func TestGrabJob(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	client2 := newMockSConn(10, 10)
@@ -203,7 +214,7 @@ func TestGrabJob(t *testing.T) {
 	functions["wc"] = 0
 
 	q.On("dequeue", mock.Anything).Return(nil, nil).Once()
-	grabedJob, err := manager.grabJob(ctx, supportFunctions(functions))
+	grabedJob, err := manager.grabJob(ctx, supportFunctions(functions), nil)
 	assert.Nil(t, err)
 	assert.Nil(t, grabedJob)
 
@@ -214,7 +225,7 @@ func TestGrabJob(t *testing.T) {
 	q.On("dequeue", mock.Anything).Return(j, nil).Once()
 
 	client2.Close()
-	grabedJob, err = manager.grabJob(ctx, supportFunctions(functions))
+	grabedJob, err = manager.grabJob(ctx, supportFunctions(functions), nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, grabedJob)
 
@@ -223,12 +234,13 @@ func TestGrabJob(t *testing.T) {
 	clientConns := getPJobConns(pJob)
 	assert.Equal(t, 1, len(clientConns))
 	assert.Contains(t, clientConns, *client1.ID())
-	assert.Equal(t, 1, manager.activeRoutineCount())
+	assert.Equal(t, 1, manager.activeJobCount())
 	q.AssertExpectations(t)
 }
 
 func TestJobClientClosed(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	client2 := newMockSConn(10, 10)
@@ -256,12 +268,12 @@ func TestJobClientClosed(t *testing.T) {
 
 	q.On("dequeue", mock.Anything).Return(j, nil).Once()
 	client1.Close()
-	grabedJob, err := manager.grabJob(ctx, supportFunctions(functions))
+	grabedJob, err := manager.grabJob(ctx, supportFunctions(functions), nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, grabedJob)
 
 	loadedPJob := loadPendingJob(manager, j.handle)
-	assert.Equal(t, 1, manager.activeRoutineCount())
+	assert.Equal(t, 1, manager.activeJobCount())
 
 	clientConns := getPJobConns(loadedPJob)
 	assert.Equal(t, 2, len(clientConns))
@@ -276,6 +288,7 @@ func TestJobClientClosed(t *testing.T) {
 
 func TestJobTimeout(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	client1 := newMockSConn(10, 10)
 	job1 := &job{
@@ -311,23 +324,23 @@ func TestJobTimeout(t *testing.T) {
 	functions["wc"] = 0
 
 	q.On("dequeue", mock.Anything).Return(job1, nil).Once()
-	grabedJob, err := manager.grabJob(ctx, functions)
+	grabedJob, err := manager.grabJob(ctx, functions, nil)
 	assert.Nil(t, err)
 	assert.Equal(t, job1, grabedJob)
 
 	q.On("dequeue", mock.Anything).Return(job2, nil).Once()
-	grabedJob, err = manager.grabJob(ctx, functions)
+	grabedJob, err = manager.grabJob(ctx, functions, nil)
 	assert.Nil(t, err)
 	assert.Equal(t, job2, grabedJob)
 
-	assert.Equal(t, 2, manager.activeRoutineCount())
+	assert.Equal(t, 2, manager.activeJobCount())
 
 	assert.NotNil(t, loadPendingJob(manager, job1.handle))
 	assert.NotNil(t, loadPendingJob(manager, job2.handle))
-	assert.Equal(t, 2, manager.activeRoutineCount())
+	assert.Equal(t, 2, manager.activeJobCount())
 
 	time.Sleep(functions["echo"] + time.Millisecond*10)
-	assert.Equal(t, 1, manager.activeRoutineCount())
+	assert.Equal(t, 1, manager.activeJobCount())
 	manager.mu.Lock()
 	assert.Equal(t, 1, len(manager.pendingJobs))
 	assert.Equal(t, 1, len(manager.pendingJobsUnique))
@@ -342,8 +355,142 @@ func TestJobTimeout(t *testing.T) {
 	q.AssertExpectations(t)
 }
 
+func TestJobRequeueWorkerClosed(t *testing.T) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	manager.cfg.JobRetries = 1
+	var wokenUp []string
+	manager.wakeUpWorkers = func(function string) {
+		wokenUp = append(wokenUp, function)
+	}
+	ctx := context.Background()
+	client := newMockSConn(10, 10)
+	j := &job{
+		function: "echo",
+		handle:   testIdGen.Generate(),
+		uniqueID: "echo1",
+	}
+	q.On("enqueue", ctx, j).Return(nil).Once()
+	_, err := manager.submitJob(ctx, j, client.srvConn)
+	assert.Nil(t, err)
+
+	functions := supportFunctions(map[string]time.Duration{"echo": 0})
+	worker1 := newMockSConn(10, 10)
+	q.On("dequeue", mock.Anything).Return(j, nil).Once()
+	grabedJob, err := manager.grabJob(ctx, functions, worker1.srvConn)
+	assert.Nil(t, err)
+	assert.Equal(t, j, grabedJob)
+
+	// the job goes back to the queue once the worker disconnects
+	q.On("enqueue", mock.Anything, j).Return(nil).Once()
+	worker1.Close()
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 0, manager.activeJobCount())
+	assert.Equal(t, []string{"echo"}, wokenUp)
+	status := manager.getJobStatus(ctx, j.handle, "")
+	assert.True(t, status.known)
+	assert.False(t, status.running)
+	assert.Equal(t, 1, status.waitingCount)
+	assert.Equal(t, 0, len(client.WriteCh))
+
+	// the retry limit is reached, the job fails
+	worker2 := newMockSConn(10, 10)
+	q.On("dequeue", mock.Anything).Return(j, nil).Once()
+	grabedJob, err = manager.grabJob(ctx, functions, worker2.srvConn)
+	assert.Nil(t, err)
+	assert.Equal(t, j, grabedJob)
+	worker2.Close()
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 0, manager.activeJobCount())
+	assert.Nil(t, loadPendingJob(manager, j.handle))
+	assert.Equal(t, 1, len(client.WriteCh))
+	msg := <-client.WriteCh
+	assert.Equal(t, gearman.WORK_FAIL, msg.PacketType)
+	assert.Equal(t, []string{j.handle.String()}, msg.Arguments)
+	assert.Empty(t, manager.functionsStatus())
+	q.AssertExpectations(t)
+}
+
+func TestJobRequeueTimeout(t *testing.T) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	manager.cfg.JobRetries = 1
+	ctx := context.Background()
+	client := newMockSConn(10, 10)
+	j := &job{
+		function: "echo",
+		handle:   testIdGen.Generate(),
+		uniqueID: "echo1",
+	}
+	q.On("enqueue", ctx, j).Return(nil).Once()
+	_, err := manager.submitJob(ctx, j, client.srvConn)
+	assert.Nil(t, err)
+
+	functions := supportFunctions(map[string]time.Duration{"echo": time.Millisecond * 50})
+	worker := newMockSConn(10, 10)
+	q.On("dequeue", mock.Anything).Return(j, nil).Once()
+	_, err = manager.grabJob(ctx, functions, worker.srvConn)
+	assert.Nil(t, err)
+
+	q.On("enqueue", mock.Anything, j).Return(nil).Once()
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, manager.activeJobCount())
+	assert.NotNil(t, loadPendingJob(manager, j.handle))
+	assert.Equal(t, 0, len(client.WriteCh))
+
+	// the late result of the timeouted worker is ignored while the job is queued
+	msg := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{j.handle.String(), "result"},
+	}
+	assert.False(t, manager.updateJobStatus(ctx, j.handle, msg, worker.srvConn))
+
+	worker2 := newMockSConn(10, 10)
+	q.On("dequeue", mock.Anything).Return(j, nil).Once()
+	_, err = manager.grabJob(ctx, functions, worker2.srvConn)
+	assert.Nil(t, err)
+	// nor after the job is dispatched to another worker
+	assert.False(t, manager.updateJobStatus(ctx, j.handle, msg, worker.srvConn))
+	time.Sleep(time.Millisecond * 100)
+	assert.Nil(t, loadPendingJob(manager, j.handle))
+	assert.Equal(t, 1, len(client.WriteCh))
+	msg = <-client.WriteCh
+	assert.Equal(t, gearman.WORK_EXCEPTION, msg.PacketType)
+	assert.Equal(t, []string{j.handle.String(), jobTimeoutErrMsg}, msg.Arguments)
+	q.AssertExpectations(t)
+}
+
+func TestSubmitDelayedJob(t *testing.T) {
+	manager := newjobsManager(testLogger, newMemoryQueue(newTestPolicy(DispatchPriority, nil)), new(Config))
+	defer manager.stop()
+	woken := make(chan string, 1)
+	manager.wakeUpWorkers = func(function string) {
+		woken <- function
+	}
+	manager.startScheduler()
+	defer manager.drain()
+	ctx := context.Background()
+	j := &job{
+		function:  "echo",
+		handle:    testIdGen.Generate(),
+		uniqueID:  "echo1",
+		notBefore: time.Now().Add(time.Millisecond * 50),
+	}
+	_, err := manager.submitJob(ctx, j, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(woken))
+	select {
+	case function := <-woken:
+		assert.Equal(t, "echo", function)
+	case <-time.After(time.Second):
+		t.Error("workers are not woken up when the delayed job is due")
+	}
+}
+
 func TestJobStatus(t *testing.T) {
 	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
 	ctx := context.Background()
 	handle := testIdGen.Generate()
 	js := manager.getJobStatus(ctx, handle, "")
@@ -389,7 +536,7 @@ func TestJobStatus(t *testing.T) {
 	functions["echo"] = 0
 
 	q.On("dequeue", mock.Anything).Return(j, nil).Once()
-	manager.grabJob(ctx, supportFunctions(functions))
+	manager.grabJob(ctx, supportFunctions(functions), nil)
 
 	js = manager.getJobStatus(ctx, nil, j.uniqueID)
 	assert.True(t, js.known)
@@ -404,7 +551,7 @@ func TestJobStatus(t *testing.T) {
 		Arguments:  []string{j.handle.String(), "10", "100"},
 	}
 	msgCopy := *msg
-	assert.True(t, manager.updateJobStatus(ctx, j.handle, msg))
+	assert.True(t, manager.updateJobStatus(ctx, j.handle, msg, nil))
 	time.Sleep(time.Millisecond * 50)
 	js = manager.getJobStatus(ctx, j.handle, "")
 	assert.Equal(t, pJob.handle, js.handle)
@@ -423,7 +570,7 @@ func TestJobStatus(t *testing.T) {
 			Arguments:  []string{j.handle.String(), "12345"},
 		}
 		msgCopy := *msg
-		assert.True(t, manager.updateJobStatus(ctx, j.handle, msg))
+		assert.True(t, manager.updateJobStatus(ctx, j.handle, msg, nil))
 		js = manager.getJobStatus(ctx, nil, j.uniqueID)
 		time.Sleep(time.Millisecond * 5)
 		assert.Equal(t, pJob.handle, js.handle)
@@ -451,6 +598,7 @@ func TestJobDone(t *testing.T) {
 	ctx := context.Background()
 	for i, packet := range []gearman.PacketType{gearman.WORK_COMPLETE, gearman.WORK_FAIL, gearman.WORK_EXCEPTION} {
 		manager, q := makeJobsManagerForTest()
+		defer manager.stop()
 		client1 := newMockSConn(10, 10)
 		client1.srvConn.setForwardException(true)
 		client2 := newMockSConn(10, 10)
@@ -473,7 +621,7 @@ func TestJobDone(t *testing.T) {
 		functions["echo"] = 0
 
 		q.On("dequeue", mock.Anything).Return(j, nil).Once()
-		manager.grabJob(ctx, supportFunctions(functions))
+		manager.grabJob(ctx, supportFunctions(functions), nil)
 		var args []string
 		switch packet {
 		case gearman.WORK_COMPLETE:
@@ -488,7 +636,7 @@ func TestJobDone(t *testing.T) {
 			PacketType: packet,
 			Arguments:  args,
 		}
-		assert.True(t, manager.updateJobStatus(ctx, j.handle, msg))
+		assert.True(t, manager.updateJobStatus(ctx, j.handle, msg, nil))
 		js := manager.getJobStatus(ctx, nil, j.uniqueID)
 		assert.False(t, js.known)
 
@@ -511,3 +659,192 @@ func TestJobDone(t *testing.T) {
 		}
 	}
 }
+
+func TestReduceJob(t *testing.T) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	ctx := context.Background()
+	client := newMockSConn(10, 10)
+	j := &job{
+		function: "split",
+		handle:   testIdGen.Generate(),
+		uniqueID: "split1",
+		priority: priorityHigh,
+		reducer:  "count",
+		data:     "a b c",
+	}
+	q.On("enqueue", ctx, j).Return(nil).Once()
+	_, err := manager.submitJob(ctx, j, client.srvConn)
+	assert.Nil(t, err)
+
+	functions := supportFunctions(map[string]time.Duration{"split": 0, "count": 0})
+	q.On("dequeue", mock.Anything).Return(j, nil).Once()
+	_, err = manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+
+	update := func(packet gearman.PacketType, args ...string) {
+		assert.True(t, manager.updateJobStatus(ctx, j.handle, &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: packet,
+			Arguments:  append([]string{j.handle.String()}, args...),
+		}, nil))
+	}
+	// the sub-results are not sent to the client
+	update(gearman.WORK_DATA, "a")
+	update(gearman.WORK_DATA, "b")
+
+	reduceJobs := make(chan *job, 1)
+	q.On("enqueue", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		reduceJobs <- args.Get(1).(*job)
+	}).Return(nil).Once()
+	// the run is ended and the reducer job is queued before updateJobStatus returns
+	update(gearman.WORK_COMPLETE, "c")
+	reduceJob := <-reduceJobs
+	assert.Equal(t, 0, len(client.WriteCh))
+	assert.Equal(t, "count", reduceJob.function)
+	assert.Equal(t, j.handle, reduceJob.handle)
+	assert.Equal(t, j.priority, reduceJob.priority)
+	assert.Equal(t, "", reduceJob.reducer)
+	results, err := gearman.DecodeReduceInput([]byte(reduceJob.data))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, results)
+	status := manager.getJobStatus(ctx, j.handle, "")
+	assert.True(t, status.known)
+	assert.False(t, status.running)
+	assert.Equal(t, []*functionStatus{{function: "count", queued: 1, queuedByPriority: QueueLimit{1, 0, 0}}}, manager.functionsStatus())
+
+	q.On("dequeue", mock.Anything).Return(reduceJob, nil).Once()
+	_, err = manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+	update(gearman.WORK_DATA, "partial")
+	update(gearman.WORK_COMPLETE, "3")
+	assert.Equal(t, 2, len(client.WriteCh))
+	msg := <-client.WriteCh
+	assert.Equal(t, gearman.WORK_DATA, msg.PacketType)
+	assert.Equal(t, []string{j.handle.String(), "partial"}, msg.Arguments)
+	msg = <-client.WriteCh
+	assert.Equal(t, gearman.WORK_COMPLETE, msg.PacketType)
+	assert.Equal(t, []string{j.handle.String(), "3"}, msg.Arguments)
+	assert.Nil(t, loadPendingJob(manager, j.handle))
+	assert.Empty(t, manager.functionsStatus())
+	q.AssertExpectations(t)
+}
+
+func TestCancelJob(t *testing.T) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	ctx := context.Background()
+	client := newMockSConn(10, 10)
+	failMsg := func(j *job) *gearman.Message {
+		return &gearman.Message{
+			MagicType:  gearman.MagicRes,
+			PacketType: gearman.WORK_FAIL,
+			Arguments:  []string{j.handle.String()},
+		}
+	}
+
+	// queued job
+	q.On("enqueue", ctx, mock.Anything).Return(nil)
+	queued := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "echo1"}
+	_, err := manager.submitJob(ctx, queued, client.srvConn)
+	assert.Nil(t, err)
+	q.On("remove", queued.handle).Return(true, nil).Once()
+	cancelled, err := manager.cancelJob(ctx, queued.handle, "")
+	assert.Nil(t, err)
+	assert.True(t, cancelled)
+	assert.Equal(t, failMsg(queued), <-client.WriteCh)
+	assert.Nil(t, loadPendingJob(manager, queued.handle))
+	assert.Empty(t, manager.functionsStatus())
+
+	cancelled, err = manager.cancelJob(ctx, queued.handle, "")
+	assert.Nil(t, err)
+	assert.False(t, cancelled)
+
+	// dispatched job, the worker gets job_not_found on its next WORK_STATUS
+	dispatched := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "echo2"}
+	_, err = manager.submitJob(ctx, dispatched, client.srvConn)
+	assert.Nil(t, err)
+	q.On("dequeue", mock.Anything).Return(dispatched, nil).Once()
+	functions := supportFunctions(map[string]time.Duration{"echo": time.Second * 5})
+	_, err = manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+	cancelled, err = manager.cancelJob(ctx, nil, "echo2")
+	assert.Nil(t, err)
+	assert.True(t, cancelled)
+	select {
+	case msg := <-client.WriteCh:
+		assert.Equal(t, failMsg(dispatched), msg)
+	case <-time.After(time.Second):
+		t.Error("WORK_FAIL is not sent")
+	}
+	for manager.activeJobCount() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, loadPendingJob(manager, dispatched.handle))
+	msg := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_STATUS,
+		Arguments:  []string{dispatched.handle.String(), "1", "2"},
+	}
+	assert.False(t, manager.updateJobStatus(ctx, dispatched.handle, msg, nil))
+
+	// cancelled while being dequeued, grabJob drops it and grabs the next one
+	dequeuing := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "echo3"}
+	_, err = manager.submitJob(ctx, dequeuing, client.srvConn)
+	assert.Nil(t, err)
+	q.On("remove", dequeuing.handle).Return(false, nil).Once()
+	cancelled, err = manager.cancelJob(ctx, dequeuing.handle, "")
+	assert.Nil(t, err)
+	assert.True(t, cancelled)
+	assert.Equal(t, 0, len(client.WriteCh))
+	// a new job with the same unique ID isn't coalesced with the cancelled one
+	next := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "echo3"}
+	handle, err := manager.submitJob(ctx, next, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, next.handle, handle)
+	q.On("dequeue", mock.Anything).Return(dequeuing, nil).Once()
+	q.On("dequeue", mock.Anything).Return(next, nil).Once()
+	grabbed, err := manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, next, grabbed)
+	assert.Equal(t, failMsg(dequeuing), <-client.WriteCh)
+	assert.Nil(t, loadPendingJob(manager, dequeuing.handle))
+	q.AssertExpectations(t)
+}
+
+func TestMaxQueue(t *testing.T) {
+	q := &mockQueue{}
+	cfg := &Config{MaxQueue: map[string]QueueLimit{"echo": {1, 0, 0}}}
+	manager := newjobsManager(testLogger, q, cfg)
+	defer manager.stop()
+	manager.metrics = newMetrics()
+	ctx := context.Background()
+	q.On("enqueue", ctx, mock.Anything).Return(nil)
+
+	high1 := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "high1", priority: priorityHigh}
+	_, err := manager.submitJob(ctx, high1, nil)
+	assert.Nil(t, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "high2", priority: priorityHigh}, nil)
+	assert.Equal(t, errQueueFull, err)
+	// the other priorities are not limited
+	for _, uniqueID := range []string{"low1", "low2", "low3"} {
+		_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: uniqueID, priority: priorityLow}, nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint64(1), manager.metrics.jobs[jobCounterKey{"echo", jobRejected}])
+
+	// the dispatched job doesn't count
+	q.On("dequeue", mock.Anything).Return(high1, nil).Once()
+	functions := supportFunctions(map[string]time.Duration{"echo": 0})
+	_, err = manager.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+	_, err = manager.submitJob(ctx, &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "high3", priority: priorityHigh}, nil)
+	assert.Nil(t, err)
+	fs := manager.functionsStatus()
+	assert.Equal(t, 1, len(fs))
+	assert.Equal(t, 4, fs[0].queued)
+	assert.Equal(t, QueueLimit{1, 0, 3}, fs[0].queuedByPriority)
+
+	manager.setMaxQueue("echo", QueueLimit{})
+	assert.NotContains(t, manager.maxQueueSizes, "echo")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var errUnknownListenerScheme = errors.New("Unknown listener scheme, tcp:// or unix:// expected")
+
+const errCodeAdminOnly = "admin_only"
+
+var errAdminOnly = errors.New("Only the administrative protocol is accepted on this listener")
+
+// listener accepts the connections of a ListenerConfig
+type listener struct {
+	net.Listener
+	cfg    ListenerConfig
+	tlsCfg *tls.Config
+}
+
+// parseListenAddr splits the listener address into the network and the address for net.Listen
+func parseListenAddr(addr string) (network string, address string, err error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "tcp", addr, nil
+	}
+	network, address = addr[:i], addr[i+len("://"):]
+	switch network {
+	case "tcp", "unix":
+		return network, address, nil
+	}
+	return "", "", errUnknownListenerScheme
+}
+
+// ParseListenerConfig parses a listener given as ADDR[?tls-cert=FILE&tls-key=FILE&tls-client-ca=FILE] or ADDR?tls=off,
+// the TLS settings of the query replace the ones of base, e.g. the ones of the command line,
+// and tls=off makes the listener accept plaintext connections, e.g. a unix socket next to a TLS TCP listener
+func ParseListenerConfig(value string, base ListenerConfig) (ListenerConfig, error) {
+	cfg := base
+	cfg.Addr = value
+	i := strings.Index(value, "?")
+	if i < 0 {
+		return cfg, nil
+	}
+	cfg.Addr = value[:i]
+	query, err := url.ParseQuery(value[i+1:])
+	if err != nil {
+		return cfg, fmt.Errorf("Invalid listener options %q: %s", value[i+1:], err)
+	}
+	if _, ok := query["tls"]; ok {
+		if query.Get("tls") != "off" || len(query) > 1 {
+			return cfg, fmt.Errorf("Invalid listener options %q, tls=off can't be used with the other options", value[i+1:])
+		}
+		cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile = "", "", ""
+		return cfg, nil
+	}
+	cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile = "", "", ""
+	for key := range query {
+		switch key {
+		case "tls-cert":
+			cfg.TLSCertFile = query.Get(key)
+		case "tls-key":
+			cfg.TLSKeyFile = query.Get(key)
+		case "tls-client-ca":
+			cfg.TLSClientCAFile = query.Get(key)
+		default:
+			return cfg, fmt.Errorf("Unknown listener option %q, tls-cert, tls-key, tls-client-ca or tls expected", key)
+		}
+	}
+	return cfg, nil
+}
+
+// listen starts listening on the address of cfg
+func listen(cfg ListenerConfig) (*listener, error) {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	network, address, err := parseListenAddr(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{l, cfg, tlsCfg}, nil
+}
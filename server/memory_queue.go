@@ -0,0 +1,234 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+// QueueMemory is the name of the in-memory queue
+const QueueMemory = "memory"
+
+// memoryQueue is a queue implementation which keeps the jobs in memory
+// the jobs are lost when the server exits, it suits the deployments with foreground jobs only
+// each function has a heap ordered by the dispatch policy, by priority then FIFO, or FIFO only
+// the delayed jobs are kept in another heap ordered by time, and moved to the ready heap when they're due
+type memoryQueue struct {
+	mu      sync.Mutex
+	heaps   map[string]*jobHeap
+	delayed map[string]*jobHeap
+	seq     uint64
+	cnt     int
+	policy  *dispatchPolicy
+	// less is the order of the ready jobs by the dispatch policy
+	less func(item, other *jobHeapItem) bool
+}
+
+type jobHeapItem struct {
+	j   *job
+	seq uint64
+}
+
+// lessByPriority reports whether the item should be dequeued before the other one
+func lessByPriority(item, other *jobHeapItem) bool {
+	if item.j.priority != other.j.priority {
+		return item.j.priority < other.j.priority
+	}
+	return item.seq < other.seq
+}
+
+// lessBySeq reports whether the item is queued before the other one
+func lessBySeq(item, other *jobHeapItem) bool {
+	return item.seq < other.seq
+}
+
+// lessByTime reports whether the delayed item is due before the other one
+func lessByTime(item, other *jobHeapItem) bool {
+	if !item.j.notBefore.Equal(other.j.notBefore) {
+		return item.j.notBefore.Before(other.j.notBefore)
+	}
+	return item.seq < other.seq
+}
+
+// jobHeap implements heap.Interface
+type jobHeap struct {
+	items []*jobHeapItem
+	less  func(item, other *jobHeapItem) bool
+}
+
+func (h *jobHeap) Len() int           { return len(h.items) }
+func (h *jobHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *jobHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *jobHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*jobHeapItem))
+}
+
+func (h *jobHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return item
+}
+
+func (h *jobHeap) top() *jobHeapItem {
+	return h.items[0]
+}
+
+func newMemoryQueue(policy *dispatchPolicy) *memoryQueue {
+	q := &memoryQueue{
+		heaps:   make(map[string]*jobHeap),
+		delayed: make(map[string]*jobHeap),
+		policy:  policy,
+		less:    lessBySeq,
+	}
+	if policy.byPriority() {
+		q.less = lessByPriority
+	}
+	return q
+}
+
+// pushJobHeap pushes the item to the heap of the function, creates the heap if not exists
+func pushJobHeap(heaps map[string]*jobHeap, function string, item *jobHeapItem,
+	less func(item, other *jobHeapItem) bool) {
+	h, ok := heaps[function]
+	if !ok {
+		h = &jobHeap{less: less}
+		heaps[function] = h
+	}
+	heap.Push(h, item)
+}
+
+// popJobHeap pops the top item of the heap of the function, removes the heap if it's empty
+func popJobHeap(heaps map[string]*jobHeap, function string) *jobHeapItem {
+	h := heaps[function]
+	item := heap.Pop(h).(*jobHeapItem)
+	if h.Len() == 0 {
+		delete(heaps, function)
+	}
+	return item
+}
+
+func (q *memoryQueue) enqueue(ctx context.Context, j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	item := &jobHeapItem{j: j, seq: q.seq}
+	if j.delay(time.Now()) > 0 {
+		pushJobHeap(q.delayed, j.function, item, lessByTime)
+	} else {
+		pushJobHeap(q.heaps, j.function, item, q.less)
+	}
+	q.cnt++
+	return nil
+}
+
+// promote moves the due delayed jobs of the function to the ready heap
+func (q *memoryQueue) promote(function string, now time.Time) {
+	for {
+		h, ok := q.delayed[function]
+		if !ok || h.top().j.delay(now) > 0 {
+			return
+		}
+		pushJobHeap(q.heaps, function, popJobHeap(q.delayed, function), q.less)
+	}
+}
+
+func (q *memoryQueue) size(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cnt, nil
+}
+
+func (q *memoryQueue) dequeue(ctx context.Context, functions []string) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	var ready []string
+	for _, function := range functions {
+		q.promote(function, now)
+		if _, ok := q.heaps[function]; ok {
+			ready = append(ready, function)
+		}
+	}
+	if len(ready) == 0 {
+		return nil, nil
+	}
+	var picked string
+	if q.policy.roundRobin() {
+		picked = q.policy.pickFunction(ready)
+	} else {
+		var best *jobHeapItem
+		for _, function := range ready {
+			top := q.heaps[function].top()
+			if best == nil || q.less(top, best) {
+				best = top
+				picked = function
+			}
+		}
+	}
+	item := popJobHeap(q.heaps, picked)
+	q.cnt--
+	return item.j, nil
+}
+
+func (q *memoryQueue) remove(ctx context.Context, handle *gearman.ID) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, heaps := range []map[string]*jobHeap{q.heaps, q.delayed} {
+		for function, h := range heaps {
+			for i, item := range h.items {
+				if *item.j.handle != *handle {
+					continue
+				}
+				heap.Remove(h, i)
+				if h.Len() == 0 {
+					delete(heaps, function)
+				}
+				q.cnt--
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// nextDelayed scans the delayed jobs, the ones not promoted yet may be due before the given time
+func (q *memoryQueue) nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	var functions []string
+	for function, h := range q.delayed {
+		// the items of a heap are not sorted, find the earliest one after the given time
+		var due time.Time
+		for _, item := range h.items {
+			notBefore := item.j.notBefore
+			if notBefore.After(after) && (due.IsZero() || notBefore.Before(due)) {
+				due = notBefore
+			}
+		}
+		switch {
+		case due.IsZero():
+		case next.IsZero() || due.Before(next):
+			next = due
+			functions = []string{function}
+		case due.Equal(next):
+			functions = append(functions, function)
+		}
+	}
+	return next, functions, nil
+}
+
+func (q *memoryQueue) dispose() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heaps = make(map[string]*jobHeap)
+	q.delayed = make(map[string]*jobHeap)
+	q.cnt = 0
+	return nil
+}
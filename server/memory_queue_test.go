@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueMemory(t *testing.T) {
+	q := newMemoryQueue(newTestPolicy(DispatchPriority, nil))
+	bgCtx := context.Background()
+	size, err := q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+
+	for i, job := range jobs {
+		err = q.enqueue(bgCtx, job)
+		assert.Nil(t, err)
+
+		size, err = q.size(bgCtx)
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, size)
+	}
+
+	job, err := q.dequeue(bgCtx, []string{"nonexist"})
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+
+	job, err = q.dequeue(bgCtx, []string{"reverse", "hello"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[2], job)
+
+	job, err = q.dequeue(bgCtx, []string{"echo", "reverse"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[1], job)
+
+	job, err = q.dequeue(bgCtx, []string{"echo", "reverse"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[3], job)
+
+	job, err = q.dequeue(bgCtx, []string{"binary"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[4], job)
+	size, err = q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(jobs)-4, size)
+
+	job, err = q.dequeue(bgCtx, []string{"reverse", "echo"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[0], job)
+	job, err = q.dequeue(bgCtx, []string{"reverse", "echo", "binary"})
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+	assert.Empty(t, q.heaps)
+
+	assert.Nil(t, q.dispose())
+}
+
+func TestQueueMemoryFIFO(t *testing.T) {
+	q := newMemoryQueue(newTestPolicy(DispatchPriority, nil))
+	bgCtx := context.Background()
+	var queued []*job
+	for i := 0; i < 10; i++ {
+		function := "echo"
+		if i%2 == 0 {
+			function = "reverse"
+		}
+		j := &job{
+			function: function,
+			handle:   testIdGen.Generate(),
+			priority: priorityMid,
+		}
+		queued = append(queued, j)
+		assert.Nil(t, q.enqueue(bgCtx, j))
+	}
+	high := &job{function: "echo", handle: testIdGen.Generate(), priority: priorityHigh}
+	assert.Nil(t, q.enqueue(bgCtx, high))
+
+	j, err := q.dequeue(bgCtx, []string{"reverse", "echo"})
+	assert.Nil(t, err)
+	assert.Equal(t, high, j)
+	for _, expected := range queued {
+		j, err = q.dequeue(bgCtx, []string{"reverse", "echo"})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, j)
+	}
+	size, err := q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+}
+
+func TestQueueMemoryDelayed(t *testing.T) {
+	q := newMemoryQueue(newTestPolicy(DispatchPriority, nil))
+	testQueueDelayed(t, q)
+
+	bgCtx := context.Background()
+	soon := &job{
+		function:  "reverse",
+		handle:    testIdGen.Generate(),
+		notBefore: time.Now().Add(time.Millisecond * 50),
+	}
+	assert.Nil(t, q.enqueue(bgCtx, soon))
+	j, err := q.dequeue(bgCtx, []string{"reverse"})
+	assert.Nil(t, err)
+	assert.Nil(t, j)
+	time.Sleep(time.Millisecond * 60)
+	j, err = q.dequeue(bgCtx, []string{"echo", "reverse"})
+	assert.Nil(t, err)
+	assert.Equal(t, soon, j)
+}
+
+func TestQueueMemoryRemove(t *testing.T) {
+	q := newMemoryQueue(newTestPolicy(DispatchPriority, nil))
+	bgCtx := context.Background()
+	for _, job := range jobs {
+		assert.Nil(t, q.enqueue(bgCtx, job))
+	}
+	delayed := &job{
+		function:  "reverse",
+		handle:    testIdGen.Generate(),
+		notBefore: time.Now().Add(time.Hour),
+	}
+	assert.Nil(t, q.enqueue(bgCtx, delayed))
+
+	for _, j := range []*job{jobs[1], delayed, jobs[4]} {
+		removed, err := q.remove(bgCtx, j.handle)
+		assert.Nil(t, err)
+		assert.True(t, removed)
+	}
+	removed, err := q.remove(bgCtx, jobs[1].handle)
+	assert.Nil(t, err)
+	assert.False(t, removed)
+	size, err := q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(jobs)-2, size)
+	assert.NotContains(t, q.heaps, "binary")
+	assert.Empty(t, q.delayed)
+
+	// the heap order is kept after removing
+	j, err := q.dequeue(bgCtx, []string{"echo", "reverse"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[2], j)
+	j, err = q.dequeue(bgCtx, []string{"echo", "reverse"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[3], j)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+// the results of a job counted by metrics
+const (
+	jobSubmitted = "submitted"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobTimeout   = "timeout"
+	jobCancelled = "cancelled"
+	jobRejected  = "rejected"
+)
+
+var jobResults = []string{jobSubmitted, jobCompleted, jobFailed, jobTimeout, jobCancelled, jobRejected}
+
+// the upper bounds of the handler latency histogram in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the observations <= latencyBuckets[i], not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	if i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+type jobCounterKey struct {
+	function string
+	result   string
+}
+
+// metrics collects the counters of the server, they're exported in the Prometheus text format
+// the methods of a nil *metrics do nothing, so the components work without metrics
+type metrics struct {
+	mu        sync.Mutex
+	jobs      map[jobCounterKey]uint64
+	packets   map[gearman.PacketType]uint64
+	latencies map[gearman.PacketType]*histogram
+	reaped    uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		jobs:      make(map[jobCounterKey]uint64),
+		packets:   make(map[gearman.PacketType]uint64),
+		latencies: make(map[gearman.PacketType]*histogram),
+	}
+}
+
+// countJob counts a job of the function by result
+func (m *metrics) countJob(function string, result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[jobCounterKey{function, result}]++
+}
+
+// connReaped counts a connection reaped as its peer is dead
+func (m *metrics) connReaped() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reaped++
+}
+
+// handled counts a packet received and the time taken by its handler
+func (m *metrics) handled(packetType gearman.PacketType, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.packets[packetType]++
+	h, ok := m.latencies[packetType]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[packetType] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the counters collected in the Prometheus text format
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, result := range jobResults {
+		name := "gearman_jobs_" + result + "_total"
+		fmt.Fprintf(w, "# HELP %s Number of the jobs %s by function.\n", name, result)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		var functions []string
+		for key := range m.jobs {
+			if key.result == result {
+				functions = append(functions, key.function)
+			}
+		}
+		sort.Strings(functions)
+		for _, function := range functions {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, label("function", function), m.jobs[jobCounterKey{function, result}])
+		}
+	}
+
+	packetTypes := make([]gearman.PacketType, 0, len(m.packets))
+	for packetType := range m.packets {
+		packetTypes = append(packetTypes, packetType)
+	}
+	sort.Slice(packetTypes, func(i, j int) bool {
+		return packetTypes[i] < packetTypes[j]
+	})
+	fmt.Fprintf(w, "# HELP gearman_packets_received_total Number of the packets received by type.\n")
+	fmt.Fprintf(w, "# TYPE gearman_packets_received_total counter\n")
+	for _, packetType := range packetTypes {
+		fmt.Fprintf(w, "gearman_packets_received_total{%s} %d\n", label("type", packetType.String()), m.packets[packetType])
+	}
+	fmt.Fprintf(w, "# HELP gearman_handler_duration_seconds Time taken to handle the packets by type.\n")
+	fmt.Fprintf(w, "# TYPE gearman_handler_duration_seconds histogram\n")
+	for _, packetType := range packetTypes {
+		h := m.latencies[packetType]
+		typeLabel := label("type", packetType.String())
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "gearman_handler_duration_seconds_bucket{%s,%s} %d\n",
+				typeLabel, label("le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "gearman_handler_duration_seconds_bucket{%s,%s} %d\n", typeLabel, label("le", "+Inf"), h.count)
+		fmt.Fprintf(w, "gearman_handler_duration_seconds_sum{%s} %s\n", typeLabel, formatFloat(h.sum))
+		fmt.Fprintf(w, "gearman_handler_duration_seconds_count{%s} %d\n", typeLabel, h.count)
+	}
+	fmt.Fprintf(w, "# HELP gearman_connections_reaped_total Number of the connections reaped as their peers are dead.\n")
+	fmt.Fprintf(w, "# TYPE gearman_connections_reaped_total counter\n")
+	fmt.Fprintf(w, "gearman_connections_reaped_total %d\n", m.reaped)
+}
+
+// writeMetrics writes the metrics of the server in the Prometheus text format
+// the gauges are read from the jobs manager, the connections and the queue at the time
+func (s *Server) writeMetrics(ctx context.Context, w io.Writer) {
+	statuses := s.jobsManager.functionsStatus()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].function < statuses[j].function
+	})
+	fmt.Fprintf(w, "# HELP gearman_function_jobs_queued Number of the jobs waiting for a worker by function.\n")
+	fmt.Fprintf(w, "# TYPE gearman_function_jobs_queued gauge\n")
+	for _, fs := range statuses {
+		fmt.Fprintf(w, "gearman_function_jobs_queued{%s} %d\n", label("function", fs.function), fs.queued)
+	}
+	fmt.Fprintf(w, "# HELP gearman_function_jobs_running Number of the jobs dispatched to a worker by function.\n")
+	fmt.Fprintf(w, "# TYPE gearman_function_jobs_running gauge\n")
+	for _, fs := range statuses {
+		fmt.Fprintf(w, "gearman_function_jobs_running{%s} %d\n", label("function", fs.function), fs.running)
+	}
+
+	conns := serverConns(s.connManager)
+	workers := availableWorkers(conns)
+	functions := make([]string, 0, len(workers))
+	for function := range workers {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	fmt.Fprintf(w, "# HELP gearman_function_workers Number of the workers available by function.\n")
+	fmt.Fprintf(w, "# TYPE gearman_function_workers gauge\n")
+	for _, function := range functions {
+		fmt.Fprintf(w, "gearman_function_workers{%s} %d\n", label("function", function), workers[function])
+	}
+	fmt.Fprintf(w, "# HELP gearman_connections Number of the active connections.\n")
+	fmt.Fprintf(w, "# TYPE gearman_connections gauge\n")
+	fmt.Fprintf(w, "gearman_connections %d\n", len(conns))
+
+	if size, err := s.queue.size(ctx); err != nil {
+		s.logger.Printf("failed to get the queue size for metrics: %s", err)
+	} else {
+		fmt.Fprintf(w, "# HELP gearman_queue_size Number of the jobs in the queue.\n")
+		fmt.Fprintf(w, "# TYPE gearman_queue_size gauge\n")
+		fmt.Fprintf(w, "gearman_queue_size %d\n", size)
+	}
+
+	s.metrics.write(w)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf := bufio.NewWriter(w)
+	s.writeMetrics(r.Context(), buf)
+	buf.Flush()
+}
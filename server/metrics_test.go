@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	var nilMetrics *metrics
+	nilMetrics.countJob("echo", jobSubmitted)
+	nilMetrics.handled(gearman.SUBMIT_JOB, time.Millisecond)
+
+	m := newMetrics()
+	m.countJob("echo", jobSubmitted)
+	m.countJob("echo", jobSubmitted)
+	m.countJob("echo", jobTimeout)
+	m.countJob(`say "hi"`, jobFailed)
+	m.handled(gearman.SUBMIT_JOB, time.Millisecond*2)
+	m.handled(gearman.SUBMIT_JOB, time.Second*10)
+	buf := new(bytes.Buffer)
+	m.write(buf)
+	output := buf.String()
+	for _, line := range []string{
+		"# TYPE gearman_jobs_submitted_total counter\n",
+		`gearman_jobs_submitted_total{function="echo"} 2` + "\n",
+		`gearman_jobs_timeout_total{function="echo"} 1` + "\n",
+		`gearman_jobs_failed_total{function="say \"hi\""} 1` + "\n",
+		`gearman_packets_received_total{type="SUBMIT_JOB"} 2` + "\n",
+		`gearman_handler_duration_seconds_bucket{type="SUBMIT_JOB",le="0.001"} 0` + "\n",
+		`gearman_handler_duration_seconds_bucket{type="SUBMIT_JOB",le="0.005"} 1` + "\n",
+		`gearman_handler_duration_seconds_bucket{type="SUBMIT_JOB",le="5"} 1` + "\n",
+		`gearman_handler_duration_seconds_bucket{type="SUBMIT_JOB",le="+Inf"} 2` + "\n",
+		`gearman_handler_duration_seconds_sum{type="SUBMIT_JOB"} 10.002` + "\n",
+		`gearman_handler_duration_seconds_count{type="SUBMIT_JOB"} 2` + "\n",
+	} {
+		assert.Contains(t, output, line)
+	}
+	assert.NotContains(t, output, "gearman_jobs_completed_total{")
+}
+
+func TestServerMetrics(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	client := serveForTest(s)
+	worker := serveForTest(s)
+	defer close(client.ReadCh)
+	defer close(worker.ReadCh)
+
+	for _, uniqueID := range []string{"job1", "job2"} {
+		resp := request(t, client, gearman.SUBMIT_JOB_BG, "echo", uniqueID, "hello")
+		assert.Equal(t, gearman.JOB_CREATED, resp.PacketType)
+	}
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+	resp := request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{resp.Arguments[0], "hello"},
+	}
+	resp = request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+	// the echo response ensures WORK_COMPLETE is processed
+	resp = request(t, worker, gearman.ECHO_REQ, "ping")
+	assert.Equal(t, gearman.ECHO_RES, resp.PacketType)
+	time.Sleep(time.Millisecond * 50)
+
+	recorder := httptest.NewRecorder()
+	s.handleMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	output := recorder.Body.String()
+	for _, line := range []string{
+		`gearman_function_jobs_queued{function="echo"} 0` + "\n",
+		`gearman_function_jobs_running{function="echo"} 1` + "\n",
+		`gearman_function_workers{function="echo"} 1` + "\n",
+		"gearman_connections 2\n",
+		"gearman_queue_size 0\n",
+		`gearman_jobs_submitted_total{function="echo"} 2` + "\n",
+		`gearman_jobs_completed_total{function="echo"} 1` + "\n",
+		`gearman_packets_received_total{type="SUBMIT_JOB_BG"} 2` + "\n",
+		`gearman_packets_received_total{type="GRAB_JOB"} 2` + "\n",
+		`gearman_handler_duration_seconds_count{type="WORK_COMPLETE"} 1` + "\n",
+	} {
+		assert.Contains(t, output, line)
+	}
+}
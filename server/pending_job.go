@@ -1,61 +1,95 @@
 package server
 
 import (
-	"context"
 	"fmt"
 	"log"
-	"reflect"
-	"strconv"
-	"time"
 
 	gearman "github.com/peonone/gearman"
 )
 
 // pendingJob represents a pending job managed by the server
 // a pending job has two states: dispatched(to a worker) and un-dispatched
-// for dispatched pending job, we have a dedicate goroutine for it
-// the goroutine handles the status update, status query, complete, listening client disconnect and timeout
+// a dispatched pending job is run by a shard of the jobs dispatcher, see dispatcher.go
+// the shard handles the status update, status query, complete, listening client disconnect and timeout
+// the job is requeued if the worker disconnects or the job timeouts, until the retry limit is reached
+// for a reduce job, the sub-results sent by the mapper with WORK_DATA are collected,
+// and the job is queued again to the reducer function with the same handle once the mapper completes
+// a cancelled job is removed from the queue, or its dispatch ends with WORK_FAIL if it's dispatched
 
 const jobTimeoutErrMsg = "Job execution timeout"
 
-const (
-	selectIdxStatusUpdate = iota
-	selectIdxTimeout
-	selectIdxNewConn
-	selectIdxQueryStatus
-	selectIdxGetConnections
-
-	staticSelectCnt
-)
+type pendingJob struct {
+	run        *jobRun // the current dispatch, protected by the manager's lock
+	handle     *gearman.ID
+	job        *job // the job dispatched, kept for requeue
+	retries    int
+	mapResults [][]byte // the sub-results of the mapper of a reduce job
+	function   string
+	priority   priority // the priority of the queued job, protected by the manager's lock
+	uniqueID   string
+	// clientConns is protected by the manager's lock if the job is not dispatched,
+	// or owned by the shard running the job
+	clientConns map[gearman.ID]*conn
+	dispatched  bool
+	background  bool // submitted as a background job by any client or its result is kept, protected by the manager's lock
+	cancelled   bool // protected by the manager's lock
+	logger      *log.Logger
+	cfg         *Config
+}
 
-type newConnReq struct {
-	conn  *conn
-	reply chan bool
+// mapping reports whether the job is at the map stage of a reduce job
+func (j *pendingJob) mapping() bool {
+	return j.job != nil && j.job.reducer != ""
 }
 
-type statusUpdateReq struct {
-	handle *gearman.ID
-	msg    *gearman.Message
+// reduceJob makes the job to be run by the reducer with the sub-results of the mapper
+func (j *pendingJob) reduceJob() *job {
+	return &job{
+		function: j.job.reducer,
+		data:     string(gearman.EncodeReduceInput(j.mapResults)),
+		handle:   j.handle,
+		uniqueID: j.uniqueID,
+		priority: j.job.priority,
+	}
 }
 
-type pendingJob struct {
-	newConnChan          chan *newConnReq
-	statusUpdateChan     chan *statusUpdateReq
-	statusQueryChan      chan chan *jobStatus
-	connectionsQueryChan chan chan map[gearman.ID]*conn
-	done                 chan struct{}
-	handle               *gearman.ID
-	uniqueID             string
-	clientConns          map[gearman.ID]*conn
-	prgNumerator         int
-	prgDenominator       int
-	timeouted            bool
-	completed            bool
-	dispatched           bool
-	logger               *log.Logger
-	cfg                  *Config
+// forward sends the status update of the worker to the clients
+// WORK_EXCEPTION is sent as WORK_FAIL to the clients not asking for the exceptions
+func (j *pendingJob) forward(msg *gearman.Message, conns []*conn) {
+	msg.MagicType = gearman.MagicRes
+	var msgBin, origBin, failBin []byte
+	var err error
+	for _, conn := range conns {
+		if msg.PacketType == gearman.WORK_EXCEPTION && !conn.forwardException() {
+			if failBin == nil {
+				failMsg := &gearman.Message{
+					MagicType:  gearman.MagicRes,
+					PacketType: gearman.WORK_FAIL,
+					Arguments:  []string{j.handle.String()},
+				}
+				failBin, err = failMsg.Encode()
+				if err != nil {
+					j.logger.Printf("encode msg %s failed", failMsg)
+					continue
+				}
+			}
+			msgBin = failBin
+		} else {
+			if origBin == nil {
+				origBin, err = msg.Encode()
+				if err != nil {
+					j.logger.Printf("encode msg %s failed", msg)
+					continue
+				}
+			}
+			msgBin = origBin
+		}
+		conn.WriteBin(msgBin)
+	}
 }
 
+// sendToListenClients sends the message to the listening clients
+// the caller should hold the manager's lock, or the job is finished
 func (j *pendingJob) sendToListenClients(msg *gearman.Message) error {
 	binData, err := msg.Encode()
 	if err != nil {
@@ -70,198 +104,27 @@ func (j *pendingJob) sendToListenClients(msg *gearman.Message) error {
 	return err
 }
 
-func (j *pendingJob) handleStatusUpdate(req *statusUpdateReq) bool {
-	defer gearman.MsgPool.Put(req.msg)
-	completed := false
-	switch req.msg.PacketType {
-	case gearman.WORK_COMPLETE, gearman.WORK_FAIL, gearman.WORK_EXCEPTION:
-		completed = true
-	case gearman.WORK_STATUS:
-		num, numErr := strconv.Atoi(req.msg.Arguments[1])
-		den, denErr := strconv.Atoi(req.msg.Arguments[2])
-		if numErr == nil && denErr == nil {
-			j.prgNumerator = num
-			j.prgDenominator = den
-		}
+// notify tells the listening clients the job failed or timeouted
+func (j *pendingJob) notify(packet gearman.PacketType) {
+	if len(j.clientConns) == 0 {
+		return
 	}
-	req.msg.MagicType = gearman.MagicRes
-	if req.msg.PacketType == gearman.WORK_EXCEPTION {
-		var msgBin, excBin, failBin []byte
-		var err error
-
-		for _, conn := range j.clientConns {
-			if conn.forwardException() {
-				if excBin == nil {
-					excBin, err = req.msg.Encode()
-					if err != nil {
-						j.logger.Printf("encode msg %s failed", req.msg)
-						continue
-					}
-				}
-				msgBin = excBin
-			} else {
-				if failBin == nil {
-					failMsg := &gearman.Message{
-						MagicType:  gearman.MagicRes,
-						PacketType: gearman.WORK_FAIL,
-						Arguments:  []string{j.handle.String()},
-					}
-					failBin, err = failMsg.Encode()
-					if err != nil {
-						j.logger.Printf("encode msg %s failed", req.msg)
-						continue
-					}
-					msgBin = failBin
-				}
-			}
-			conn.WriteBin(msgBin)
-		}
-	} else {
-		j.sendToListenClients(req.msg)
+	msg := gearman.MsgPool.Get()
+	msg.MagicType = gearman.MagicRes
+	msg.PacketType = packet
+	msg.Arguments = []string{j.handle.String()}
+	if packet == gearman.WORK_EXCEPTION {
+		msg.Arguments = append(msg.Arguments, jobTimeoutErrMsg)
 	}
+	j.sendToListenClients(msg)
+	gearman.MsgPool.Put(msg)
+}
 
-	return completed
+// sendWorkFail tells the listening clients the job failed
+func (j *pendingJob) sendWorkFail() {
+	j.notify(gearman.WORK_FAIL)
 }
 
 func (j *pendingJob) String() string {
 	return fmt.Sprintf("%s-%s", j.handle, j.uniqueID)
 }
-
-func (j *pendingJob) run(timeout time.Duration, manager *srvJobsManager) {
-	if j.cfg.Verbose {
-		j.logger.Printf("job %s started", j)
-	}
-	defer func() {
-		// remove the job from jobs manager
-		if j.cfg.Verbose {
-			j.logger.Printf("job %s done", j)
-		}
-		close(j.done)
-		manager.removeJob(j.handle)
-		close(j.newConnChan)
-		close(j.statusUpdateChan)
-		close(j.statusQueryChan)
-		close(j.connectionsQueryChan)
-		manager.jobRoutineDone()
-	}()
-	var timeoutTimer *time.Timer
-	var emptyChan chan struct{}
-
-	if timeout > 0 {
-		timeoutTimer = time.NewTimer(timeout)
-	} else {
-		emptyChan = make(chan struct{})
-	}
-
-LOOP:
-	for {
-		cases := make([]reflect.SelectCase, len(j.clientConns)+staticSelectCnt)
-		casesConnMap := make(map[int]gearman.Conn)
-
-		cases[selectIdxStatusUpdate] = reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(j.statusUpdateChan),
-		}
-		if timeoutTimer != nil {
-			cases[selectIdxTimeout] = reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(timeoutTimer.C),
-			}
-		} else {
-			cases[selectIdxTimeout] = reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(emptyChan),
-			}
-		}
-
-		cases[selectIdxNewConn] = reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(j.newConnChan),
-		}
-		cases[selectIdxQueryStatus] = reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(j.statusQueryChan),
-		}
-		cases[selectIdxGetConnections] = reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(j.connectionsQueryChan),
-		}
-
-		i := staticSelectCnt
-		for _, conn := range j.clientConns {
-			closedChan := conn.Closed()
-			casesConnMap[i] = conn
-			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(closedChan)}
-			i++
-		}
-		chosen, value, _ := reflect.Select(cases)
-		switch chosen {
-		case selectIdxStatusUpdate:
-			if j.handleStatusUpdate(value.Interface().(*statusUpdateReq)) {
-				// job completed
-				if timeoutTimer != nil {
-					timeoutTimer.Stop()
-				}
-				break LOOP
-			}
-		case selectIdxTimeout:
-			// job timeout
-			if j.cfg.Verbose {
-				j.logger.Printf("job %s timeouted", j)
-			}
-			j.timeouted = true
-			if len(j.clientConns) > 0 {
-				msg := gearman.MsgPool.Get()
-				msg.MagicType = gearman.MagicRes
-				msg.PacketType = gearman.WORK_EXCEPTION
-				msg.Arguments = []string{j.handle.String(), jobTimeoutErrMsg}
-				j.sendToListenClients(msg)
-				gearman.MsgPool.Put(msg)
-			}
-			break LOOP
-		case selectIdxNewConn:
-			connReq := value.Interface().(*newConnReq)
-			j.clientConns[*connReq.conn.ID()] = connReq.conn
-			connReq.reply <- true
-		case selectIdxQueryStatus:
-			replyCh := value.Interface().(chan *jobStatus)
-			replyCh <- &jobStatus{
-				handle:       j.handle,
-				known:        true,
-				running:      true,
-				numerator:    j.prgNumerator,
-				denominator:  j.prgDenominator,
-				waitingCount: len(j.clientConns),
-			}
-		case selectIdxGetConnections:
-			replyCh := value.Interface().(chan map[gearman.ID]*conn)
-			connsCopy := make(map[gearman.ID]*conn)
-
-			for k, v := range j.clientConns {
-				connsCopy[k] = v
-			}
-			replyCh <- connsCopy
-		default:
-			closedConn := casesConnMap[chosen]
-			delete(j.clientConns, *closedConn.ID())
-		}
-	}
-}
-
-func (j *pendingJob) registerNewConn(ctx context.Context, clientConn *conn) (bool, error) {
-	replyCh := make(chan bool)
-	select {
-	case <-j.done:
-		return false, nil
-	case j.newConnChan <- &newConnReq{clientConn, replyCh}:
-	}
-
-	select {
-	case <-replyCh:
-		return true, nil
-	case <-j.done:
-		return false, nil
-	case <-ctx.Done():
-		return false, ctx.Err()
-	}
-}
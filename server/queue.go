@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/peonone/gearman"
 	"github.com/stretchr/testify/mock"
@@ -12,6 +13,11 @@ type queue interface {
 	enqueue(ctx context.Context, job *job) error
 	size(ctx context.Context) (int, error)
 	dequeue(ctx context.Context, functions []string) (*job, error)
+	// remove deletes the job from the queue, false is returned if it's not in the queue
+	remove(ctx context.Context, handle *gearman.ID) (bool, error)
+	// nextDelayed returns the earliest time after the given one when delayed jobs are due,
+	// and the functions of the jobs due then, zero time is returned if there's none
+	nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error)
 	dispose() error
 }
 
@@ -38,6 +44,20 @@ func (q *mockQueue) dequeue(ctx context.Context, functions []string) (*job, erro
 	return j, returnValues.Error(1)
 }
 
+func (q *mockQueue) remove(ctx context.Context, handle *gearman.ID) (bool, error) {
+	returnValues := q.Called(handle)
+	return returnValues.Bool(0), returnValues.Error(1)
+}
+
+func (q *mockQueue) nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error) {
+	returnValues := q.Called(after)
+	var functions []string
+	if returnValues.Get(1) != nil {
+		functions = returnValues.Get(1).([]string)
+	}
+	return returnValues.Get(0).(time.Time), functions, returnValues.Error(2)
+}
+
 func (q *mockQueue) appendListenClient(ctx context.Context, handle *gearman.ID, clientID *gearman.ID) error {
 	return q.Called(ctx, handle, clientID).Error(0)
 }
@@ -47,4 +67,5 @@ func (q *mockQueue) dispose() error {
 }
 
 var _ queue = &sqlQueue{}
+var _ queue = &memoryQueue{}
 var _ queue = &mockQueue{}
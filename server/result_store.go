@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// the result store types
+const (
+	ResultStoreMemory = "memory"
+	ResultStoreSQL    = "sql"
+)
+
+var errUnknownResultStoreType = errors.New("Unknown result store type")
+var errResultStoreWithoutSQLQueue = errors.New("The sql result store requires the sql queue")
+
+// the status of a job result
+const (
+	resultComplete  = "complete"
+	resultFail      = "fail"
+	resultException = "exception"
+)
+
+// jobResult is the result of a background job kept for the clients to fetch later
+type jobResult struct {
+	handle   string
+	uniqueID string
+	status   string
+	// data is the result of WORK_COMPLETE or the exception of WORK_EXCEPTION
+	data     string
+	expireAt time.Time
+}
+
+// resultStore keeps the results of the background jobs until they expire
+type resultStore interface {
+	put(ctx context.Context, r *jobResult) error
+	// get returns the result by handle, or by unique ID if handle is empty, nil if not found or expired
+	get(ctx context.Context, handle string, uniqueID string) (*jobResult, error)
+	dispose() error
+}
+
+// the interval to remove the expired results
+const resultPurgeInterval = time.Minute
+
+// memoryResultStore keeps the results in memory, they're lost when the server exits
+type memoryResultStore struct {
+	mu        sync.Mutex
+	byHandle  map[string]*jobResult
+	byUnique  map[string]*jobResult
+	nextPurge time.Time
+}
+
+func newMemoryResultStore() *memoryResultStore {
+	return &memoryResultStore{
+		byHandle: make(map[string]*jobResult),
+		byUnique: make(map[string]*jobResult),
+	}
+}
+
+func (s *memoryResultStore) put(ctx context.Context, r *jobResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextPurge) {
+		s.purge(now)
+		s.nextPurge = now.Add(resultPurgeInterval)
+	}
+	s.byHandle[r.handle] = r
+	if r.uniqueID != "" {
+		s.byUnique[r.uniqueID] = r
+	}
+	return nil
+}
+
+// purge removes the expired results, the caller should hold s.mu
+func (s *memoryResultStore) purge(now time.Time) {
+	for handle, r := range s.byHandle {
+		if !r.expireAt.After(now) {
+			delete(s.byHandle, handle)
+		}
+	}
+	for uniqueID, r := range s.byUnique {
+		if !r.expireAt.After(now) {
+			delete(s.byUnique, uniqueID)
+		}
+	}
+}
+
+func (s *memoryResultStore) get(ctx context.Context, handle string, uniqueID string) (*jobResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r *jobResult
+	if handle != "" {
+		r = s.byHandle[handle]
+	} else {
+		r = s.byUnique[uniqueID]
+	}
+	if r == nil || !r.expireAt.After(time.Now()) {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (s *memoryResultStore) dispose() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHandle = make(map[string]*jobResult)
+	s.byUnique = make(map[string]*jobResult)
+	return nil
+}
+
+// newResultStore creates the result store of the config, nil if it's not enabled
+// the sql result store shares the database of the sql queue q
+func newResultStore(cfg *Config, q queue) (resultStore, error) {
+	switch cfg.ResultStoreType {
+	case "":
+		return nil, nil
+	case ResultStoreMemory:
+		return newMemoryResultStore(), nil
+	case ResultStoreSQL:
+		sq, ok := q.(*sqlQueue)
+		if !ok {
+			return nil, errResultStoreWithoutSQLQueue
+		}
+		return newSQLResultStore(sq, cfg.ResultTableName)
+	}
+	return nil, errUnknownResultStoreType
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testResultStore(t *testing.T, s resultStore) {
+	ctx := context.Background()
+	now := time.Now()
+	r, err := s.get(ctx, "H:1", "")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	results := []*jobResult{
+		{handle: "H:1", uniqueID: "uniq1", status: resultComplete, data: "\x00olleh", expireAt: now.Add(time.Hour)},
+		{handle: "H:2", uniqueID: "", status: resultFail, expireAt: now.Add(time.Hour)},
+		{handle: "H:3", uniqueID: "uniq3", status: resultException, data: "boom", expireAt: now.Add(-time.Second)},
+	}
+	for _, r := range results {
+		assert.Nil(t, s.put(ctx, r))
+	}
+	for _, expected := range results[:2] {
+		r, err = s.get(ctx, expected.handle, "")
+		assert.Nil(t, err)
+		assert.Equal(t, expected.handle, r.handle)
+		assert.Equal(t, expected.uniqueID, r.uniqueID)
+		assert.Equal(t, expected.status, r.status)
+		assert.Equal(t, expected.data, r.data)
+		assert.Equal(t, expected.expireAt.Unix(), r.expireAt.Unix())
+	}
+	r, err = s.get(ctx, "", "uniq1")
+	assert.Nil(t, err)
+	assert.Equal(t, "H:1", r.handle)
+
+	// expired
+	r, err = s.get(ctx, "H:3", "")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+	r, err = s.get(ctx, "", "uniq3")
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	// the latest result of the unique ID
+	assert.Nil(t, s.put(ctx, &jobResult{handle: "H:4", uniqueID: "uniq1", status: resultComplete,
+		data: "again", expireAt: now.Add(time.Hour * 2)}))
+	r, err = s.get(ctx, "", "uniq1")
+	assert.Nil(t, err)
+	assert.Equal(t, "again", r.data)
+	// put again with the same handle replaces the result
+	assert.Nil(t, s.put(ctx, &jobResult{handle: "H:2", status: resultComplete, expireAt: now.Add(time.Hour)}))
+	r, err = s.get(ctx, "H:2", "")
+	assert.Nil(t, err)
+	assert.Equal(t, resultComplete, r.status)
+}
+
+func TestResultStoreMemory(t *testing.T) {
+	s := newMemoryResultStore()
+	testResultStore(t, s)
+	// the expired results are removed on put
+	s.nextPurge = time.Time{}
+	assert.Nil(t, s.put(context.Background(), &jobResult{handle: "H:5", expireAt: time.Now().Add(time.Hour)}))
+	assert.NotContains(t, s.byHandle, "H:3")
+	assert.NotContains(t, s.byUnique, "uniq3")
+	assert.Nil(t, s.dispose())
+}
+
+func TestResultStoreSqlite3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ds := filepath.Join(dir, "test.db")
+	q, err := newSQLQueue(QueueSqlite3Driver, ds, "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	s, err := newSQLResultStore(q, "gearman_results")
+	assert.Nil(t, err)
+	assert.Equal(t, q.db, s.db)
+	testResultStore(t, s)
+	s.nextPurge = time.Time{}
+	assert.Nil(t, s.put(context.Background(), &jobResult{handle: "H:5", expireAt: time.Now().Add(time.Hour)}))
+	var cnt int
+	assert.Nil(t, s.db.QueryRow("SELECT COUNT(1) FROM gearman_results WHERE handle = 'H:3'").Scan(&cnt))
+	assert.Equal(t, 0, cnt)
+	assert.Nil(t, s.dispose())
+	// the queue closes the shared database
+	assert.Nil(t, q.db.Ping())
+	assert.Nil(t, q.dispose())
+
+	// the existing table is reused without the queue columns added
+	q, err = newSQLQueue(QueueSqlite3Driver, ds, "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	defer q.dispose()
+	s, err = newSQLResultStore(q, "gearman_results")
+	assert.Nil(t, err)
+	r, err := s.get(context.Background(), "H:5", "")
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+	_, err = s.db.Exec("SELECT not_before FROM gearman_results WHERE 1 = 0")
+	assert.NotNil(t, err)
+
+	_, err = newResultStore(&Config{ResultStoreType: ResultStoreSQL}, newMemoryQueue(newTestPolicy(DispatchPriority, nil)))
+	assert.Equal(t, errResultStoreWithoutSQLQueue, err)
+}
+
+func TestResultStorePostgres(t *testing.T) {
+	ds := os.Getenv("GEARMAN_TEST_POSTGRES")
+	if ds == "" {
+		t.Skip("GEARMAN_TEST_POSTGRES is not set")
+	}
+	testSQLResultStore(t, QueuePostgresDriver, ds)
+}
+
+func TestResultStoreMySQL(t *testing.T) {
+	ds := os.Getenv("GEARMAN_TEST_MYSQL")
+	if ds == "" {
+		t.Skip("GEARMAN_TEST_MYSQL is not set")
+	}
+	testSQLResultStore(t, QueueMySQLDriver, ds)
+}
+
+func testSQLResultStore(t *testing.T, driver string, ds string) {
+	q, err := newSQLQueue(driver, ds, "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	defer q.dispose()
+	_, err = q.db.Exec("DROP TABLE IF EXISTS gearman_results")
+	assert.Nil(t, err)
+	s, err := newSQLResultStore(q, "gearman_results")
+	assert.Nil(t, err)
+	testResultStore(t, s)
+}
+
+func TestStoreResult(t *testing.T) {
+	manager, q := makeJobsManagerForTest()
+	defer manager.stop()
+	results := newMemoryResultStore()
+	manager.results = results
+	ctx := context.Background()
+	client := newMockSConn(10, 10)
+	functions := supportFunctions(map[string]time.Duration{"echo": 0})
+
+	cases := []struct {
+		clientConn *conn
+		packet     gearman.PacketType
+		args       []string
+		expected   *jobResult
+	}{
+		{nil, gearman.WORK_COMPLETE, []string{"olleh"}, &jobResult{status: resultComplete, data: "olleh"}},
+		{nil, gearman.WORK_FAIL, nil, &jobResult{status: resultFail}},
+		{nil, gearman.WORK_EXCEPTION, []string{"boom"}, &jobResult{status: resultException, data: "boom"}},
+		// the results of the foreground jobs are not kept
+		{client.srvConn, gearman.WORK_COMPLETE, []string{"olleh"}, nil},
+	}
+	for _, c := range cases {
+		j := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "uniq1"}
+		q.On("enqueue", ctx, j).Return(nil).Once()
+		_, err := manager.submitJob(ctx, j, c.clientConn)
+		assert.Nil(t, err)
+		q.On("dequeue", mock.Anything).Return(j, nil).Once()
+		_, err = manager.grabJob(ctx, functions, nil)
+		assert.Nil(t, err)
+		assert.True(t, manager.updateJobStatus(ctx, j.handle, &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: c.packet,
+			Arguments:  append([]string{j.handle.String()}, c.args...),
+		}, nil))
+		for manager.activeJobCount() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		r, err := results.get(ctx, j.handle.String(), "")
+		assert.Nil(t, err)
+		if c.expected == nil {
+			assert.Nil(t, r)
+			continue
+		}
+		assert.Equal(t, "uniq1", r.uniqueID)
+		assert.Equal(t, c.expected.status, r.status)
+		assert.Equal(t, c.expected.data, r.data)
+		assert.WithinDuration(t, time.Now().Add(defaultResultTTL), r.expireAt, time.Second)
+	}
+	// the foreground job got the result
+	assert.Equal(t, gearman.WORK_COMPLETE, (<-client.WriteCh).PacketType)
+}
+
+func TestAdminResult(t *testing.T) {
+	a, _, _ := makeAdminForTest()
+	assert.Equal(t, adminErrNoResultStore, adminCall(t, a, "result H:1"))
+
+	results := newMemoryResultStore()
+	a.results = results
+	expireAt := time.Now().Add(time.Hour)
+	ctx := context.Background()
+	assert.Nil(t, results.put(ctx, &jobResult{handle: "H:1", uniqueID: "uniq1", status: resultComplete,
+		data: "olleh", expireAt: expireAt}))
+	assert.Nil(t, results.put(ctx, &jobResult{handle: "H:2", status: resultFail, expireAt: expireAt}))
+	assert.Equal(t, "OK complete b2xsZWg=\n", adminCall(t, a, "result H:1"))
+	assert.Equal(t, "OK complete b2xsZWg=\n", adminCall(t, a, "result_unique uniq1"))
+	assert.Equal(t, "OK fail \n", adminCall(t, a, "result H:2"))
+	assert.Equal(t, adminErrNotFound, adminCall(t, a, "result H:3"))
+	assert.Equal(t, adminErrIncomplete, adminCall(t, a, "result_unique"))
+}
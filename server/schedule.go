@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var errInvalidSchedule = errors.New("Invalid schedule")
+
+// schedule is the crontab like schedule of SUBMIT_JOB_SCHED
+// a field of -1 matches any value
+type schedule struct {
+	minute     int
+	hour       int
+	dayOfMonth int
+	month      int
+	dayOfWeek  int
+}
+
+// the max period to look for the next run time, a schedule like Feb 30 never matches
+const maxScheduleSearch = 5 * 366 * 24 * time.Hour
+
+// parseSchedule parses the fields of SUBMIT_JOB_SCHED, an empty field matches any value
+func parseSchedule(minute, hour, dayOfMonth, month, dayOfWeek string) (*schedule, error) {
+	fields := []struct {
+		str      string
+		min, max int
+	}{
+		{minute, 0, 59},
+		{hour, 0, 23},
+		{dayOfMonth, 1, 31},
+		{month, 1, 12},
+		{dayOfWeek, 0, 6},
+	}
+	values := make([]int, len(fields))
+	for i, field := range fields {
+		if field.str == "" {
+			values[i] = -1
+			continue
+		}
+		v, err := strconv.Atoi(field.str)
+		if err != nil || v < field.min || v > field.max {
+			return nil, errInvalidSchedule
+		}
+		values[i] = v
+	}
+	return &schedule{values[0], values[1], values[2], values[3], values[4]}, nil
+}
+
+func (s *schedule) matchDay(t time.Time) bool {
+	if s.month >= 0 && int(t.Month()) != s.month {
+		return false
+	}
+	mdayMatch := s.dayOfMonth < 0 || t.Day() == s.dayOfMonth
+	wdayMatch := s.dayOfWeek < 0 || int(t.Weekday()) == s.dayOfWeek
+	if s.dayOfMonth >= 0 && s.dayOfWeek >= 0 {
+		// either of them matches like cron
+		return mdayMatch || wdayMatch
+	}
+	return mdayMatch && wdayMatch
+}
+
+// next returns the first matched minute after now
+func (s *schedule) next(now time.Time) (time.Time, error) {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	deadline := now.Add(maxScheduleSearch)
+	for t.Before(deadline) {
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour >= 0 && t.Hour() != s.hour {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute >= 0 && t.Minute() != s.minute {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+	return time.Time{}, errInvalidSchedule
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2018, 3, 14, 10, 30, 20, 0, time.UTC)
+	cases := []struct {
+		fields   []string
+		expected time.Time
+	}{
+		{[]string{"", "", "", "", ""}, time.Date(2018, 3, 14, 10, 31, 0, 0, time.UTC)},
+		{[]string{"0", "", "", "", ""}, time.Date(2018, 3, 14, 11, 0, 0, 0, time.UTC)},
+		{[]string{"15", "2", "", "", ""}, time.Date(2018, 3, 15, 2, 15, 0, 0, time.UTC)},
+		{[]string{"", "", "1", "", ""}, time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{[]string{"0", "0", "", "1", ""}, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{[]string{"0", "0", "", "", "0"}, time.Date(2018, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{[]string{"0", "0", "20", "", "5"}, time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{[]string{"0", "0", "29", "2", ""}, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := parseSchedule(c.fields[0], c.fields[1], c.fields[2], c.fields[3], c.fields[4])
+		assert.Nil(t, err)
+		next, err := s.next(now)
+		assert.Nil(t, err, "%v", c.fields)
+		assert.Equal(t, c.expected, next, "%v", c.fields)
+	}
+
+	s, err := parseSchedule("0", "0", "30", "2", "")
+	assert.Nil(t, err)
+	_, err = s.next(now)
+	assert.Equal(t, errInvalidSchedule, err)
+
+	for _, fields := range [][]string{
+		{"60", "", "", "", ""},
+		{"", "24", "", "", ""},
+		{"", "", "0", "", ""},
+		{"", "", "", "13", ""},
+		{"", "", "", "", "7"},
+		{"x", "", "", "", ""},
+	} {
+		_, err = parseSchedule(fields[0], fields[1], fields[2], fields[3], fields[4])
+		assert.Equal(t, errInvalidSchedule, err, "%v", fields)
+	}
+}
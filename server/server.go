@@ -1,24 +1,42 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"reflect"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/peonone/gearman"
 )
 
 var errUnknownQueueType = errors.New("Unknown queue type")
 
+const errCodeBodyTooLarge = "body_too_large"
+
+// connsCloseTimeout is how long Shutdown waits the jobs of the closed workers to end
+const connsCloseTimeout = time.Second
+
+// the timeouts of reading the HTTP requests of the gateway and the metrics,
+// the context of a request is cancelled once ReadTimeout elapsed, so it covers the longest long poll of the gateway
+const (
+	httpReadHeaderTimeout = time.Second * 10
+	httpReadTimeout       = gatewayMaxWait + time.Minute
+)
+
 // Server represents a gearman server instance
 type Server struct {
 	cfg                *Config
 	logger             *log.Logger
 	queue              queue
-	jobHandleGenerator *gearman.IDGenerator
+	jobHandleGenerator HandleGenerator
 	clientIDGenerator  *gearman.IDGenerator
 	logf               *os.File
 	handlersMng        *serverMessageHandlerManager
@@ -26,10 +44,18 @@ type Server struct {
 	connManager        *gearman.ConnManager
 	sleepManager       *sleepManager
 	admin              *admin
+	mu                 sync.Mutex
+	listeners          []*listener
+	results            resultStore
+	metrics            *metrics
+	httpServers        []*http.Server
+	shuttingDown       bool
+	shutdownDone       chan struct{}
 }
 
 func (s *Server) initHandlerManager() {
 	s.handlersMng = newServerHandlerManager(s.cfg.RequestTimeout)
+	s.handlersMng.metrics = s.metrics
 	echoHandler := &echoHandler{}
 	submitJobHandler := &submitJobHandler{
 		s.jobHandleGenerator,
@@ -38,11 +64,13 @@ func (s *Server) initHandlerManager() {
 		s.connManager,
 	}
 	canDoHandler := &canDoHandler{}
-	grabJobHandler := &grabJobHandler{s.jobsManager}
+	grabJobHandler := &grabJobHandler{s.jobsManager, s.sleepManager}
 	workStatusHandler := &workStatusHandler{s.jobsManager, s.connManager}
+	getStatusHandler := &getStatusHandler{s.jobsManager}
 	sleepHandler := &sleepHandler{s.sleepManager}
 	optionHandler := &optionHandler{}
 	setClientIDHandler := &setClientIDHandler{}
+	allYoursHandler := &allYoursHandler{}
 
 	handlers := []serverMessageHandler{
 		echoHandler,
@@ -50,9 +78,11 @@ func (s *Server) initHandlerManager() {
 		canDoHandler,
 		grabJobHandler,
 		workStatusHandler,
+		getStatusHandler,
 		sleepHandler,
 		optionHandler,
 		setClientIDHandler,
+		allYoursHandler,
 	}
 
 	registeredTypes := make(map[gearman.PacketType]serverMessageHandler)
@@ -70,6 +100,10 @@ func (s *Server) initHandlerManager() {
 }
 
 func NewServer(cfg *Config) (*Server, error) {
+	policy, err := newDispatchPolicy(cfg.DispatchPolicy, cfg.FunctionWeights)
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(cfg.LogFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		log.Printf("failed to open log file: %s", err)
@@ -83,7 +117,9 @@ func NewServer(cfg *Config) (*Server, error) {
 	var queue queue
 	switch cfg.QueueType {
 	case QueueSQL:
-		queue, err = newSQLQueue(cfg.QueueDriver, cfg.QueueDataSource, cfg.QueueTableName)
+		queue, err = newSQLQueue(cfg.QueueDriver, cfg.QueueDataSource, cfg.QueueTableName, policy)
+	case QueueMemory:
+		queue = newMemoryQueue(policy)
 	default:
 		err = errUnknownQueueType
 	}
@@ -91,49 +127,289 @@ func NewServer(cfg *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	results, err := newResultStore(cfg, queue)
+	if err != nil {
+		queue.dispose()
+		return nil, err
+	}
 
 	connManager := gearman.NewConnManager()
+	jobsManager := newjobsManager(logger, queue, cfg)
+	jobsManager.metrics = newMetrics()
+	jobsManager.results = results
+	handleGen := cfg.HandleGenerator
+	if handleGen == nil {
+		handleGen = newDefaultHandleGenerator()
+	}
 	s := &Server{
 		cfg:                cfg,
 		logger:             logger,
 		logf:               f,
 		queue:              queue,
-		jobHandleGenerator: gearman.NewIDGenerator(),
+		jobHandleGenerator: handleGen,
 		clientIDGenerator:  gearman.NewIDGenerator(),
-		jobsManager:        newjobsManager(logger, queue, cfg),
+		jobsManager:        jobsManager,
 		connManager:        connManager,
 		sleepManager:       newSleepManager(),
-		admin:              new(admin),
+		metrics:            jobsManager.metrics,
+		results:            results,
+	}
+	jobsManager.wakeUpWorkers = func(function string) {
+		s.sleepManager.wakeUp(connManager, function)
+	}
+	jobsManager.startScheduler()
+	s.admin = &admin{
+		connManager: connManager,
+		jobsManager: jobsManager,
+		cfg:         cfg,
+		results:     results,
+		shutdown:    s.shutdown,
 	}
 	s.initHandlerManager()
 	return s, nil
 }
 
-// Run runs the gearman server
+// Run runs the gearman server, it accepts connections on all the listeners concurrently
 func (s *Server) Run() error {
 	defer func() {
 		if s.logf != nil {
 			s.logf.Close()
 		}
 	}()
-	listener, err := net.Listen("tcp", s.cfg.BindAddr)
-	if err != nil {
-		s.logger.Printf("failed to listen server connection:%s", err)
-		return err
+	var listeners []*listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, cfg := range s.cfg.listeners() {
+		l, err := listen(cfg)
+		if err != nil {
+			s.logger.Printf("failed to listen server connection on %s:%s", cfg.Addr, err)
+			return err
+		}
+		listeners = append(listeners, l)
 	}
+	muxes := s.httpMuxes()
+	httpListeners := make([]net.Listener, 0, len(muxes))
+	httpServers := make([]*http.Server, 0, len(muxes))
 	defer func() {
-		listener.Close()
+		for _, l := range httpListeners {
+			l.Close()
+		}
 	}()
+	for addr, mux := range muxes {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.logger.Printf("failed to listen HTTP on %s:%s", addr, err)
+			return err
+		}
+		httpListeners = append(httpListeners, l)
+		httpServers = append(httpServers, &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			ReadTimeout:       httpReadTimeout,
+		})
+	}
+	s.mu.Lock()
+	s.listeners = listeners
+	s.httpServers = httpServers
+	if s.shuttingDown {
+		// Shutdown was called before listening
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, l := range httpListeners {
+			l.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	errCh := make(chan error, len(listeners)+len(httpServers))
+	for _, l := range listeners {
+		go func(l *listener) {
+			errCh <- s.accept(l)
+		}(l)
+	}
+	for i, httpServer := range httpServers {
+		go func(httpServer *http.Server, l net.Listener) {
+			errCh <- httpServer.Serve(l)
+		}(httpServer, httpListeners[i])
+	}
+	err := <-errCh
+	shuttingDown, shutdownDone := s.shutdownState()
+	if !shuttingDown {
+		return err
+	}
+	<-shutdownDone
+	return nil
+}
+
+// httpMuxes returns the HTTP handlers by the address to listen on
+func (s *Server) httpMuxes() map[string]*http.ServeMux {
+	muxes := make(map[string]*http.ServeMux)
+	muxOf := func(addr string) *http.ServeMux {
+		mux, ok := muxes[addr]
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[addr] = mux
+		}
+		return mux
+	}
+	if s.cfg.MetricsAddr != "" {
+		muxOf(s.cfg.MetricsAddr).HandleFunc("/metrics", s.handleMetrics)
+	}
+	if s.cfg.GatewayAddr != "" {
+		muxOf(s.cfg.GatewayAddr).Handle("/jobs/", s.newGateway())
+	}
+	return muxes
+}
+
+// accept accepts the connections of the listener until it's closed
+func (s *Server) accept(l *listener) error {
 	for {
-		netConn, err := listener.Accept()
+		netConn, err := l.Accept()
 		if err != nil {
 			return err
 		}
-		conn := newServerConn(gearman.NewNetConn(netConn, s.clientIDGenerator.Generate()))
+		fd := fdOf(netConn)
+		if l.tlsCfg != nil {
+			// the handshake is done on the first read in the serving goroutine
+			netConn = tls.Server(netConn, l.tlsCfg)
+		}
+		gconn := gearman.NewNetConn(netConn, s.clientIDGenerator.Generate())
+		gconn.SetMaxBodySize(s.cfg.MaxBodySize)
+		gconn.SetIdleTimeout(s.cfg.IdleTimeout)
+		conn := newServerConn(gconn)
+		conn.fd = fd
+		conn.remoteAddr = hostOf(netConn.RemoteAddr())
+		conn.adminOnly = l.cfg.AdminOnly
 		go s.serve(conn)
 	}
 }
 
+// Shutdown stops accepting new connections, submissions and handing out jobs,
+// waits the dispatched jobs done until ctx is done, closes the connections, then disposes the queue.
+// The submissions get a shutting_down ERROR, and the jobs whose dispatch ends are not requeued but failed.
+// Run returns after Shutdown finished, it's safe to call Shutdown more than once
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		shutdownDone := s.shutdownDone
+		s.mu.Unlock()
+		select {
+		case <-shutdownDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.shuttingDown = true
+	s.shutdownDone = make(chan struct{})
+	defer close(s.shutdownDone)
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, httpServer := range s.httpServers {
+		httpServer.Close()
+	}
+	s.mu.Unlock()
+
+	s.jobsManager.drain()
+	err := s.waitJobsDone(ctx)
+	if err != nil {
+		s.logger.Printf("%d dispatched jobs are not done before shutdown: %s",
+			s.jobsManager.activeJobCount(), err)
+	}
+	// the jobs of the closed workers fail instead of being requeued, wait them to be removed
+	for _, c := range s.connManager.Conns() {
+		c.Close()
+	}
+	closeCtx, cancel := context.WithTimeout(context.Background(), connsCloseTimeout)
+	if closeErr := s.waitJobsDone(closeCtx); closeErr != nil {
+		s.logger.Printf("%d dispatched jobs are not ended after the connections closed", s.jobsManager.activeJobCount())
+	}
+	cancel()
+	s.jobsManager.stop()
+	if disposeErr := s.queue.dispose(); disposeErr != nil {
+		s.logger.Printf("failed to dispose the queue: %s", disposeErr)
+		if err == nil {
+			err = disposeErr
+		}
+	}
+	if s.results != nil {
+		if disposeErr := s.results.dispose(); disposeErr != nil {
+			s.logger.Printf("failed to dispose the result store: %s", disposeErr)
+			if err == nil {
+				err = disposeErr
+			}
+		}
+	}
+	s.logger.Printf("server shutdown")
+	return err
+}
+
+// shutdown is called by the admin command "shutdown"
+// the dispatched jobs are not waited if not graceful
+func (s *Server) shutdown(graceful bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !graceful {
+		cancel()
+	}
+	go func() {
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+}
+
+func (s *Server) shutdownState() (shuttingDown bool, shutdownDone <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown, s.shutdownDone
+}
+
+func (s *Server) waitJobsDone(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for s.jobsManager.activeJobCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// fdOf returns the file descriptor of the connection, -1 if not available
+func fdOf(c net.Conn) int {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	rc.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	return fd
+}
+
+// hostOf returns the host part of the address, or the address itself if it has no port
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func (s *Server) handleRequest(conn *conn) bool {
 	msg, txtMsg, err := conn.ReadMsg()
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -141,11 +417,30 @@ func (s *Server) handleRequest(conn *conn) bool {
 			s.logger.Printf("client closed: %s", conn)
 		}
 		return true
-	} else if err != nil {
+	} else if err == gearman.ErrBodyTooLarge {
+		s.logger.Printf("read packet failed from %s: %s", conn, err)
+		s.writeError(conn, &serverError{errCodeBodyTooLarge, err})
+		return false
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return s.idle(conn)
+	} else if err == gearman.ErrMessageTimeout {
+		s.logger.Printf("reaped %s, stalled in the middle of a packet", conn)
+		s.metrics.connReaped()
+		return true
+	} else if gearman.IsMalformed(err) {
+		// the malformed packet is drained, keep reading the next one
 		s.logger.Printf("read packet failed from %s: %s", conn, err)
 		return false
+	} else if err != nil {
+		// the connection is broken, e.g. the TLS handshake failed
+		s.logger.Printf("read packet failed from %s: %s", conn, err)
+		return true
 	}
-	if msg != nil {
+	conn.probed = false
+	if msg != nil && conn.adminOnly {
+		s.writeError(conn, &serverError{errCodeAdminOnly, errAdminOnly})
+		gearman.MsgPool.Put(msg)
+	} else if msg != nil {
 		recyclable, err := s.handlersMng.handleMessage(msg, conn)
 		defer func() {
 			if recyclable {
@@ -155,12 +450,7 @@ func (s *Server) handleRequest(conn *conn) bool {
 		if err != nil {
 			s.logger.Printf("failed to process message %s for %s: %s", msg, conn, err)
 			if serverErr, ok := err.(*serverError); ok {
-				errMsg := gearman.MsgPool.Get()
-				errMsg.MagicType = gearman.MagicRes
-				errMsg.PacketType = gearman.ERROR
-				errMsg.Arguments = serverErr.toArguments()
-				conn.WriteMsg(errMsg)
-				gearman.MsgPool.Put(errMsg)
+				s.writeError(conn, serverErr)
 			}
 		} else if s.cfg.Verbose {
 			s.logger.Printf("processed message %s for %s", msg, conn)
@@ -171,9 +461,49 @@ func (s *Server) handleRequest(conn *conn) bool {
 	return false
 }
 
+// idle handles the idle timeout of the connection, true is returned if the connection should be reaped
+// only a sleeping worker is probed, with NOOP, a live one wakes up and sends GRAB_JOB,
+// the peer is reaped if nothing arrives in another idle timeout after the probe
+// the other connections are kept: the workers running a job and the clients waiting for one
+// may not send anything for long, and the other libraries don't expect any packet but the responses,
+// a dead peer of them is detected by the TCP keepalive of the listener or fails the writes on the write timeout
+func (s *Server) idle(conn *conn) bool {
+	if s.cfg.IdleTimeout <= 0 {
+		return false
+	}
+	if conn.probed {
+		s.logger.Printf("reaped %s, no answer to the probe", conn)
+		s.metrics.connReaped()
+		return true
+	}
+	if !s.sleepManager.isSleeping(conn.ID()) {
+		return false
+	}
+	if s.cfg.Verbose {
+		s.logger.Printf("probing the idle worker %s with NOOP", conn)
+	}
+	if err := conn.WriteMsg(noopMsg); err != nil {
+		s.logger.Printf("reaped %s, failed to probe: %s", conn, err)
+		s.metrics.connReaped()
+		return true
+	}
+	conn.probed = true
+	return false
+}
+
+func (s *Server) writeError(conn *conn, serverErr *serverError) {
+	errMsg := gearman.MsgPool.Get()
+	defer gearman.MsgPool.Put(errMsg)
+	errMsg.MagicType = gearman.MagicRes
+	errMsg.PacketType = gearman.ERROR
+	errMsg.Arguments = serverErr.toArguments()
+	conn.WriteMsg(errMsg)
+}
+
 func (s *Server) serve(conn *conn) {
 	defer func() {
 		s.connManager.RemoveConn(conn.ID())
+		s.sleepManager.removeSleepWorker(conn.ID())
 		conn.Close()
 	}()
 	if s.cfg.Verbose {
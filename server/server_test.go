@@ -1,10 +1,17 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	gearman "github.com/peonone/gearman"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +31,7 @@ func TestServe(t *testing.T) {
 		clientIDGenerator:  testIdGen,
 		handlersMng:        newServerHandlerManager(0),
 		connManager:        gearman.NewConnManager(),
+		sleepManager:       newSleepManager(),
 	}
 	submitHandler := &MockHandler{}
 	echoHandler := &MockHandler{}
@@ -68,3 +76,472 @@ func TestServe(t *testing.T) {
 	assert.Equal(t, gearman.ERROR, sentMsg.PacketType)
 	assert.Equal(t, []string{serverErr.code, serverErr.err.Error()}, sentMsg.Arguments)
 }
+
+// makeServerForTest creates a server with a sqlite3 queue in a temp dir
+// the connections are served by s.serve directly instead of a listener
+func makeServerForTest(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	q, err := newSQLQueue(QueueSqlite3Driver, filepath.Join(dir, "test.db"), "queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	cfg := &Config{}
+	jobsManager := newjobsManager(testLogger, q, cfg)
+	jobsManager.metrics = newMetrics()
+	s := &Server{
+		cfg:                cfg,
+		logger:             testLogger,
+		queue:              q,
+		jobHandleGenerator: testIdGen,
+		clientIDGenerator:  testIdGen,
+		jobsManager:        jobsManager,
+		connManager:        gearman.NewConnManager(),
+		sleepManager:       newSleepManager(),
+		metrics:            jobsManager.metrics,
+	}
+	s.initHandlerManager()
+	return s, func() {
+		jobsManager.stop()
+		q.dispose()
+		os.RemoveAll(dir)
+	}
+}
+
+// serveForTest serves a mock connection in a new goroutine
+func serveForTest(s *Server) *mockConn {
+	conn := newMockSConn(10, 10)
+	conn.Timeout = time.Minute
+	go s.serve(conn.srvConn)
+	return conn
+}
+
+// request sends a request to the server and returns the response
+func request(t *testing.T, conn *mockConn, packet gearman.PacketType, args ...string) *gearman.Message {
+	conn.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: packet,
+		Arguments:  args,
+	}
+	select {
+	case msg := <-conn.WriteCh:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("no response for %s", packet)
+		return nil
+	}
+}
+
+func TestServeGetStatus(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	client := serveForTest(s)
+	worker := serveForTest(s)
+	defer close(client.ReadCh)
+	defer close(worker.ReadCh)
+
+	handles := make(map[string]string)
+	for _, uniqueID := range []string{"job1", "job2"} {
+		resp := request(t, client, gearman.SUBMIT_JOB_BG, "echo", uniqueID, "hello")
+		assert.Equal(t, gearman.JOB_CREATED, resp.PacketType)
+		handles[uniqueID] = resp.Arguments[0]
+	}
+
+	// queued
+	resp := request(t, client, gearman.GET_STATUS, handles["job1"])
+	assert.Equal(t, gearman.STATUS_RES, resp.PacketType)
+	assert.Equal(t, []string{handles["job1"], "1", "0", "0", "0"}, resp.Arguments)
+	resp = request(t, client, gearman.GET_STATUS_UNIQUE, "job2")
+	assert.Equal(t, gearman.STATUS_RES_UNIQUE, resp.PacketType)
+	assert.Equal(t, []string{"job2", "1", "0", "0", "0", "0"}, resp.Arguments)
+
+	// running
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+	resp = request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+	runningHandle := resp.Arguments[0]
+	queuedUniqueID := "job1"
+	if runningHandle == handles["job1"] {
+		queuedUniqueID = "job2"
+	}
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_STATUS,
+		Arguments:  []string{runningHandle, "3", "10"},
+	}
+	// the echo response ensures WORK_STATUS is processed
+	resp = request(t, worker, gearman.ECHO_REQ, "ping")
+	assert.Equal(t, gearman.ECHO_RES, resp.PacketType)
+
+	resp = request(t, client, gearman.GET_STATUS, runningHandle)
+	assert.Equal(t, []string{runningHandle, "1", "1", "3", "10"}, resp.Arguments)
+	resp = request(t, client, gearman.GET_STATUS_UNIQUE, queuedUniqueID)
+	assert.Equal(t, []string{queuedUniqueID, "1", "0", "0", "0", "0"}, resp.Arguments)
+
+	// unknown
+	unknownHandle := testIdGen.Generate().String()
+	resp = request(t, client, gearman.GET_STATUS, unknownHandle)
+	assert.Equal(t, []string{unknownHandle, "0", "0", "0", "0"}, resp.Arguments)
+	resp = request(t, client, gearman.GET_STATUS, "H:unknown:1")
+	assert.Equal(t, []string{"H:unknown:1", "0", "0", "0", "0"}, resp.Arguments)
+	resp = request(t, client, gearman.GET_STATUS_UNIQUE, "unknown")
+	assert.Equal(t, gearman.STATUS_RES_UNIQUE, resp.PacketType)
+	assert.Equal(t, []string{"unknown", "0", "0", "0", "0", "0"}, resp.Arguments)
+
+	// completed
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{runningHandle, "hello"},
+	}
+	resp = request(t, worker, gearman.ECHO_REQ, "ping")
+	assert.Equal(t, gearman.ECHO_RES, resp.PacketType)
+	resp = request(t, client, gearman.GET_STATUS, runningHandle)
+	assert.Equal(t, []string{runningHandle, "0", "0", "0", "0"}, resp.Arguments)
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	s.cfg.BindAddr = "127.0.0.1:0"
+	s.cfg.JobRetries = 1
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run()
+	}()
+
+	// the connections are closed by Shutdown
+	client := serveForTest(s)
+	worker := serveForTest(s)
+	for _, uniqueID := range []string{"job1", "job2"} {
+		resp := request(t, client, gearman.SUBMIT_JOB_BG, "echo", uniqueID, "hello")
+		assert.Equal(t, gearman.JOB_CREATED, resp.PacketType)
+	}
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+	resp := request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(timeoutCtx))
+	select {
+	case err := <-runErr:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after shutdown")
+	}
+	assert.Nil(t, s.Shutdown(context.Background()))
+
+	for _, c := range []*mockConn{client, worker} {
+		select {
+		case <-c.Closed():
+		default:
+			t.Fatal("the connection is not closed by shutdown")
+		}
+	}
+	// the job of the closed worker failed instead of being requeued to the closed queue
+	assert.Equal(t, 0, s.jobsManager.activeJobCount())
+	var metricsBuf bytes.Buffer
+	s.metrics.write(&metricsBuf)
+	assert.Contains(t, metricsBuf.String(), `gearman_jobs_failed_total{function="echo"} 1`+"\n")
+}
+
+func TestServerShutdownWaitsJobs(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	client := serveForTest(s)
+	worker := serveForTest(s)
+	resp := request(t, client, gearman.SUBMIT_JOB_BG, "echo", "job1", "hello")
+	assert.Equal(t, gearman.JOB_CREATED, resp.PacketType)
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.CAN_DO,
+		Arguments:  []string{"echo"},
+	}
+	resp = request(t, worker, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the dispatched job done")
+	case <-time.After(time.Millisecond * 150):
+	}
+	// no more submissions are accepted
+	errResp := request(t, client, gearman.SUBMIT_JOB_BG, "echo", "job2", "hello")
+	assert.Equal(t, gearman.ERROR, errResp.PacketType)
+	assert.Equal(t, errCodeShuttingDown, errResp.Arguments[0])
+
+	worker.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{resp.Arguments[0], "hello"},
+	}
+	select {
+	case err := <-shutdownErr:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Shutdown didn't return after the dispatched job done")
+	}
+}
+
+func TestServeMalformedPacket(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	srvSide, peer := net.Pipe()
+	defer peer.Close()
+	go s.serve(newServerConn(gearman.NewNetConn(srvSide, testIdGen.Generate())))
+
+	// a packet of an unknown type is drained, and the connection is kept
+	echo := &gearman.Message{MagicType: gearman.MagicReq, PacketType: gearman.ECHO_REQ, Arguments: []string{"ping"}}
+	go func() {
+		peer.Write([]byte("\x00REQ\x00\x00\x03\xe7\x00\x00\x00\x03abc"))
+		echo.WriteTo(peer)
+	}()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	resp, _, err := gearman.NextMessage(bufio.NewReader(peer))
+	assert.Nil(t, err)
+	assert.Equal(t, gearman.ECHO_RES, resp.PacketType)
+	assert.Equal(t, []string{"ping"}, resp.Arguments)
+}
+
+func TestServeStalledPacket(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	s.cfg.IdleTimeout = time.Millisecond * 20
+	srvSide, peer := net.Pipe()
+	defer peer.Close()
+	gconn := gearman.NewNetConn(srvSide, testIdGen.Generate())
+	gconn.SetIdleTimeout(s.cfg.IdleTimeout)
+	served := make(chan struct{})
+	go func() {
+		s.serve(newServerConn(gconn))
+		close(served)
+	}()
+
+	// the peer stalls in the middle of a packet, it's reaped
+	go peer.Write([]byte("\x00REQ\x00\x00"))
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("the stalled connection is not reaped")
+	}
+	var metricsBuf bytes.Buffer
+	s.metrics.write(&metricsBuf)
+	assert.Contains(t, metricsBuf.String(), "gearman_connections_reaped_total 1\n")
+}
+
+func TestServerReapIdleConns(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	s.cfg.IdleTimeout = time.Millisecond * 20
+
+	newIdleConn := func() *mockConn {
+		c := newMockSConn(10, 10)
+		c.Timeout = s.cfg.IdleTimeout
+		go s.serve(c.srvConn)
+		return c
+	}
+	canDo := func(worker *mockConn) {
+		worker.ReadCh <- &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: gearman.CAN_DO,
+			Arguments:  []string{"echo"},
+		}
+	}
+
+	// neither the worker running a job longer than the idle timeout nor the client waiting for it is probed
+	waiting := newIdleConn()
+	defer close(waiting.ReadCh)
+	resp := request(t, waiting, gearman.SUBMIT_JOB, "echo", "job1", "hello")
+	assert.Equal(t, gearman.JOB_CREATED, resp.PacketType)
+	busy := newIdleConn()
+	defer close(busy.ReadCh)
+	canDo(busy)
+	resp = request(t, busy, gearman.GRAB_JOB)
+	assert.Equal(t, gearman.JOB_ASSIGN, resp.PacketType)
+	select {
+	case msg := <-busy.WriteCh:
+		t.Fatalf("the busy worker is sent %s", msg)
+	case msg := <-waiting.WriteCh:
+		t.Fatalf("the waiting client is sent %s", msg)
+	case <-time.After(s.cfg.IdleTimeout * 10):
+	}
+	assert.NotNil(t, s.connManager.GetConn(busy.ID()))
+	assert.NotNil(t, s.connManager.GetConn(waiting.ID()))
+	busy.ReadCh <- &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{resp.Arguments[0], "olleh"},
+	}
+	select {
+	case msg := <-waiting.WriteCh:
+		assert.Equal(t, gearman.WORK_COMPLETE, msg.PacketType)
+	case <-time.After(time.Second):
+		t.Fatal("no WORK_COMPLETE for the waiting client")
+	}
+
+	// the dead sleeping worker is reaped
+	sleeping := newIdleConn()
+	canDo(sleeping)
+	sleeping.ReadCh <- &gearman.Message{MagicType: gearman.MagicReq, PacketType: gearman.PRE_SLEEP}
+	select {
+	case msg := <-sleeping.WriteCh:
+		assert.Equal(t, gearman.NOOP, msg.PacketType)
+	case <-time.After(time.Second):
+		t.Fatal("no NOOP probe")
+	}
+	select {
+	case <-sleeping.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("the dead worker is not reaped")
+	}
+	for s.connManager.GetConn(sleeping.ID()) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, s.sleepManager.isSleeping(sleeping.ID()))
+
+	// the live sleeping worker answers the NOOP probes
+	live := newIdleConn()
+	defer close(live.ReadCh)
+	canDo(live)
+	live.ReadCh <- &gearman.Message{MagicType: gearman.MagicReq, PacketType: gearman.PRE_SLEEP}
+	deadline := time.After(time.Millisecond * 150)
+	var noops int
+	for done := false; !done; {
+		select {
+		case msg := <-live.WriteCh:
+			switch msg.PacketType {
+			case gearman.NOOP:
+				noops++
+				live.ReadCh <- &gearman.Message{MagicType: gearman.MagicReq, PacketType: gearman.GRAB_JOB}
+			case gearman.NO_JOB:
+				live.ReadCh <- &gearman.Message{MagicType: gearman.MagicReq, PacketType: gearman.PRE_SLEEP}
+			}
+		case <-deadline:
+			done = true
+		}
+	}
+	assert.True(t, noops > 0)
+	assert.NotNil(t, s.connManager.GetConn(live.ID()))
+	assert.NotNil(t, s.connManager.GetConn(busy.ID()))
+	var metricsBuf bytes.Buffer
+	s.metrics.write(&metricsBuf)
+	assert.Contains(t, metricsBuf.String(), "gearman_connections_reaped_total 1\n")
+}
+
+func TestParseListenAddr(t *testing.T) {
+	cases := []struct {
+		addr, network, address string
+		err                    error
+	}{
+		{":4730", "tcp", ":4730", nil},
+		{"tcp://127.0.0.1:4730", "tcp", "127.0.0.1:4730", nil},
+		{"unix:///var/run/gearmand.sock", "unix", "/var/run/gearmand.sock", nil},
+		{"udp://127.0.0.1:4730", "", "", errUnknownListenerScheme},
+	}
+	for _, c := range cases {
+		network, address, err := parseListenAddr(c.addr)
+		assert.Equal(t, c.err, err, c.addr)
+		assert.Equal(t, c.network, network, c.addr)
+		assert.Equal(t, c.address, address, c.addr)
+	}
+}
+
+func TestParseListenerConfig(t *testing.T) {
+	base := ListenerConfig{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: "ca.pem"}
+	cases := []struct {
+		value    string
+		expected ListenerConfig
+		err      bool
+	}{
+		{"tcp://:4730", ListenerConfig{Addr: "tcp://:4730", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: "ca.pem"}, false},
+		{"unix:///var/run/gearmand.sock?tls=off", ListenerConfig{Addr: "unix:///var/run/gearmand.sock"}, false},
+		{"tcp://:4740?tls-cert=other.pem&tls-key=other.key", ListenerConfig{Addr: "tcp://:4740", TLSCertFile: "other.pem", TLSKeyFile: "other.key"}, false},
+		{"tcp://:4740?tls=on", ListenerConfig{}, true},
+		{"tcp://:4740?tls=off&tls-cert=other.pem", ListenerConfig{}, true},
+		{"tcp://:4740?admin=1", ListenerConfig{}, true},
+		{"tcp://:4740?tls-cert=%zz", ListenerConfig{}, true},
+	}
+	for _, c := range cases {
+		cfg, err := ParseListenerConfig(c.value, base)
+		if c.err {
+			assert.NotNil(t, err, c.value)
+			continue
+		}
+		assert.Nil(t, err, c.value)
+		assert.Equal(t, c.expected, cfg, c.value)
+	}
+	cfg, err := ParseListenerConfig("tcp://:4731", ListenerConfig{AdminOnly: true})
+	assert.Nil(t, err)
+	assert.Equal(t, ListenerConfig{Addr: "tcp://:4731", AdminOnly: true}, cfg)
+}
+
+func TestServerListeners(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "gearman-sock")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "gearmand.sock")
+	s.cfg.Listeners = []ListenerConfig{
+		{Addr: "tcp://127.0.0.1:0"},
+		{Addr: "unix://" + sockPath},
+		{Addr: "127.0.0.1:0", AdminOnly: true},
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run()
+	}()
+	listenAddrForTest(t, s)
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	assert.Equal(t, 3, len(listeners))
+
+	dial := func(network, addr string) gearman.Conn {
+		netConn, err := net.Dial(network, addr)
+		assert.Nil(t, err)
+		return gearman.NewNetConn(netConn, testIdGen.Generate())
+	}
+	echo := &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.ECHO_REQ,
+		Arguments:  []string{"hello"},
+	}
+	for _, l := range listeners[:2] {
+		c := dial(l.Addr().Network(), l.Addr().String())
+		assert.Nil(t, c.WriteMsg(echo))
+		msg, _, err := c.ReadMsg()
+		assert.Nil(t, err)
+		assert.Equal(t, gearman.ECHO_RES, msg.PacketType)
+		assert.Equal(t, []string{"hello"}, msg.Arguments)
+		c.Close()
+	}
+
+	adminConn := dial("tcp", listeners[2].Addr().String())
+	defer adminConn.Close()
+	assert.Nil(t, adminConn.WriteMsg(echo))
+	msg, _, err := adminConn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, gearman.ERROR, msg.PacketType)
+	assert.Equal(t, errCodeAdminOnly, msg.Arguments[0])
+	assert.Nil(t, adminConn.WriteTxtMsg("version\n"))
+	_, txtMsg, err := adminConn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, "OK "+Version, txtMsg)
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Nil(t, <-runErr)
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err))
+}
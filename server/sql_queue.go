@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"sync"
+	"time"
+
+	gearman "github.com/peonone/gearman"
 )
 
 // sqlQueue is a queue implementation with RDBMS
@@ -23,7 +26,7 @@ const QueueSQL = "sql"
 
 var errUnsupportedDialiet = errors.New("Unsupported SQL dialect")
 
-func newSQLQueue(driver string, ds string, table string) (*sqlQueue, error) {
+func newSQLQueue(driver string, ds string, table string, policy *dispatchPolicy) (*sqlQueue, error) {
 	db, err := sql.Open(driver, ds)
 	if err != nil {
 		return nil, err
@@ -34,13 +37,18 @@ func newSQLQueue(driver string, ds string, table string) (*sqlQueue, error) {
 	}
 
 	dialectParam := &sqlQueueDialectParam{
-		table: table,
-		db:    db,
+		table:  table,
+		db:     db,
+		policy: policy,
 	}
 	var dialect sqlQueueDialiect
 	switch driver {
 	case QueueSqlite3Driver:
 		dialect = newSqlite3Dialect(dialectParam)
+	case QueuePostgresDriver:
+		dialect = newPostgresDialect(dialectParam)
+	case QueueMySQLDriver:
+		dialect = newMySQLDialect(dialectParam)
 	default:
 		return nil, errUnsupportedDialiet
 	}
@@ -66,20 +74,18 @@ func (q *sqlQueue) size(ctx context.Context) (int, error) {
 	return q.dialect.querySize(ctx)
 }
 
-func (q *sqlQueue) dequeue(ctx context.Context, functions []string) (j *job, err error) {
+func (q *sqlQueue) dequeue(ctx context.Context, functions []string) (*job, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	j, err = q.dialect.peekJob(ctx, functions)
-	if err != nil {
-		return nil, err
-	}
-	if j != nil {
-		err = q.dialect.deleteByhandle(ctx, j.handle.String())
-		if err != nil {
-			return nil, err
-		}
-	}
-	return
+	return q.dialect.popJob(ctx, functions)
+}
+
+func (q *sqlQueue) remove(ctx context.Context, handle *gearman.ID) (bool, error) {
+	return q.dialect.removeJob(ctx, handle.String())
+}
+
+func (q *sqlQueue) nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error) {
+	return q.dialect.nextDelayed(ctx, after)
 }
 
 func (q *sqlQueue) dispose() error {
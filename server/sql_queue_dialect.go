@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	gearman "github.com/peonone/gearman"
 )
@@ -15,34 +18,67 @@ import (
 // the concrete implementation can just use the instance of sqlQueueDialiectSimple or nest it
 
 var (
-	queueCreateTableTmpl = `
-	CREATE TABLE %s
-	(
-		function VARCHAR(32),
-		handle VARCHAR(32), 
-		unique_id VARCHAR(32),
-		priority SMALLINT,
-		data BIT VARYING(64),
-		reducer VARCHAR(64),
-		PRIMARY KEY (handle)
-	);
-	CREATE INDEX idx_queue_priority ON %s (priority);
-	CREATE INDEX idx_queue_function ON %s (function);
-	CREATE INDEX idx_unique_id ON %s (unique_id);
-	`
+	// ansiCreateTableTmpls are executed one by one as some drivers don't support multiple statements
+	ansiCreateTableTmpls = []string{
+		`CREATE TABLE %[1]s
+		(
+			function VARCHAR(32),
+			handle VARCHAR(64), 
+			unique_id VARCHAR(32),
+			priority SMALLINT,
+			data BLOB,
+			reducer VARCHAR(64),
+			not_before BIGINT NOT NULL DEFAULT 0,
+			enqueued_at BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (handle)
+		)`,
+		`CREATE INDEX idx_%[1]s_priority ON %[1]s (priority)`,
+		`CREATE INDEX idx_%[1]s_enqueued_at ON %[1]s (enqueued_at)`,
+		`CREATE INDEX idx_%[1]s_function ON %[1]s (function)`,
+		`CREATE INDEX idx_%[1]s_unique_id ON %[1]s (unique_id)`,
+	}
+
+	ansiTableExistsQuery = "SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1"
+
+	// queueMigrations are the columns missing in the queue tables created by the older versions,
+	// they're added at startup along with the index if it's not empty
+	queueMigrations = []struct {
+		column     string
+		definition string
+		indexTmpl  string
+	}{
+		{"not_before", "BIGINT NOT NULL DEFAULT 0", ""},
+		{"enqueued_at", "BIGINT NOT NULL DEFAULT 0", `CREATE INDEX idx_%[1]s_enqueued_at ON %[1]s (enqueued_at)`},
+	}
+
+	queueColumnProbeTmpl = "SELECT %s FROM %s WHERE 1 = 0"
+
+	queueAddColumnTmpl = "ALTER TABLE %s ADD COLUMN %s %s"
 
 	queueInsertTmpl = `
 	INSERT INTO %s 
-	(function, handle, unique_id, priority, data, reducer)
-	VALUES($1, $2, $3, $4, $5, $6)
+	(function, handle, unique_id, priority, data, reducer, not_before, enqueued_at)
+	VALUES(%s)
 	`
 
+	queuePeekTmpl = `SELECT 
+		function, handle, unique_id, priority, data, reducer, not_before
+		FROM %s 
+		WHERE function in (%s) AND not_before <= %s
+		order by %s LIMIT 1 %s
+		`
+
+	queueReadyFunctionsTmpl = `SELECT DISTINCT function FROM %s WHERE function in (%s) AND not_before <= %s`
+
+	queueNextDelayedTmpl = `SELECT DISTINCT function, not_before FROM %[1]s
+		WHERE not_before = (SELECT MIN(not_before) FROM %[1]s WHERE not_before > %[2]s)`
+
 	queueCountTmpl = "SELECT COUNT(1) FROM %s"
 
 	queueMaxHandleTmpl = "SELECT MAX(handle) FROM %s"
 
 	queueDeleteTmpl = `
-	DELETE FROM %s WHERE handle=$1
+	DELETE FROM %s WHERE handle=%s
 	`
 
 	queueAppendClientTmpl = `
@@ -53,52 +89,98 @@ var (
 type sqlQueueDialiect interface {
 	createQueueTable() error
 	insertItem(ctx context.Context, j *job) error
-	peekJob(ctx context.Context, functions []string) (*job, error)
+	popJob(ctx context.Context, functions []string) (*job, error)
 	querySize(ctx context.Context) (int, error)
-	deleteByhandle(ctx context.Context, handle string) error
+	removeJob(ctx context.Context, handle string) (bool, error)
+	nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error)
 }
 
 type sqlQueueDialectParam struct {
-	table string
-	db    *sql.DB
+	table  string
+	db     *sql.DB
+	policy *dispatchPolicy
 }
 
 type sqlQueueDialiectSimple struct {
 	param *sqlQueueDialectParam
+	// bindVar returns the placeholder of the i-th(starts from 1) argument
+	bindVar func(i int) string
+	// createTableTmpls are executed one by one to create the table and the indexes,
+	// the table name is formatted into them
+	createTableTmpls []string
+	// tableExistsQuery counts the tables with the name of the first argument
+	tableExistsQuery string
+	// lockClause is appended to the query selecting the job to dequeue
+	lockClause string
+	// lastEnqueued is the last enqueued_at in nanoseconds, to keep the enqueue order of the jobs inserted by the process
+	lastEnqueued int64
+	mu           sync.Mutex
 }
 
-func (ds *sqlQueueDialiectSimple) hasQueueTable() bool {
-	// TODO need a better way to check if table exists
-	query := fmt.Sprintf("SELECT 1 FROM %s", ds.param.table)
-	_, err := ds.param.db.Exec(query)
+func newSQLQueueDialectSimple(param *sqlQueueDialectParam) *sqlQueueDialiectSimple {
+	return &sqlQueueDialiectSimple{
+		param:            param,
+		bindVar:          dollarBindVar,
+		createTableTmpls: ansiCreateTableTmpls,
+		tableExistsQuery: ansiTableExistsQuery,
+	}
+}
+
+// dollarBindVar returns the placeholders like $1
+func dollarBindVar(i int) string {
+	return "$" + strconv.Itoa(i)
+}
+
+func (ds *sqlQueueDialiectSimple) hasQueueTable() (bool, error) {
+	var cnt int
+	err := ds.param.db.QueryRow(ds.tableExistsQuery, ds.param.table).Scan(&cnt)
 	if err != nil {
-		return false
+		return false, err
 	}
-	return true
+	return cnt > 0, nil
 }
 
+// createQueueTable creates the table if not exists, or adds the columns missing in the existing one
 func (ds *sqlQueueDialiectSimple) createQueueTable() error {
-	if ds.hasQueueTable() {
-		return nil
+	exists, err := ds.hasQueueTable()
+	if err != nil {
+		return err
 	}
-	query := fmt.Sprintf(queueCreateTableTmpl,
-		ds.param.table, ds.param.table, ds.param.table, ds.param.table)
-	_, err := ds.param.db.Exec(query)
-	return err
+	if exists {
+		return ds.migrateQueueTable()
+	}
+	for _, tmpl := range ds.createTableTmpls {
+		_, err = ds.param.db.Exec(fmt.Sprintf(tmpl, ds.param.table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (ds *sqlQueueDialiectSimple) peekJob(ctx context.Context, functions []string) (j *job, err error) {
-	query := fmt.Sprintf(`SELECT 
-		function, handle, unique_id, priority, data, reducer
-		FROM %s 
-		WHERE function in (?%s)
-		order by priority LIMIT 1
-		`, ds.param.table, strings.Repeat(",?", len(functions)-1))
-
-	args := make([]interface{}, len(functions))
-	for i, f := range functions {
-		args[i] = f
+// migrateQueueTable adds the missing columns, a column is missing if it can't be selected
+func (ds *sqlQueueDialiectSimple) migrateQueueTable() error {
+	for _, m := range queueMigrations {
+		rows, err := ds.param.db.Query(fmt.Sprintf(queueColumnProbeTmpl, m.column, ds.param.table))
+		if err == nil {
+			rows.Close()
+			continue
+		}
+		_, err = ds.param.db.Exec(fmt.Sprintf(queueAddColumnTmpl, ds.param.table, m.column, m.definition))
+		if err != nil {
+			return err
+		}
+		if m.indexTmpl != "" {
+			if _, err = ds.param.db.Exec(fmt.Sprintf(m.indexTmpl, ds.param.table)); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// popJob selects the job of the functions by the dispatch policy and deletes it in one transaction
+func (ds *sqlQueueDialiectSimple) popJob(ctx context.Context, functions []string) (j *job, err error) {
 	tx, err := ds.param.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
@@ -110,18 +192,108 @@ func (ds *sqlQueueDialiectSimple) peekJob(ctx context.Context, functions []strin
 			err = tx.Commit()
 		}
 	}()
-	rows, err := tx.QueryContext(ctx, query, args...)
+	if ds.param.policy.roundRobin() {
+		j, err = ds.peekRoundRobin(ctx, tx, functions)
+	} else {
+		j, err = ds.peekJob(ctx, tx, functions)
+	}
+	if err != nil || j == nil {
+		return nil, err
+	}
+	err = ds.deleteByhandle(ctx, tx, j.handle.String())
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// functionBindVars returns the placeholders of the functions, and the one of the current time after them
+func (ds *sqlQueueDialiectSimple) functionBindVars(functions []string) (string, string) {
+	bindVars := make([]string, len(functions))
+	for i := range functions {
+		bindVars[i] = ds.bindVar(i + 1)
+	}
+	return strings.Join(bindVars, ","), ds.bindVar(len(functions) + 1)
+}
+
+// functionArgs returns the arguments of the functions and the current time
+func functionArgs(functions []string) []interface{} {
+	args := make([]interface{}, len(functions), len(functions)+1)
+	for i, f := range functions {
+		args[i] = f
+	}
+	return append(args, time.Now().Unix())
+}
+
+func (ds *sqlQueueDialiectSimple) peekQuery(functions []string) string {
+	orderBy := "enqueued_at"
+	if ds.param.policy.byPriority() {
+		orderBy = "priority, enqueued_at"
+	}
+	functionVars, nowVar := ds.functionBindVars(functions)
+	return fmt.Sprintf(queuePeekTmpl, ds.param.table, functionVars, nowVar, orderBy, ds.lockClause)
+}
+
+// peekRoundRobin picks one of the functions with due jobs by the dispatch policy and peeks its job,
+// another function is picked if the jobs of the picked one are taken by another server in the meantime
+func (ds *sqlQueueDialiectSimple) peekRoundRobin(ctx context.Context, tx *sql.Tx, functions []string) (*job, error) {
+	functionVars, nowVar := ds.functionBindVars(functions)
+	query := fmt.Sprintf(queueReadyFunctionsTmpl, ds.param.table, functionVars, nowVar)
+	rows, err := tx.QueryContext(ctx, query, functionArgs(functions)...)
+	if err != nil {
+		return nil, err
+	}
+	readySet := make(map[string]bool)
+	for rows.Next() {
+		var function string
+		if err = rows.Scan(&function); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		readySet[function] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// the functions are picked in the order of the worker's, like the memory queue
+	var ready []string
+	for _, function := range functions {
+		if readySet[function] {
+			ready = append(ready, function)
+			delete(readySet, function)
+		}
+	}
+	for len(ready) > 0 {
+		picked := ds.param.policy.pickFunction(ready)
+		j, err := ds.peekJob(ctx, tx, []string{picked})
+		if err != nil || j != nil {
+			return j, err
+		}
+		for i, function := range ready {
+			if function == picked {
+				ready = append(ready[:i], ready[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (ds *sqlQueueDialiectSimple) peekJob(ctx context.Context, tx *sql.Tx, functions []string) (*job, error) {
+	rows, err := tx.QueryContext(ctx, ds.peekQuery(functions), functionArgs(functions)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		return nil, nil
+		return nil, rows.Err()
 	}
 	var function, handleStr, uniqueID, data, reducer string
 	var priority priority
+	var notBefore int64
 
-	err = rows.Scan(&function, &handleStr, &uniqueID, &priority, &data, &reducer)
+	err = rows.Scan(&function, &handleStr, &uniqueID, &priority, &data, &reducer, &notBefore)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +303,7 @@ func (ds *sqlQueueDialiectSimple) peekJob(ctx context.Context, functions []strin
 		return nil, err
 	}
 
-	j = &job{
+	j := &job{
 		function: function,
 		data:     data,
 		handle:   handle,
@@ -139,7 +311,10 @@ func (ds *sqlQueueDialiectSimple) peekJob(ctx context.Context, functions []strin
 		priority: priority,
 		reducer:  reducer,
 	}
-	return
+	if notBefore > 0 {
+		j.notBefore = time.Unix(notBefore, 0)
+	}
+	return j, nil
 }
 
 func (ds *sqlQueueDialiectSimple) insertItem(ctx context.Context, j *job) (err error) {
@@ -154,14 +329,58 @@ func (ds *sqlQueueDialiectSimple) insertItem(ctx context.Context, j *job) (err e
 			err = tx.Commit()
 		}
 	}()
-	query := fmt.Sprintf(queueInsertTmpl, ds.param.table)
+	bindVars := make([]string, 8)
+	for i := range bindVars {
+		bindVars[i] = ds.bindVar(i + 1)
+	}
+	query := fmt.Sprintf(queueInsertTmpl, ds.param.table, strings.Join(bindVars, ", "))
 
+	var notBefore int64
+	if !j.notBefore.IsZero() {
+		notBefore = j.notBefore.Unix()
+	}
+	// data is stored as binary as it may contain any bytes
 	_, err = tx.ExecContext(ctx, query,
 		j.function, j.handle.String(), j.uniqueID,
-		j.priority, j.data, j.reducer)
+		j.priority, []byte(j.data), j.reducer, notBefore, ds.enqueueTime())
 	return
 }
 
+// enqueueTime returns the enqueued_at of a new job in nanoseconds,
+// it's increased for each job even if the clock doesn't advance
+func (ds *sqlQueueDialiectSimple) enqueueTime() int64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now().UnixNano()
+	if now <= ds.lastEnqueued {
+		now = ds.lastEnqueued + 1
+	}
+	ds.lastEnqueued = now
+	return now
+}
+
+// nextDelayed queries the earliest not_before after the given time and the functions of the jobs due then
+func (ds *sqlQueueDialiectSimple) nextDelayed(ctx context.Context, after time.Time) (time.Time, []string, error) {
+	query := fmt.Sprintf(queueNextDelayedTmpl, ds.param.table, ds.bindVar(1))
+	rows, err := ds.param.db.QueryContext(ctx, query, after.Unix())
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	defer rows.Close()
+	var next time.Time
+	var functions []string
+	for rows.Next() {
+		var function string
+		var notBefore int64
+		if err = rows.Scan(&function, &notBefore); err != nil {
+			return time.Time{}, nil, err
+		}
+		next = time.Unix(notBefore, 0)
+		functions = append(functions, function)
+	}
+	return next, functions, rows.Err()
+}
+
 func (ds *sqlQueueDialiectSimple) querySize(ctx context.Context) (size int, err error) {
 	query := fmt.Sprintf(queueCountTmpl, ds.param.table)
 	tx, err := ds.param.db.BeginTx(ctx, nil)
@@ -183,21 +402,24 @@ func (ds *sqlQueueDialiectSimple) querySize(ctx context.Context) (size int, err
 	return
 }
 
-func (ds *sqlQueueDialiectSimple) deleteByhandle(ctx context.Context, handle string) (err error) {
-	query := fmt.Sprintf(queueDeleteTmpl, ds.param.table)
-	tx, err := ds.param.db.BeginTx(ctx, nil)
+func (ds *sqlQueueDialiectSimple) deleteByhandle(ctx context.Context, tx *sql.Tx, handle string) error {
+	query := fmt.Sprintf(queueDeleteTmpl, ds.param.table, ds.bindVar(1))
+	_, err := tx.ExecContext(ctx, query, handle)
+	return err
+}
+
+// removeJob deletes the job by handle, false is returned if no row is deleted
+func (ds *sqlQueueDialiectSimple) removeJob(ctx context.Context, handle string) (bool, error) {
+	query := fmt.Sprintf(queueDeleteTmpl, ds.param.table, ds.bindVar(1))
+	res, err := ds.param.db.ExecContext(ctx, query, handle)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-		}
-	}()
-	_, err = tx.ExecContext(ctx, query, handle)
-	return
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
 }
 
 func (ds *sqlQueueDialiectSimple) marshalClientIDs(clientIDs []*gearman.ID) (interface{}, error) {
@@ -0,0 +1,45 @@
+package server
+
+// QueueMySQLDriver is the driver name of MySQL, the driver github.com/go-sql-driver/mysql should be imported
+const QueueMySQLDriver = "mysql"
+
+// the indexes are created along with the table as the driver runs one statement at a time
+var mysqlCreateTableTmpls = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s
+	(
+		function VARCHAR(255),
+		handle VARCHAR(64),
+		unique_id VARCHAR(255),
+		priority SMALLINT,
+		data LONGBLOB,
+		reducer VARCHAR(255),
+		not_before BIGINT NOT NULL DEFAULT 0,
+		enqueued_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (handle),
+		INDEX idx_%[1]s_priority (priority),
+		INDEX idx_%[1]s_function (function),
+		INDEX idx_%[1]s_unique_id (unique_id),
+		INDEX idx_%[1]s_not_before (not_before),
+		INDEX idx_%[1]s_enqueued_at (enqueued_at)
+	) ENGINE=InnoDB`,
+}
+
+const mysqlTableExistsQuery = `SELECT COUNT(1) FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = ?`
+
+// newMySQLDialect creates the dialect for MySQL(8.0+) and MariaDB(10.6+)
+// the rows being dequeued are locked and skipped by the others,
+// so multiple servers can share one queue table, the jobs submitted to the others are adopted by grabJob
+func newMySQLDialect(param *sqlQueueDialectParam) sqlQueueDialiect {
+	ds := newSQLQueueDialectSimple(param)
+	ds.bindVar = questionBindVar
+	ds.createTableTmpls = mysqlCreateTableTmpls
+	ds.tableExistsQuery = mysqlTableExistsQuery
+	ds.lockClause = "FOR UPDATE SKIP LOCKED"
+	return ds
+}
+
+// questionBindVar returns the placeholder ?
+func questionBindVar(i int) string {
+	return "?"
+}
@@ -0,0 +1,38 @@
+package server
+
+// QueuePostgresDriver is the driver name of PostgreSQL, the driver github.com/lib/pq should be imported
+const QueuePostgresDriver = "postgres"
+
+// the column sizes are enforced by PostgreSQL, unlike SQLite
+var postgresCreateTableTmpls = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s
+	(
+		function VARCHAR(255),
+		handle VARCHAR(64),
+		unique_id VARCHAR(255),
+		priority SMALLINT,
+		data BYTEA,
+		reducer VARCHAR(255),
+		not_before BIGINT NOT NULL DEFAULT 0,
+		enqueued_at BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (handle)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_%[1]s_priority ON %[1]s (priority)`,
+	`CREATE INDEX IF NOT EXISTS idx_%[1]s_function ON %[1]s (function)`,
+	`CREATE INDEX IF NOT EXISTS idx_%[1]s_unique_id ON %[1]s (unique_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_%[1]s_enqueued_at ON %[1]s (enqueued_at)`,
+}
+
+const postgresTableExistsQuery = `SELECT COUNT(1) FROM information_schema.tables
+	WHERE table_schema = current_schema() AND table_name = $1`
+
+// newPostgresDialect creates the dialect for PostgreSQL(9.5+)
+// the rows being dequeued are locked and skipped by the others,
+// so multiple servers can share one queue table, the jobs submitted to the others are adopted by grabJob
+func newPostgresDialect(param *sqlQueueDialectParam) sqlQueueDialiect {
+	ds := newSQLQueueDialectSimple(param)
+	ds.createTableTmpls = postgresCreateTableTmpls
+	ds.tableExistsQuery = postgresTableExistsQuery
+	ds.lockClause = "FOR UPDATE SKIP LOCKED"
+	return ds
+}
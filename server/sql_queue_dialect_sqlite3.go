@@ -2,6 +2,10 @@ package server
 
 const QueueSqlite3Driver = "sqlite3"
 
+const sqlite3TableExistsQuery = "SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = $1"
+
 func newSqlite3Dialect(param *sqlQueueDialectParam) sqlQueueDialiect {
-	return &sqlQueueDialiectSimple{param}
+	ds := newSQLQueueDialectSimple(param)
+	ds.tableExistsQuery = sqlite3TableExistsQuery
+	return ds
 }
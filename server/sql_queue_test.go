@@ -2,10 +2,17 @@ package server
 
 import (
 	"context"
+	"database/sql"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/peonone/gearman"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -40,6 +47,13 @@ var jobs = []*job{
 		uniqueID: "reverseJob2",
 		priority: priorityMid,
 	},
+	&job{
+		function: "binary",
+		data:     "\000\001\002" + string(make([]byte, 1024)),
+		handle:   testIdGen.Generate(),
+		uniqueID: "binaryJob1",
+		priority: priorityMid,
+	},
 }
 
 func TestQueueSqlite3(t *testing.T) {
@@ -51,8 +65,208 @@ func TestQueueSqlite3(t *testing.T) {
 	testQueue(t, QueueSqlite3Driver, unittestDbFile, "gearman_queue")
 }
 
+func TestQueueSqlite3Shared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	testSharedQueue(t, QueueSqlite3Driver, filepath.Join(dir, "test.db"))
+}
+
+// testSharedQueue runs a job submitted to a jobs manager by the worker of another one sharing the queue table
+func testSharedQueue(t *testing.T, driver string, ds string) {
+	q1, err := newSQLQueue(driver, ds, "gearman_shared_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	defer q1.dispose()
+	q2, err := newSQLQueue(driver, ds, "gearman_shared_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	defer q2.dispose()
+	_, err = q1.db.Exec("DELETE FROM gearman_shared_queue")
+	assert.Nil(t, err)
+	m1 := newjobsManager(testLogger, q1, &Config{})
+	defer m1.stop()
+	m2 := newjobsManager(testLogger, q2, &Config{})
+	defer m2.stop()
+	ctx := context.Background()
+
+	j := &job{function: "echo", handle: testIdGen.Generate(), uniqueID: "shared1", data: "hello", priority: priorityHigh}
+	_, err = m1.submitJob(ctx, j, nil)
+	assert.Nil(t, err)
+	functions := supportFunctions(map[string]time.Duration{"echo": 0})
+	grabbed, err := m2.grabJob(ctx, functions, nil)
+	assert.Nil(t, err)
+	if !assert.NotNil(t, grabbed) {
+		return
+	}
+	assert.Equal(t, j.handle.String(), grabbed.handle.String())
+	assert.Equal(t, "hello", grabbed.data)
+	assert.True(t, m2.getJobStatus(ctx, j.handle, "").running)
+	assert.Equal(t, []*functionStatus{{function: "echo", running: 1}}, m2.functionsStatus())
+
+	assert.True(t, m2.updateJobStatus(ctx, j.handle, &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_COMPLETE,
+		Arguments:  []string{j.handle.String(), "hello"},
+	}, nil))
+	assert.Nil(t, loadPendingJob(m2, j.handle))
+	assert.Empty(t, m2.functionsStatus())
+	size, err := q1.size(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+}
+
+func TestQueueSqlite3Delayed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	q, err := newSQLQueue(QueueSqlite3Driver, filepath.Join(dir, "test.db"), "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	defer q.dispose()
+	testQueueDelayed(t, q)
+}
+
+// testQueueDelayed tests the jobs are dequeued only when they are due
+func testQueueDelayed(t *testing.T, q queue) {
+	bgCtx := context.Background()
+	now := time.Now()
+	delayedJob := &job{
+		function:  "echo",
+		handle:    testIdGen.Generate(),
+		uniqueID:  "delayed",
+		priority:  priorityHigh,
+		notBefore: now.Add(time.Hour),
+	}
+	dueJob := &job{
+		function:  "echo",
+		handle:    testIdGen.Generate(),
+		uniqueID:  "due",
+		priority:  priorityLow,
+		notBefore: now.Add(-time.Minute),
+	}
+	assert.Nil(t, q.enqueue(bgCtx, delayedJob))
+	assert.Nil(t, q.enqueue(bgCtx, dueJob))
+
+	j, err := q.dequeue(bgCtx, []string{"echo"})
+	assert.Nil(t, err)
+	assert.Equal(t, dueJob.handle, j.handle)
+	assert.Equal(t, dueJob.notBefore.Unix(), j.notBefore.Unix())
+	j, err = q.dequeue(bgCtx, []string{"echo"})
+	assert.Nil(t, err)
+	assert.Nil(t, j)
+	size, err := q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, size)
+
+	next, functions, err := q.nextDelayed(bgCtx, now)
+	assert.Nil(t, err)
+	assert.Equal(t, delayedJob.notBefore.Unix(), next.Unix())
+	assert.Equal(t, []string{"echo"}, functions)
+	next, functions, err = q.nextDelayed(bgCtx, delayedJob.notBefore)
+	assert.Nil(t, err)
+	assert.True(t, next.IsZero())
+	assert.Empty(t, functions)
+}
+
+func TestQueuePostgres(t *testing.T) {
+	// e.g. postgres://gearman@localhost/gearman_test?sslmode=disable
+	ds := os.Getenv("GEARMAN_TEST_POSTGRES")
+	if ds == "" {
+		t.Skip("GEARMAN_TEST_POSTGRES is not set")
+	}
+	db, err := sql.Open(QueuePostgresDriver, ds)
+	assert.Nil(t, err)
+	_, err = db.Exec("DROP TABLE IF EXISTS gearman_queue")
+	assert.Nil(t, err)
+	db.Close()
+	testQueue(t, QueuePostgresDriver, ds, "gearman_queue")
+	testSharedQueue(t, QueuePostgresDriver, ds)
+}
+
+func TestPostgresDialectQuery(t *testing.T) {
+	ds := newPostgresDialect(&sqlQueueDialectParam{table: "gearman_queue", policy: newTestPolicy(DispatchPriority, nil)}).(*sqlQueueDialiectSimple)
+	query := ds.peekQuery([]string{"echo", "reverse"})
+	assert.Contains(t, query, "WHERE function in ($1,$2)")
+	assert.Contains(t, query, "order by priority, enqueued_at LIMIT 1 FOR UPDATE SKIP LOCKED")
+}
+
+func TestQueueMySQL(t *testing.T) {
+	// e.g. gearman@tcp(localhost:3306)/gearman_test
+	ds := os.Getenv("GEARMAN_TEST_MYSQL")
+	if ds == "" {
+		t.Skip("GEARMAN_TEST_MYSQL is not set")
+	}
+	db, err := sql.Open(QueueMySQLDriver, ds)
+	assert.Nil(t, err)
+	_, err = db.Exec("DROP TABLE IF EXISTS gearman_queue")
+	assert.Nil(t, err)
+	db.Close()
+	testQueue(t, QueueMySQLDriver, ds, "gearman_queue")
+	testSharedQueue(t, QueueMySQLDriver, ds)
+}
+
+func TestMySQLDialectQuery(t *testing.T) {
+	ds := newMySQLDialect(&sqlQueueDialectParam{table: "gearman_queue", policy: newTestPolicy(DispatchPriority, nil)}).(*sqlQueueDialiectSimple)
+	query := ds.peekQuery([]string{"echo", "reverse"})
+	assert.Contains(t, query, "WHERE function in (?,?)")
+	assert.Contains(t, query, "LIMIT 1 FOR UPDATE SKIP LOCKED")
+	assert.Contains(t, ds.createTableTmpls[0], "data LONGBLOB")
+}
+
+func TestSqlite3HasQueueTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open(QueueSqlite3Driver, filepath.Join(dir, "test.db"))
+	assert.Nil(t, err)
+	defer db.Close()
+	ds := newSqlite3Dialect(&sqlQueueDialectParam{table: "gearman_queue", db: db}).(*sqlQueueDialiectSimple)
+
+	exists, err := ds.hasQueueTable()
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, ds.createQueueTable())
+	exists, err = ds.hasQueueTable()
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	// the existing table is kept
+	assert.Nil(t, ds.createQueueTable())
+}
+
+func TestSqlite3MigrateQueueTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gearman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "test.db")
+	db, err := sql.Open(QueueSqlite3Driver, dbFile)
+	assert.Nil(t, err)
+	// the table created by the versions before the delayed jobs
+	_, err = db.Exec(`CREATE TABLE gearman_queue
+		(
+			function VARCHAR(32),
+			handle VARCHAR(64),
+			unique_id VARCHAR(32),
+			priority SMALLINT,
+			data BLOB,
+			reducer VARCHAR(64),
+			PRIMARY KEY (handle)
+		)`)
+	assert.Nil(t, err)
+	db.Close()
+
+	q, err := newSQLQueue(QueueSqlite3Driver, dbFile, "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	testQueueDelayed(t, q)
+	assert.Nil(t, q.dispose())
+	// the migrated table is kept as is
+	q, err = newSQLQueue(QueueSqlite3Driver, dbFile, "gearman_queue", newTestPolicy(DispatchPriority, nil))
+	assert.Nil(t, err)
+	size, err := q.size(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, size)
+	assert.Nil(t, q.dispose())
+}
+
 func testQueue(t *testing.T, driver string, datasource string, table string) {
-	q, err := newSQLQueue(driver, unittestDbFile, "gearman_queue")
+	q, err := newSQLQueue(driver, datasource, table, newTestPolicy(DispatchPriority, nil))
 	defer func() {
 		if q != nil {
 			q.dispose()
@@ -98,11 +312,26 @@ func testQueue(t *testing.T, driver string, datasource string, table string) {
 	assert.Nil(t, err)
 	assert.Equal(t, len(jobs)-3, size)
 
+	job, err = q.dequeue(bgCtx, []string{"binary"})
+	assert.Nil(t, err)
+	assert.Equal(t, jobs[4], job)
+	size, err = q.size(bgCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(jobs)-4, size)
+
+	removed, err := q.remove(bgCtx, jobs[0].handle)
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	removed, err = q.remove(bgCtx, jobs[0].handle)
+	assert.Nil(t, err)
+	assert.False(t, removed)
+	assert.Nil(t, q.enqueue(bgCtx, jobs[0]))
+
 	assert.Nil(t, q.dispose())
 
-	q, err = newSQLQueue(driver, unittestDbFile, "gearman_queue")
+	q, err = newSQLQueue(driver, datasource, table, newTestPolicy(DispatchPriority, nil))
 	assert.Nil(t, err)
 	size, err = q.size(bgCtx)
 	assert.Nil(t, err)
-	assert.Equal(t, len(jobs)-3, size)
+	assert.Equal(t, len(jobs)-4, size)
 }
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the result table is created in the database of the sql queue
+var (
+	ansiResultCreateTableTmpls = []string{
+		`CREATE TABLE %[1]s
+		(
+			handle VARCHAR(64),
+			unique_id VARCHAR(255),
+			status VARCHAR(16),
+			data BLOB,
+			expire_at BIGINT NOT NULL,
+			PRIMARY KEY (handle)
+		)`,
+		`CREATE INDEX idx_%[1]s_unique_id ON %[1]s (unique_id)`,
+		`CREATE INDEX idx_%[1]s_expire_at ON %[1]s (expire_at)`,
+	}
+
+	postgresResultCreateTableTmpls = []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s
+		(
+			handle VARCHAR(64),
+			unique_id VARCHAR(255),
+			status VARCHAR(16),
+			data BYTEA,
+			expire_at BIGINT NOT NULL,
+			PRIMARY KEY (handle)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_%[1]s_unique_id ON %[1]s (unique_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_%[1]s_expire_at ON %[1]s (expire_at)`,
+	}
+
+	mysqlResultCreateTableTmpls = []string{
+		`CREATE TABLE IF NOT EXISTS %[1]s
+		(
+			handle VARCHAR(64),
+			unique_id VARCHAR(255),
+			status VARCHAR(16),
+			data LONGBLOB,
+			expire_at BIGINT NOT NULL,
+			PRIMARY KEY (handle),
+			INDEX idx_%[1]s_unique_id (unique_id),
+			INDEX idx_%[1]s_expire_at (expire_at)
+		) ENGINE=InnoDB`,
+	}
+
+	resultDeleteTmpl = "DELETE FROM %s WHERE handle = %s"
+
+	resultInsertTmpl = `INSERT INTO %s
+	(handle, unique_id, status, data, expire_at)
+	VALUES(%s, %s, %s, %s, %s)`
+
+	resultPurgeTmpl = "DELETE FROM %s WHERE expire_at <= %s"
+
+	resultSelectTmpl = `SELECT handle, unique_id, status, data, expire_at FROM %s
+	WHERE %s = %s AND expire_at > %s
+	ORDER BY expire_at DESC LIMIT 1`
+)
+
+// sqlResultStore keeps the results in a table, the expired results are removed on put
+// at most once per resultPurgeInterval
+type sqlResultStore struct {
+	// db is shared with the sql queue, which closes it
+	db      *sql.DB
+	table   string
+	bindVar func(i int) string
+
+	mu        sync.Mutex
+	nextPurge time.Time
+}
+
+// newSQLResultStore creates the result store with the database of the sql queue,
+// a second connection pool to the same database would contend with the queue, e.g. "database is locked" of SQLite
+func newSQLResultStore(q *sqlQueue, table string) (*sqlResultStore, error) {
+	s := &sqlResultStore{db: q.db, table: table, bindVar: dollarBindVar}
+	var tableExistsQuery string
+	var createTableTmpls []string
+	switch q.driver {
+	case QueueSqlite3Driver:
+		tableExistsQuery, createTableTmpls = sqlite3TableExistsQuery, ansiResultCreateTableTmpls
+	case QueuePostgresDriver:
+		tableExistsQuery, createTableTmpls = postgresTableExistsQuery, postgresResultCreateTableTmpls
+	case QueueMySQLDriver:
+		tableExistsQuery, createTableTmpls = mysqlTableExistsQuery, mysqlResultCreateTableTmpls
+		s.bindVar = questionBindVar
+	default:
+		return nil, errUnsupportedDialiet
+	}
+	if err := s.createTable(tableExistsQuery, createTableTmpls); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// createTable creates the result table if not exists
+func (s *sqlResultStore) createTable(tableExistsQuery string, createTableTmpls []string) error {
+	var cnt int
+	err := s.db.QueryRow(tableExistsQuery, s.table).Scan(&cnt)
+	if err != nil || cnt > 0 {
+		return err
+	}
+	for _, tmpl := range createTableTmpls {
+		if _, err = s.db.Exec(fmt.Sprintf(tmpl, s.table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shouldPurge reports whether the expired results should be removed now
+func (s *sqlResultStore) shouldPurge(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.nextPurge) {
+		s.nextPurge = now.Add(resultPurgeInterval)
+		return true
+	}
+	return false
+}
+
+func (s *sqlResultStore) put(ctx context.Context, r *jobResult) (err error) {
+	bindVar := s.bindVar
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	now := time.Now()
+	if s.shouldPurge(now) {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(resultPurgeTmpl, s.table, bindVar(1)), now.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(resultDeleteTmpl, s.table, bindVar(1)), r.handle)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(resultInsertTmpl, s.table, bindVar(1), bindVar(2), bindVar(3), bindVar(4), bindVar(5))
+	_, err = tx.ExecContext(ctx, query, r.handle, r.uniqueID, r.status, []byte(r.data), r.expireAt.Unix())
+	return err
+}
+
+func (s *sqlResultStore) get(ctx context.Context, handle string, uniqueID string) (*jobResult, error) {
+	column, key := "handle", handle
+	if handle == "" {
+		column, key = "unique_id", uniqueID
+	}
+	bindVar := s.bindVar
+	query := fmt.Sprintf(resultSelectTmpl, s.table, column, bindVar(1), bindVar(2))
+	r := new(jobResult)
+	var data []byte
+	var expireAt int64
+	err := s.db.QueryRowContext(ctx, query, key, time.Now().Unix()).Scan(
+		&r.handle, &r.uniqueID, &r.status, &data, &expireAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r.data = string(data)
+	r.expireAt = time.Unix(expireAt, 0)
+	return r, nil
+}
+
+// dispose does nothing, the database is closed by the sql queue
+func (s *sqlResultStore) dispose() error {
+	return nil
+}
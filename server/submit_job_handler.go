@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
+	"strconv"
+	"time"
 
 	"github.com/peonone/gearman"
 )
 
+const errCodeQueueFull = "queue_full"
+const errCodeShuttingDown = "shutting_down"
+const errCodeInvalidArgument = "invalid_argument"
+
 type submitJobHandler struct {
-	handleGen    *gearman.IDGenerator
+	handleGen    HandleGenerator
 	sleepManager *sleepManager
 	jobsManager  jobsManager
 	connManager  *gearman.ConnManager
@@ -23,6 +29,8 @@ func (h *submitJobHandler) supportPacketTypes() []gearman.PacketType {
 		gearman.SUBMIT_JOB_LOW_BG,
 		gearman.SUBMIT_REDUCE_JOB,
 		gearman.SUBMIT_REDUCE_JOB_BACKGROUND,
+		gearman.SUBMIT_JOB_SCHED,
+		gearman.SUBMIT_JOB_EPOCH,
 	}
 }
 
@@ -31,7 +39,8 @@ func (h *submitJobHandler) handle(ctx context.Context, m *gearman.Message, con *
 	var priority priority
 
 	switch m.PacketType {
-	case gearman.SUBMIT_JOB_BG, gearman.SUBMIT_JOB_HIGH_BG, gearman.SUBMIT_JOB_LOW_BG, gearman.SUBMIT_REDUCE_JOB_BACKGROUND:
+	case gearman.SUBMIT_JOB_BG, gearman.SUBMIT_JOB_HIGH_BG, gearman.SUBMIT_JOB_LOW_BG, gearman.SUBMIT_REDUCE_JOB_BACKGROUND,
+		gearman.SUBMIT_JOB_SCHED, gearman.SUBMIT_JOB_EPOCH:
 		bg = backgroud
 	default:
 		bg = nonBackgroud
@@ -57,31 +66,41 @@ func (h *submitJobHandler) handle(ctx context.Context, m *gearman.Message, con *
 	if bg == nonBackgroud {
 		listenConn = con
 	}
-	if m.PacketType == gearman.SUBMIT_REDUCE_JOB || m.PacketType == gearman.SUBMIT_REDUCE_JOB_BACKGROUND {
+	switch m.PacketType {
+	case gearman.SUBMIT_REDUCE_JOB, gearman.SUBMIT_REDUCE_JOB_BACKGROUND:
 		j.reducer = m.Arguments[2]
 		j.data = m.Arguments[3]
-	} else {
+	case gearman.SUBMIT_JOB_SCHED:
+		// minute, hour, day of month, month, day of week in the local time of the server
+		sched, err := parseSchedule(m.Arguments[2], m.Arguments[3], m.Arguments[4], m.Arguments[5], m.Arguments[6])
+		if err == nil {
+			j.notBefore, err = sched.next(time.Now())
+		}
+		if err != nil {
+			return true, &serverError{errCodeInvalidArgument, err}
+		}
+		j.data = m.Arguments[7]
+	case gearman.SUBMIT_JOB_EPOCH:
+		epoch, err := strconv.ParseInt(m.Arguments[2], 10, 64)
+		if err != nil {
+			return true, &serverError{errCodeInvalidArgument, err}
+		}
+		j.notBefore = time.Unix(epoch, 0)
+		j.data = m.Arguments[3]
+	default:
 		j.data = m.Arguments[2]
 	}
 	jobH, err := h.jobsManager.submitJob(ctx, j, listenConn)
-	if err != nil {
+	if err == errQueueFull {
+		return true, &serverError{errCodeQueueFull, err}
+	} else if err == errShuttingDown {
+		return true, &serverError{errCodeShuttingDown, err}
+	} else if err != nil {
 		return false, err
 	}
-	for _, sleepID := range h.sleepManager.allSleepingConnIDs() {
-		workerConn := h.connManager.GetConn(sleepID)
-		if workerConn == nil {
-			continue
-		}
-		workerConnSrv := workerConn.(*conn)
-		if workerConnSrv.supportFunctions.support(j.function) {
-			msg := gearman.MsgPool.Get()
-			defer gearman.MsgPool.Put(msg)
-			msg.MagicType = gearman.MagicRes
-			msg.PacketType = gearman.NOOP
-			msg.Arguments = nil
-			workerConn.WriteMsg(msg)
-			break
-		}
+	if j.delay(time.Now()) == 0 {
+		// the delayed jobs wake up the workers when they are due
+		h.sleepManager.wakeUp(h.connManager, j.function)
 	}
 
 	respMsg := &gearman.Message{
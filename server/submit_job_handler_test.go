@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"strconv"
 	"testing"
+	"time"
 
 	gearman "github.com/peonone/gearman"
 	"github.com/stretchr/testify/assert"
@@ -117,3 +119,99 @@ func TestSubmitJobHandlerNoopSleep(t *testing.T) {
 	assert.Equal(t, gearman.MagicRes, msg.MagicType)
 	assert.Equal(t, gearman.NOOP, msg.PacketType)
 }
+
+func TestSubmitJobHandlerNoopExclusive(t *testing.T) {
+	client := newMockSConn(10, 10)
+	sleepManager := newSleepManager()
+	jobsManager := new(mockJobsManager)
+	connManager := gearman.NewConnManager()
+	handler := &submitJobHandler{testIdGen, sleepManager, jobsManager, connManager}
+
+	var workers []*mockConn
+	for i := 0; i < 5; i++ {
+		worker := newMockSConn(10, 10)
+		worker.srvConn.canDo("echo", 0)
+		connManager.AddConn(worker.srvConn)
+		sleepManager.addSleepWorker(worker.ID())
+		workers = append(workers, worker)
+	}
+	exclusiveWorker := workers[3]
+	exclusiveWorker.srvConn.setExclusive()
+
+	ctx := context.Background()
+	jobsManager.On("submitJob", ctx, mock.Anything, mock.Anything).Return("in-param", nil).Once()
+	handler.handle(ctx, &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.SUBMIT_JOB,
+		Arguments:  []string{"echo", "123456", "hello world"},
+	}, client.srvConn)
+	for _, worker := range workers {
+		if worker == exclusiveWorker {
+			assert.Equal(t, 1, len(worker.WriteCh))
+			assert.Equal(t, gearman.NOOP, (<-worker.WriteCh).PacketType)
+		} else {
+			assert.Equal(t, 0, len(worker.WriteCh))
+		}
+	}
+}
+
+func TestSubmitJobHandlerDelayed(t *testing.T) {
+	client := newMockSConn(10, 10)
+	sleepManager := newSleepManager()
+	jobsManager := new(mockJobsManager)
+	connManager := gearman.NewConnManager()
+	handler := &submitJobHandler{testIdGen, sleepManager, jobsManager, connManager}
+	worker := newMockSConn(10, 10)
+	connManager.AddConn(worker.srvConn)
+	sleepManager.addSleepWorker(worker.ID())
+	worker.srvConn.supportFunctions.canDo("echo", 0)
+	ctx := context.Background()
+
+	epoch := time.Now().Add(time.Hour).Unix()
+	jobsManager.On("submitJob", ctx, mock.Anything, (*conn)(nil)).Return("in-param", nil)
+	msgRecyclable, err := handler.handle(ctx, &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.SUBMIT_JOB_EPOCH,
+		Arguments:  []string{"echo", "epoch1", strconv.FormatInt(epoch, 10), "hello"},
+	}, client.srvConn)
+	assert.True(t, msgRecyclable)
+	assert.Nil(t, err)
+	j := jobsManager.Calls[0].Arguments[1].(*job)
+	assert.Equal(t, time.Unix(epoch, 0), j.notBefore)
+	assert.Equal(t, "hello", j.data)
+	assert.Equal(t, gearman.JOB_CREATED, (<-client.WriteCh).PacketType)
+	// the worker is not woken up until the job is due
+	assert.Equal(t, 0, len(worker.WriteCh))
+
+	_, err = handler.handle(ctx, &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.SUBMIT_JOB_SCHED,
+		Arguments:  []string{"echo", "sched1", "30", "2", "", "", "", "hello"},
+	}, client.srvConn)
+	assert.Nil(t, err)
+	j = jobsManager.Calls[1].Arguments[1].(*job)
+	assert.Equal(t, 30, j.notBefore.Minute())
+	assert.Equal(t, 2, j.notBefore.Hour())
+	assert.True(t, j.notBefore.After(time.Now()))
+	assert.Equal(t, "hello", j.data)
+	assert.Equal(t, gearman.JOB_CREATED, (<-client.WriteCh).PacketType)
+
+	for _, args := range [][]string{
+		{"echo", "sched2", "60", "", "", "", "", "hello"},
+		{"echo", "sched2", "", "", "30", "2", "", "hello"},
+	} {
+		_, err = handler.handle(ctx, &gearman.Message{
+			MagicType:  gearman.MagicReq,
+			PacketType: gearman.SUBMIT_JOB_SCHED,
+			Arguments:  args,
+		}, client.srvConn)
+		assert.Equal(t, errCodeInvalidArgument, err.(*serverError).code)
+	}
+	_, err = handler.handle(ctx, &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.SUBMIT_JOB_EPOCH,
+		Arguments:  []string{"echo", "epoch2", "tomorrow", "hello"},
+	}, client.srvConn)
+	assert.Equal(t, errCodeInvalidArgument, err.(*serverError).code)
+	assert.Equal(t, 2, len(jobsManager.Calls))
+}
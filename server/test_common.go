@@ -9,3 +9,12 @@ import (
 
 var testIdGen = gearman.NewIDGenerator()
 var testLogger = log.New(os.Stderr, "", log.LstdFlags)
+
+// newTestPolicy creates a dispatch policy for the queues of the tests
+func newTestPolicy(name string, weights map[string]int) *dispatchPolicy {
+	policy, err := newDispatchPolicy(name, weights)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
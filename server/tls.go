@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	errInvalidClientCA    = errors.New("No certificate found in the client CA file")
+	errIncompleteTLSCert  = errors.New("Both the TLS certificate and key files are required")
+	errClientCAWithoutTLS = errors.New("The TLS certificate and key files are required to verify the client certificates")
+)
+
+// tlsConfig loads the TLS config of the server, nil if TLS is not enabled
+// the client certificates are required and verified if a client CA is configured
+func (cfg *ListenerConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			// never serve plaintext when mutual TLS is asked for
+			return nil, errClientCAWithoutTLS
+		}
+		return nil, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, errIncompleteTLSCert
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errInvalidClientCA
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman/client"
+	"github.com/peonone/gearman/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.Nil(t, err)
+	return cert
+}
+
+// generateTestCert generates a certificate signed by parent, it's self-signed if parent is nil
+func generateTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signerCert, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+// listenAddrForTest waits the server listening and returns its address
+func listenAddrForTest(t *testing.T, s *Server) string {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		listeners := s.listeners
+		s.mu.Unlock()
+		if len(listeners) > 0 {
+			return listeners[0].Addr().String()
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("server is not listening")
+	return ""
+}
+
+func TestServerTLS(t *testing.T) {
+	s, cleanup := makeServerForTest(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "gearman-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := generateTestCert(t, "test ca", nil)
+	serverCert := generateTestCert(t, "server", ca)
+	clientCert := generateTestCert(t, "client", ca)
+	s.cfg.BindAddr = "127.0.0.1:0"
+	s.cfg.TLSCertFile = writeTestFile(t, dir, "server.crt", serverCert.certPEM)
+	s.cfg.TLSKeyFile = writeTestFile(t, dir, "server.key", serverCert.keyPEM)
+	s.cfg.TLSClientCAFile = writeTestFile(t, dir, "ca.crt", ca.certPEM)
+	go s.Run()
+	defer s.Shutdown(context.Background())
+	addr := listenAddrForTest(t, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsCfg := &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert.tlsCertificate(t)},
+	}
+
+	w, err := worker.DialTLS("tcp", addr, tlsCfg)
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.Register("echo", func(j worker.Job) ([]byte, error) {
+		return j.Data, nil
+	}, 0))
+	go w.Run()
+
+	c, err := client.DialTLS("tcp", addr, tlsCfg)
+	assert.Nil(t, err)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	j, err := c.Submit(ctx, "echo", "", []byte("hello"))
+	assert.Nil(t, err)
+	data, err := j.Wait(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	// the client certificate is required
+	_, err = client.DialTLS("tcp", addr, &tls.Config{RootCAs: roots})
+	assert.NotNil(t, err)
+	// the server is not trusted
+	_, err = client.DialTLS("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{clientCert.tlsCertificate(t)},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestConfigTLS(t *testing.T) {
+	tlsCfg, err := (&ListenerConfig{}).tlsConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsCfg)
+
+	dir, err := ioutil.TempDir("", "gearman-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cert := generateTestCert(t, "server", nil)
+	cfg := &ListenerConfig{
+		TLSCertFile: writeTestFile(t, dir, "server.crt", cert.certPEM),
+		TLSKeyFile:  writeTestFile(t, dir, "server.key", cert.keyPEM),
+	}
+	tlsCfg, err = cfg.tlsConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tlsCfg.Certificates))
+	assert.Equal(t, tls.NoClientCert, tlsCfg.ClientAuth)
+
+	cfg.TLSClientCAFile = writeTestFile(t, dir, "ca.crt", []byte("not a certificate"))
+	_, err = cfg.tlsConfig()
+	assert.Equal(t, errInvalidClientCA, err)
+
+	cfg.TLSKeyFile = filepath.Join(dir, "nonexist.key")
+	_, err = cfg.tlsConfig()
+	assert.NotNil(t, err)
+
+	_, err = (&ListenerConfig{TLSCertFile: cfg.TLSCertFile}).tlsConfig()
+	assert.Equal(t, errIncompleteTLSCert, err)
+	_, err = (&ListenerConfig{TLSKeyFile: cfg.TLSKeyFile}).tlsConfig()
+	assert.Equal(t, errIncompleteTLSCert, err)
+	_, err = (&ListenerConfig{TLSClientCAFile: cfg.TLSClientCAFile}).tlsConfig()
+	assert.Equal(t, errClientCAWithoutTLS, err)
+}
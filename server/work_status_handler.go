@@ -6,6 +6,9 @@ import (
 	gearman "github.com/peonone/gearman"
 )
 
+// errCodeJobNotFound is responded to WORK_STATUS if the job is cancelled or not dispatched to the worker any more
+const errCodeJobNotFound = "job_not_found"
+
 var wsSupportPacketTypes = []gearman.PacketType{
 	gearman.WORK_STATUS, gearman.WORK_WARNING, gearman.WORK_DATA,
 	gearman.WORK_COMPLETE, gearman.WORK_FAIL, gearman.WORK_EXCEPTION,
@@ -25,6 +28,9 @@ func (h *workStatusHandler) handle(ctx context.Context, m *gearman.Message, conn
 	if err != nil {
 		return true, err
 	}
-	h.jobsManager.updateJobStatus(ctx, handle, m)
+	if !h.jobsManager.updateJobStatus(ctx, handle, m, conn) && m.PacketType == gearman.WORK_STATUS {
+		// tell the worker the job is gone, so it can stop working on it
+		return true, &serverError{errCodeJobNotFound, errJobNotFound}
+	}
 	return false, nil
 }
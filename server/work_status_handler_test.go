@@ -23,9 +23,20 @@ func TestWorkStatusHandler(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	jobsManager.On("updateJobStatus", ctx, handle, msg).Return(true).Once()
+	jobsManager.On("updateJobStatus", ctx, handle, msg, worker.srvConn).Return(true).Once()
 	msgRecyclable, err := h.handle(ctx, msg, worker.srvConn)
 	assert.False(t, msgRecyclable)
 	assert.Nil(t, err)
+
+	// the job is cancelled or not dispatched any more
+	msg = &gearman.Message{
+		MagicType:  gearman.MagicReq,
+		PacketType: gearman.WORK_STATUS,
+		Arguments:  []string{handle.String(), "1", "2"},
+	}
+	jobsManager.On("updateJobStatus", ctx, handle, msg, worker.srvConn).Return(false).Once()
+	msgRecyclable, err = h.handle(ctx, msg, worker.srvConn)
+	assert.True(t, msgRecyclable)
+	assert.Equal(t, &serverError{errCodeJobNotFound, errJobNotFound}, err)
 	jobsManager.AssertExpectations(t)
 }
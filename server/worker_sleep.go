@@ -19,21 +19,29 @@ func newSleepManager() *sleepManager {
 
 func (m *sleepManager) addSleepWorker(connID *gearman.ID) {
 	m.mu.Lock()
-	m.mu.Unlock()
+	defer m.mu.Unlock()
 
 	m.sleepConnIDs[*connID] = struct{}{}
 }
 
 func (m *sleepManager) removeSleepWorker(connID *gearman.ID) {
 	m.mu.Lock()
-	m.mu.Unlock()
+	defer m.mu.Unlock()
 
 	delete(m.sleepConnIDs, *connID)
 }
 
+func (m *sleepManager) isSleeping(connID *gearman.ID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sleepConnIDs[*connID]
+	return ok
+}
+
 func (m *sleepManager) allSleepingConnIDs() []*gearman.ID {
 	m.mu.Lock()
-	m.mu.Unlock()
+	defer m.mu.Unlock()
 	ret := make([]*gearman.ID, len(m.sleepConnIDs))
 	i := 0
 	for k := range m.sleepConnIDs {
@@ -44,3 +52,39 @@ func (m *sleepManager) allSleepingConnIDs() []*gearman.ID {
 	}
 	return ret
 }
+
+var noopMsg = &gearman.Message{
+	MagicType:  gearman.MagicRes,
+	PacketType: gearman.NOOP,
+}
+
+// wakeUp sends NOOP to one of the sleeping workers which can do the function
+// the exclusive workers(sent ALL_YOURS) are preferred as they don't take jobs from other servers
+// a worker failed to be written is dead, it's closed and another one is woken up
+func (m *sleepManager) wakeUp(connManager *gearman.ConnManager, function string) {
+	for {
+		var candidate *conn
+		for _, sleepID := range m.allSleepingConnIDs() {
+			workerConn := connManager.GetConn(sleepID)
+			if workerConn == nil {
+				continue
+			}
+			workerConnSrv := workerConn.(*conn)
+			if !workerConnSrv.supports(function) {
+				continue
+			}
+			candidate = workerConnSrv
+			if workerConnSrv.isExclusive() {
+				break
+			}
+		}
+		if candidate == nil {
+			return
+		}
+		if candidate.WriteMsg(noopMsg) == nil {
+			return
+		}
+		m.removeSleepWorker(candidate.ID())
+		candidate.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/peonone/gearman"
+)
+
+// ErrWorkFail can be returned by a JobFunc to report WORK_FAIL instead of WORK_EXCEPTION
+var ErrWorkFail = errors.New("Work failed")
+
+// ErrJobCancelled is returned by the Send methods of a job cancelled on the server
+var ErrJobCancelled = errors.New("Job cancelled")
+
+// JobFunc is the function to process a job
+// the returned data is sent back with WORK_COMPLETE if error is nil,
+// WORK_FAIL is sent if ErrWorkFail is returned,
+// and WORK_EXCEPTION with the error message is sent for the other errors
+type JobFunc func(Job) ([]byte, error)
+
+// Job is a job assigned to the worker by the server
+type Job struct {
+	Handle   string
+	Function string
+	// UniqueID is the unique ID given by the client, it can be used to make the side effects idempotent
+	UniqueID string
+	Data     []byte
+
+	w   *Worker
+	ctx context.Context
+}
+
+// Context returns the context of the job, it's cancelled once the server tells the job is cancelled,
+// which is the reply of the WORK_STATUS sent after the cancellation, the function can stop working on it then
+func (j Job) Context() context.Context {
+	if j.ctx == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// send sends a WORK_* packet of the job, ErrJobCancelled is returned if the job is cancelled
+func (j Job) send(packet gearman.PacketType, args ...string) error {
+	if j.Context().Err() != nil {
+		return ErrJobCancelled
+	}
+	return j.w.send(packet, append([]string{j.Handle}, args...)...)
+}
+
+// SendStatus reports the progress of the job with WORK_STATUS
+// the server replies it with an ERROR if the job is cancelled, then the context of the job is cancelled
+func (j Job) SendStatus(numerator int, denominator int) error {
+	return j.send(gearman.WORK_STATUS, strconv.Itoa(numerator), strconv.Itoa(denominator))
+}
+
+// MapResults decodes the sub-results sent by the mapper, it's used by the reducer of a map/reduce job
+func (j Job) MapResults() ([][]byte, error) {
+	return gearman.DecodeReduceInput(j.Data)
+}
+
+// SendData sends a chunk of the result with WORK_DATA
+// the mapper of a map/reduce job emits the sub-results with it
+func (j Job) SendData(data []byte) error {
+	return j.send(gearman.WORK_DATA, string(data))
+}
+
+// SendWarning sends a warning with WORK_WARNING
+func (j Job) SendWarning(data []byte) error {
+	return j.send(gearman.WORK_WARNING, string(data))
+}
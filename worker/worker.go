@@ -0,0 +1,303 @@
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/peonone/gearman"
+)
+
+var errFunctionNotRegistered = errors.New("Function not registered")
+
+var idGen = gearman.NewIDGenerator()
+
+// Worker is a gearman worker which grabs jobs from a gearman server and runs the registered functions
+// it runs one job at a time, run multiple workers for concurrency
+type Worker struct {
+	conn    gearman.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	funcs   map[string]JobFunc
+	closed  bool
+	// msgs are the replies read by readLoop for the loop of Run, it's closed with readErr set once the read fails
+	msgs    chan *gearman.Message
+	readErr error
+	// woken is notified when a NOOP arrives
+	woken chan struct{}
+	// cancelJob cancels the context of the running job, nil if no job is running
+	cancelJob context.CancelFunc
+}
+
+// Dial connects to the gearman server and creates a worker on the connection
+func Dial(network, addr string) (*Worker, error) {
+	netConn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewWorker(gearman.NewNetConn(netConn, idGen.Generate())), nil
+}
+
+// DialTLS connects to the gearman server over TLS and creates a worker on the connection
+// config carries the CAs to verify the server and the client certificate if the server requires one
+func DialTLS(network, addr string, config *tls.Config) (*Worker, error) {
+	netConn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewWorker(gearman.NewNetConn(netConn, idGen.Generate())), nil
+}
+
+// NewWorker creates a worker on an established connection
+func NewWorker(conn gearman.Conn) *Worker {
+	return &Worker{
+		conn:  conn,
+		funcs: make(map[string]JobFunc),
+		woken: make(chan struct{}, 1),
+	}
+}
+
+// Register registers a function to the worker and tells the server with CAN_DO
+// CAN_DO_TIMEOUT is sent instead if timeout is greater than 0
+func (w *Worker) Register(function string, fn JobFunc, timeout time.Duration) error {
+	w.mu.Lock()
+	w.funcs[function] = fn
+	w.mu.Unlock()
+	if timeout > 0 {
+		timeoutMili := int(timeout / time.Millisecond)
+		return w.send(gearman.CAN_DO_TIMEOUT, function, strconv.Itoa(timeoutMili))
+	}
+	return w.send(gearman.CAN_DO, function)
+}
+
+// Unregister removes a function from the worker and tells the server with CANT_DO
+func (w *Worker) Unregister(function string) error {
+	w.mu.Lock()
+	_, ok := w.funcs[function]
+	delete(w.funcs, function)
+	w.mu.Unlock()
+	if !ok {
+		return errFunctionNotRegistered
+	}
+	return w.send(gearman.CANT_DO, function)
+}
+
+// AllYours tells the server the worker only takes jobs from it,
+// the server prefers such workers when waking up the sleeping ones
+func (w *Worker) AllYours() error {
+	return w.send(gearman.ALL_YOURS)
+}
+
+func (w *Worker) getFunc(function string) JobFunc {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.funcs[function]
+}
+
+// Run grabs and runs jobs until the worker is closed or the connection is broken
+// it sleeps with PRE_SLEEP when there's no job, and grabs again once woken up by NOOP
+// nil is returned if the loop is ended by Close
+func (w *Worker) Run() error {
+	w.msgs = make(chan *gearman.Message)
+	done := make(chan struct{})
+	go w.readLoop(done)
+	err := w.run()
+	close(done)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	return err
+}
+
+func (w *Worker) run() error {
+	for {
+		err := w.send(gearman.GRAB_JOB_UNIQ)
+		if err != nil {
+			return err
+		}
+		msg, err := w.readGrabReply()
+		if err != nil {
+			return err
+		}
+		switch msg.PacketType {
+		case gearman.NO_JOB:
+			gearman.MsgPool.Put(msg)
+			err = w.sleep()
+		case gearman.JOB_ASSIGN_UNIQ:
+			j := Job{
+				Handle:   msg.Arguments[0],
+				Function: msg.Arguments[1],
+				UniqueID: msg.Arguments[2],
+				Data:     []byte(msg.Arguments[3]),
+				w:        w,
+			}
+			gearman.MsgPool.Put(msg)
+			err = w.runJob(j)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// errCodeJobNotFound is the ERROR responded to WORK_STATUS by the server if the job is cancelled
+const errCodeJobNotFound = "job_not_found"
+
+// readGrabReply reads until the reply of GRAB_JOB_UNIQ
+func (w *Worker) readGrabReply() (*gearman.Message, error) {
+	for {
+		msg, ok := <-w.msgs
+		if !ok {
+			return nil, w.readErr
+		}
+		switch msg.PacketType {
+		case gearman.NO_JOB, gearman.JOB_ASSIGN_UNIQ:
+			return msg, nil
+		case gearman.ERROR:
+			err := fmt.Errorf("grab job failed: %s: %s", msg.Arguments[0], msg.Arguments[1])
+			gearman.MsgPool.Put(msg)
+			return nil, err
+		}
+		gearman.MsgPool.Put(msg)
+	}
+}
+
+// sleep sends PRE_SLEEP and waits for NOOP
+func (w *Worker) sleep() error {
+	err := w.send(gearman.PRE_SLEEP)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-w.woken:
+		return nil
+	case msg, ok := <-w.msgs:
+		if !ok {
+			return w.readErr
+		}
+		// no reply is expected while sleeping
+		gearman.MsgPool.Put(msg)
+		return nil
+	}
+}
+
+// readLoop reads the connection until it's broken or done is closed
+// the packets which may arrive at any time are handled here instead of the loop of Run:
+// a NOOP may arrive at any time as the server wakes up sleeping workers on every submission,
+// and an ERROR job_not_found may arrive for the WORK_STATUS of a cancelled job
+func (w *Worker) readLoop(done <-chan struct{}) {
+	defer close(w.msgs)
+	for {
+		msg, _, err := w.conn.ReadMsg()
+		if err != nil {
+			w.readErr = err
+			return
+		}
+		if msg == nil {
+			// text message is not expected by a worker
+			continue
+		}
+		if msg.Validate(gearman.RoleWorker) != nil {
+			gearman.MsgPool.Put(msg)
+			continue
+		}
+		switch {
+		case msg.PacketType == gearman.NOOP:
+			select {
+			case w.woken <- struct{}{}:
+			default:
+			}
+			gearman.MsgPool.Put(msg)
+		case msg.PacketType == gearman.ERROR && msg.Arguments[0] == errCodeJobNotFound:
+			// the reply of a WORK_STATUS sent for a cancelled job, the server replies in order,
+			// so it arrives before the next job is assigned
+			w.mu.Lock()
+			if w.cancelJob != nil {
+				w.cancelJob()
+			}
+			w.mu.Unlock()
+			gearman.MsgPool.Put(msg)
+		default:
+			select {
+			case w.msgs <- msg:
+			case <-done:
+				gearman.MsgPool.Put(msg)
+				return
+			}
+		}
+	}
+}
+
+func (w *Worker) runJob(j Job) error {
+	fn := w.getFunc(j.Function)
+	if fn == nil {
+		// the function was unregistered after the job was grabbed
+		return w.send(gearman.WORK_FAIL, j.Handle)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.ctx = ctx
+	w.mu.Lock()
+	w.cancelJob = cancel
+	w.mu.Unlock()
+	data, err := w.callFunc(fn, j)
+	w.mu.Lock()
+	w.cancelJob = nil
+	w.mu.Unlock()
+	cancelled := ctx.Err() != nil
+	cancel()
+	switch {
+	case cancelled:
+		// the server doesn't know the job any more
+		return nil
+	case err == nil:
+		return w.send(gearman.WORK_COMPLETE, j.Handle, string(data))
+	case err == ErrWorkFail:
+		return w.send(gearman.WORK_FAIL, j.Handle)
+	default:
+		return w.send(gearman.WORK_EXCEPTION, j.Handle, err.Error())
+	}
+}
+
+func (w *Worker) callFunc(fn JobFunc, j Job) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(j)
+}
+
+func (w *Worker) send(packet gearman.PacketType, args ...string) error {
+	return w.write(gearman.MagicReq, packet, args...)
+}
+
+func (w *Worker) write(magic gearman.MagicType, packet gearman.PacketType, args ...string) error {
+	msg := gearman.MsgPool.Get()
+	defer gearman.MsgPool.Put(msg)
+	msg.MagicType = magic
+	msg.PacketType = packet
+	msg.Arguments = args
+	// the job functions may send status concurrently with the loop
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.conn.WriteMsg(msg)
+}
+
+// Close closes the connection to the server, Run returns after that
+func (w *Worker) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	return w.conn.Close()
+}
@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/peonone/gearman"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWorker() (*Worker, *gearman.NetConn) {
+	workerSide, serverSide := net.Pipe()
+	return NewWorker(gearman.NewNetConn(workerSide, idGen.Generate())),
+		gearman.NewNetConn(serverSide, idGen.Generate())
+}
+
+func writeRes(conn gearman.Conn, packet gearman.PacketType, args ...string) {
+	conn.WriteMsg(&gearman.Message{
+		MagicType:  gearman.MagicRes,
+		PacketType: packet,
+		Arguments:  args,
+	})
+}
+
+func expectReq(t *testing.T, conn gearman.Conn, packet gearman.PacketType, args ...string) {
+	msg, _, err := conn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, gearman.MagicReq, msg.MagicType)
+	assert.Equal(t, packet, msg.PacketType)
+	if len(args) > 0 {
+		assert.Equal(t, args, msg.Arguments)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	w, srvConn := newTestWorker()
+	defer w.Close()
+	fn := func(j Job) ([]byte, error) { return nil, nil }
+
+	go w.Register("echo", fn, 0)
+	expectReq(t, srvConn, gearman.CAN_DO, "echo")
+	go w.Register("reverse", fn, time.Second)
+	expectReq(t, srvConn, gearman.CAN_DO_TIMEOUT, "reverse", "1000")
+	go w.Unregister("echo")
+	expectReq(t, srvConn, gearman.CANT_DO, "echo")
+	go w.AllYours()
+	expectReq(t, srvConn, gearman.ALL_YOURS)
+
+	assert.Equal(t, errFunctionNotRegistered, w.Unregister("echo"))
+	assert.Nil(t, w.getFunc("echo"))
+	assert.NotNil(t, w.getFunc("reverse"))
+}
+
+func TestRun(t *testing.T) {
+	w, srvConn := newTestWorker()
+
+	go func() {
+		w.Register("reverse", func(j Job) ([]byte, error) {
+			assert.Equal(t, "reverse1", j.UniqueID)
+			j.SendStatus(1, 2)
+			data := make([]byte, len(j.Data))
+			for i, b := range j.Data {
+				data[len(data)-1-i] = b
+			}
+			return data, nil
+		}, 0)
+		w.Register("fail", func(j Job) ([]byte, error) {
+			return nil, ErrWorkFail
+		}, 0)
+		w.Register("exception", func(j Job) ([]byte, error) {
+			return nil, errors.New("boom")
+		}, 0)
+		w.Register("panic", func(j Job) ([]byte, error) {
+			panic("oops")
+		}, 0)
+	}()
+	for i := 0; i < 4; i++ {
+		expectReq(t, srvConn, gearman.CAN_DO)
+	}
+
+	runErr := make(chan error)
+	go func() {
+		runErr <- w.Run()
+	}()
+
+	// sleep until woken up by NOOP
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.NO_JOB)
+	expectReq(t, srvConn, gearman.PRE_SLEEP)
+	writeRes(srvConn, gearman.NOOP)
+
+	// spurious NOOP before JOB_ASSIGN_UNIQ
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.NOOP)
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:1", "reverse", "reverse1", "hello")
+	expectReq(t, srvConn, gearman.WORK_STATUS, "H:1", "1", "2")
+	expectReq(t, srvConn, gearman.WORK_COMPLETE, "H:1", "olleh")
+
+	// the reply of the WORK_STATUS if the job was cancelled
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.ERROR, "job_not_found", "Job not found")
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:2", "fail", "", "")
+	expectReq(t, srvConn, gearman.WORK_FAIL, "H:2")
+
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:3", "exception", "", "")
+	expectReq(t, srvConn, gearman.WORK_EXCEPTION, "H:3", "boom")
+
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:4", "panic", "", "")
+	expectReq(t, srvConn, gearman.WORK_EXCEPTION, "H:4", "panic: oops")
+
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:5", "unknown", "", "")
+	expectReq(t, srvConn, gearman.WORK_FAIL, "H:5")
+
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	w.Close()
+	select {
+	case err := <-runErr:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("Run did not return after Close")
+	}
+}
+
+func TestRunCancelledJob(t *testing.T) {
+	w, srvConn := newTestWorker()
+	statusErr := make(chan error, 1)
+	go w.Register("wait", func(j Job) ([]byte, error) {
+		assert.Nil(t, j.SendStatus(1, 2))
+		select {
+		case <-j.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("the job was not cancelled")
+		}
+		statusErr <- j.SendStatus(2, 2)
+		return []byte("done"), nil
+	}, 0)
+	expectReq(t, srvConn, gearman.CAN_DO, "wait")
+
+	runErr := make(chan error)
+	go func() {
+		runErr <- w.Run()
+	}()
+
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	writeRes(srvConn, gearman.JOB_ASSIGN_UNIQ, "H:1", "wait", "", "")
+	expectReq(t, srvConn, gearman.WORK_STATUS, "H:1", "1", "2")
+	writeRes(srvConn, gearman.ERROR, "job_not_found", "Job not found")
+	assert.Equal(t, ErrJobCancelled, <-statusErr)
+
+	// no WORK_COMPLETE for the cancelled job
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	w.Close()
+	select {
+	case err := <-runErr:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("Run did not return after Close")
+	}
+}
+
+func TestRunConnBroken(t *testing.T) {
+	w, srvConn := newTestWorker()
+	runErr := make(chan error)
+	go func() {
+		runErr <- w.Run()
+	}()
+	expectReq(t, srvConn, gearman.GRAB_JOB_UNIQ)
+	srvConn.Close()
+	select {
+	case err := <-runErr:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Error("Run did not return after the connection broken")
+	}
+	w.Close()
+}
+
+func TestJobMapResults(t *testing.T) {
+	results := [][]byte{[]byte("a"), []byte("b")}
+	j := Job{Data: gearman.EncodeReduceInput(results)}
+	decoded, err := j.MapResults()
+	assert.Nil(t, err)
+	assert.Equal(t, results, decoded)
+}